@@ -0,0 +1,166 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Measures the per-call cost of the Hello RPCs against an in-process server,
+//! so there is no network variance and interceptor overhead stands out.
+//!
+//! ```text
+//! cargo run --release --example hello-bench -- [concurrency] [calls]
+//! ```
+//!
+//! Reports time and heap allocations per call for unary and streaming calls,
+//! each with and without gzip. Allocations are counted process wide, so they
+//! include the server's share of each call.
+
+use std::{
+    alloc::{GlobalAlloc, Layout, System},
+    env,
+    future::Future,
+    sync::atomic::{AtomicU64, Ordering},
+    time::{Duration, Instant},
+};
+
+use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, HelloStreamRequest};
+use rsketch_server::{in_process::InProcessServer, Server};
+use tonic::{codec::CompressionEncoding, transport::Channel};
+
+const DEFAULT_CONCURRENCY: usize = 1;
+const DEFAULT_CALLS: usize = 10_000;
+/// Names per streaming call, each one answered with a message.
+const STREAM_NAMES: usize = 8;
+
+/// Counts allocations on top of the system allocator.
+struct CountingAlloc;
+
+static ALLOCATIONS: AtomicU64 = AtomicU64::new(0);
+
+unsafe impl GlobalAlloc for CountingAlloc {
+    unsafe fn alloc(&self, layout: Layout) -> *mut u8 {
+        ALLOCATIONS.fetch_add(1, Ordering::Relaxed);
+        System.alloc(layout)
+    }
+
+    unsafe fn dealloc(&self, ptr: *mut u8, layout: Layout) { System.dealloc(ptr, layout) }
+}
+
+#[global_allocator]
+static GLOBAL: CountingAlloc = CountingAlloc;
+
+#[tokio::main]
+async fn main() -> Result<(), Box<dyn std::error::Error>> {
+    let mut args = env::args().skip(1);
+    let concurrency = args.next().map_or(Ok(DEFAULT_CONCURRENCY), |s| s.parse())?;
+    let calls = args.next().map_or(Ok(DEFAULT_CALLS), |s| s.parse())?;
+
+    let server = InProcessServer::start(Server::new("in-process"));
+    let channel = server.channel();
+    println!("concurrency={concurrency} calls={calls}");
+
+    for compression in [None, Some(CompressionEncoding::Gzip)] {
+        let client = hello_client(channel.clone(), compression);
+        let label = if compression.is_some() {
+            "gzip"
+        } else {
+            "plain"
+        };
+
+        let unary = bench(concurrency, calls, || {
+            let mut client = client.clone();
+            async move {
+                let request = HelloRequest {
+                    name: "bench".to_string(),
+                };
+                client.hello(request).await.map(drop)
+            }
+        })
+        .await?;
+        report(&format!("hello_unary/{label}"), calls, unary);
+
+        let stream = bench(concurrency, calls, || {
+            let mut client = client.clone();
+            async move {
+                let request = HelloStreamRequest {
+                    names: vec!["bench".to_string(); STREAM_NAMES],
+                };
+                let mut stream = client.hello_stream(request).await?.into_inner();
+                while stream.message().await?.is_some() {}
+                Ok(())
+            }
+        })
+        .await?;
+        report(&format!("hello_stream/{label}"), calls, stream);
+    }
+
+    server.shutdown().await?;
+    Ok(())
+}
+
+fn hello_client(
+    channel: Channel,
+    compression: Option<CompressionEncoding>,
+) -> HelloClient<Channel> {
+    let client = HelloClient::new(channel);
+    match compression {
+        Some(encoding) => client.send_compressed(encoding).accept_compressed(encoding),
+        None => client,
+    }
+}
+
+/// Runs `calls` calls spread over `concurrency` tasks after a warm-up call,
+/// returning the elapsed time and the allocations made.
+async fn bench<F, Fut>(
+    concurrency: usize,
+    calls: usize,
+    call: F,
+) -> Result<(Duration, u64), tonic::Status>
+where
+    F: Fn() -> Fut,
+    Fut: Future<Output = Result<(), tonic::Status>> + Send + 'static,
+{
+    // Establishes the connection outside of the measurement.
+    call().await?;
+
+    let concurrency = concurrency.max(1);
+    let allocations = ALLOCATIONS.load(Ordering::Relaxed);
+    let start = Instant::now();
+    let tasks: Vec<_> = (0..concurrency)
+        .map(|task| {
+            // Spreads the remainder over the first tasks.
+            let share = calls / concurrency + usize::from(task < calls % concurrency);
+            let calls: Vec<_> = (0..share).map(|_| call()).collect();
+            tokio::spawn(async move {
+                for call in calls {
+                    call.await?;
+                }
+                Ok::<_, tonic::Status>(())
+            })
+        })
+        .collect();
+    for task in tasks {
+        task.await.expect("bench task panicked")?;
+    }
+    Ok((
+        start.elapsed(),
+        ALLOCATIONS.load(Ordering::Relaxed) - allocations,
+    ))
+}
+
+fn report(name: &str, calls: usize, (elapsed, allocations): (Duration, u64)) {
+    let calls = calls.max(1) as u64;
+    println!(
+        "{name:<20} {:>10} ns/op {:>8} allocs/op",
+        elapsed.as_nanos() / u128::from(calls),
+        allocations / calls
+    );
+}
@@ -0,0 +1,59 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::{env, time::Duration};
+
+use api::pb::v1::hello::HelloStreamRequest;
+use rsketch_client::ClientBuilder;
+
+/// Bounds every call so a dead server surfaces as an error instead of a hang.
+const REQUEST_TIMEOUT: Duration = Duration::from_secs(3);
+
+/// How long to give a server that is still starting.
+const READY_TIMEOUT: Duration = Duration::from_secs(10);
+
+#[tokio::main]
+async fn main() -> Result<(), Box<dyn std::error::Error>> {
+    // The connection is established on the first call rather than up front.
+    let client = ClientBuilder::new("localhost:50051")
+        .with_connect_timeout(REQUEST_TIMEOUT)
+        .with_timeout(REQUEST_TIMEOUT)
+        .connect()?;
+    client.wait_for_ready(READY_TIMEOUT).await?;
+
+    // `--info` prints what the server reports about its build.
+    if env::args().any(|arg| arg == "--info") {
+        let info = client.get_info().await?;
+        println!(
+            "server {} (commit {}, built {} with {})",
+            info.version, info.git_commit, info.build_time, info.rustc_version
+        );
+    }
+
+    // Both calls share the client's single connection.
+    println!("{}", client.hello("world").await?);
+
+    let mut stream = client
+        .hello_client()
+        .hello_stream(HelloStreamRequest {
+            names: vec!["alice".to_string(), "bob".to_string()],
+        })
+        .await?
+        .into_inner();
+    // `message` yields `None` once the server closes the stream.
+    while let Some(response) = stream.message().await? {
+        println!("{}", response.message);
+    }
+    Ok(())
+}
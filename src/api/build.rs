@@ -21,10 +21,34 @@ fn main() {
     );
 
     const EQ_ATTR: &str = "#[derive(serde::Serialize, serde::Deserialize,  Eq)]";
+    // Added after the derives, renders messages like the protobuf JSON
+    // mapping, see `src/json.rs`.
+    const JSON_ATTR: &str = "#[serde(rename_all = \"camelCase\")]";
+    const BYTES_ATTR: &str = "#[serde(with = \"crate::json::bytes\")]";
+    const TIMESTAMP_ATTR: &str = "#[serde(serialize_with = \"crate::json::timestamp\")]";
 
     tonic_build::configure()
         .file_descriptor_set_path(out_dir.join("rsketch_grpc_desc.bin"))
-        .type_attribute("rsketch.v1.hello.Message", EQ_ATTR)
-        .compile(&["proto/v1/hello/hello.proto"], &["proto"])
+        .type_attribute("rsketch.v1.hello.HelloRequest", EQ_ATTR)
+        .type_attribute("rsketch.v1.hello.HelloStreamRequest", EQ_ATTR)
+        .type_attribute("rsketch.v1.hello.HelloResponse", EQ_ATTR)
+        .type_attribute("rsketch.v1.hello.ListGreetingsRequest", EQ_ATTR)
+        .type_attribute("rsketch.v1.hello.ListGreetingsResponse", EQ_ATTR)
+        .type_attribute("rsketch.v1.hello.PingRequest", EQ_ATTR)
+        .type_attribute("rsketch.v1.hello.PingResponse", EQ_ATTR)
+        .type_attribute("rsketch.v1.hello.InfoResponse", EQ_ATTR)
+        .type_attribute("rsketch.v2.hello.HelloRequest", EQ_ATTR)
+        .type_attribute(
+            "rsketch.v2.hello.HelloResponse",
+            "#[derive(serde::Serialize)]",
+        )
+        .type_attribute(".rsketch", JSON_ATTR)
+        .field_attribute("rsketch.v1.hello.PingRequest.payload", BYTES_ATTR)
+        .field_attribute("rsketch.v1.hello.PingResponse.payload", BYTES_ATTR)
+        .field_attribute("rsketch.v2.hello.HelloResponse.served_at", TIMESTAMP_ATTR)
+        .compile(
+            &["proto/v1/hello/hello.proto", "proto/v2/hello/hello.proto"],
+            &["proto"],
+        )
         .expect("compile proto");
 }
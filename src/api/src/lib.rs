@@ -14,6 +14,9 @@
 
 pub use serde;
 
+mod json;
+pub mod validate;
+
 pub mod pb {
     pub const GRPC_DESC: &[u8] = tonic::include_file_descriptor_set!("rsketch_grpc_desc");
 
@@ -22,4 +25,10 @@ pub mod pb {
             tonic::include_proto!("rsketch.v1.hello");
         }
     }
+
+    pub mod v2 {
+        pub mod hello {
+            tonic::include_proto!("rsketch.v2.hello");
+        }
+    }
 }
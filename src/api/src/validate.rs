@@ -0,0 +1,91 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Field level validation of request messages, enforcing the constraints
+//! documented in the protos.
+
+use std::fmt;
+
+use crate::pb::{
+    v1::hello::{HelloRequest, HelloStreamRequest},
+    v2,
+};
+
+/// The longest name accepted, in characters.
+pub const MAX_NAME_LEN: usize = 256;
+
+/// A request field that breaks one of its constraints.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct FieldViolation {
+    /// Path of the offending field, e.g. `names[2]`.
+    pub field:       String,
+    pub description: String,
+}
+
+impl fmt::Display for FieldViolation {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}: {}", self.field, self.description)
+    }
+}
+
+/// A message whose fields can be checked against their constraints.
+pub trait Validate {
+    /// Returns every violated constraint, or `Ok` if there are none.
+    fn validate(&self) -> Result<(), Vec<FieldViolation>>;
+}
+
+impl Validate for HelloRequest {
+    fn validate(&self) -> Result<(), Vec<FieldViolation>> {
+        into_result(validate_name("name", &self.name).into_iter().collect())
+    }
+}
+
+impl Validate for v2::hello::HelloRequest {
+    fn validate(&self) -> Result<(), Vec<FieldViolation>> {
+        into_result(validate_name("name", &self.name).into_iter().collect())
+    }
+}
+
+impl Validate for HelloStreamRequest {
+    fn validate(&self) -> Result<(), Vec<FieldViolation>> {
+        into_result(
+            self.names
+                .iter()
+                .enumerate()
+                .filter_map(|(i, name)| validate_name(&format!("names[{i}]"), name))
+                .collect(),
+        )
+    }
+}
+
+fn validate_name(field: &str, name: &str) -> Option<FieldViolation> {
+    let description = if name.chars().count() > MAX_NAME_LEN {
+        format!("must be at most {MAX_NAME_LEN} characters")
+    } else if name.chars().any(char::is_control) {
+        "must not contain control characters".to_string()
+    } else {
+        return None;
+    };
+    Some(FieldViolation {
+        field: field.to_string(),
+        description,
+    })
+}
+
+fn into_result(violations: Vec<FieldViolation>) -> Result<(), Vec<FieldViolation>> {
+    if violations.is_empty() {
+        Ok(())
+    } else {
+        Err(violations)
+    }
+}
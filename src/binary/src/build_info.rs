@@ -12,6 +12,8 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+use rsketch_server::BuildInfo;
+
 mod built {
     include!(concat!(env!("OUT_DIR"), "/built.rs"));
 }
@@ -41,4 +43,14 @@ pub const FULL_VERSION: &str = {
         const_format::concatcp!(built::PKG_VERSION, UNOFFICIAL_SUFFIX)
     }
 };
+/// What the `GetInfo` RPC reports about this build.
+pub fn server_build_info() -> BuildInfo {
+    BuildInfo {
+        version:       FULL_VERSION.to_string(),
+        git_commit:    built::GIT_COMMIT_HASH.unwrap_or_default().to_string(),
+        build_time:    built::BUILT_TIME_UTC.to_string(),
+        rustc_version: built::RUSTC_VERSION.to_string(),
+    }
+}
+
 const fn is_official_release() -> bool { option_env!("KISEKI_RELEASE").is_some() }
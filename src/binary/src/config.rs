@@ -0,0 +1,296 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Server settings read from `RSKETCH_*` environment variables, which
+//! command-line flags override.
+//!
+//! | Variable                     | Default           |
+//! |------------------------------|-------------------|
+//! | `RSKETCH_ADDR`               | `127.0.0.1:50051` |
+//! | `RSKETCH_TLS_CERT`           | unset, plaintext  |
+//! | `RSKETCH_TLS_KEY`            | unset, plaintext  |
+//! | `RSKETCH_METRICS_ADDR`       | unset, disabled   |
+//! | `RSKETCH_GATEWAY_ADDR`       | unset, disabled   |
+//! | `RSKETCH_GATEWAY_CA`         | unset             |
+//! | `RSKETCH_LOG_LEVEL`          | `info`            |
+//! | `RSKETCH_DRAIN_TIMEOUT_SECS` | `30`              |
+//! | `RSKETCH_METHOD_TIMEOUTS`    | unset, none       |
+//! | `RSKETCH_DEFAULT_TIMEOUT`    | unset, none       |
+//!
+//! `RSKETCH_METHOD_TIMEOUTS` lists the deadlines given to calls arriving
+//! without one as comma-separated `method=timeout` pairs, such as
+//! `/rsketch.v1.hello.Hello/HelloStream=5m,/rsketch.v1.hello.Hello/Hello=2s`.
+//! `RSKETCH_DEFAULT_TIMEOUT` covers the other unary methods. Timeouts take an
+//! `ms`, `s`, `m` or `h` unit.
+//!
+//! The gateway dials the server at `RSKETCH_ADDR`. When the server serves
+//! TLS, the gateway verifies its certificate against the PEM CA certificate
+//! in `RSKETCH_GATEWAY_CA`, which is then required, and the certificate must
+//! name the host of `RSKETCH_ADDR`.
+
+use std::{path::PathBuf, time::Duration};
+
+use rsketch_common::env::{var, var_parsed};
+use rsketch_server::DEFAULT_DRAIN_TIMEOUT;
+use snafu::{whatever, Whatever};
+
+pub const DEFAULT_ADDR: &str = "127.0.0.1:50051";
+
+const ENV_PREFIX: &str = "RSKETCH_";
+
+/// The certificate chain and private key files to serve TLS with.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TlsConfig {
+    pub cert: PathBuf,
+    pub key:  PathBuf,
+}
+
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct ServerConfig {
+    pub addr:            String,
+    pub tls:             Option<TlsConfig>,
+    pub metrics_addr:    Option<String>,
+    pub gateway_addr:    Option<String>,
+    /// The CA certificate the gateway verifies the server's TLS certificate
+    /// against.
+    pub gateway_ca:      Option<PathBuf>,
+    /// A tracing filter directive, `None` keeps the logger's default.
+    pub log_level:       Option<String>,
+    pub drain_timeout:   Duration,
+    /// Default deadlines of full method names, checked against the served
+    /// methods when the server starts.
+    pub method_timeouts: Vec<(String, Duration)>,
+    pub default_timeout: Option<Duration>,
+}
+
+impl Default for ServerConfig {
+    fn default() -> Self {
+        Self {
+            addr:            DEFAULT_ADDR.to_string(),
+            tls:             None,
+            metrics_addr:    None,
+            gateway_addr:    None,
+            gateway_ca:      None,
+            log_level:       None,
+            drain_timeout:   DEFAULT_DRAIN_TIMEOUT,
+            method_timeouts: Vec::new(),
+            default_timeout: None,
+        }
+    }
+}
+
+/// Settings given on the command line, each replacing its environment
+/// variable when set.
+#[derive(Debug, Clone, Default)]
+pub struct Overrides {
+    pub addr:               Option<String>,
+    pub tls_cert:           Option<PathBuf>,
+    pub tls_key:            Option<PathBuf>,
+    pub metrics_addr:       Option<String>,
+    pub gateway_addr:       Option<String>,
+    pub gateway_ca:         Option<PathBuf>,
+    pub log_level:          Option<String>,
+    pub drain_timeout_secs: Option<u64>,
+    pub method_timeouts:    Option<String>,
+    pub default_timeout:    Option<String>,
+}
+
+impl ServerConfig {
+    /// Loads the configuration from the environment, then applies
+    /// `overrides` on top.
+    ///
+    /// Fails on values that don't parse, when only one of the TLS
+    /// certificate and key is given, and when the gateway is to dial a TLS
+    /// server without a CA certificate to verify it with.
+    pub fn load(overrides: Overrides) -> Result<Self, Whatever> {
+        let defaults = Self::default();
+        let addr = overrides.addr.or(env("ADDR")?).unwrap_or(defaults.addr);
+        let tls_cert = overrides.tls_cert.or(env_parsed("TLS_CERT")?);
+        let tls_key = overrides.tls_key.or(env_parsed("TLS_KEY")?);
+        let tls = match (tls_cert, tls_key) {
+            (Some(cert), Some(key)) => Some(TlsConfig { cert, key }),
+            (None, None) => None,
+            _ => whatever!("TLS needs both a certificate and a key, only one was given"),
+        };
+        let gateway_addr = overrides.gateway_addr.or(env("GATEWAY_ADDR")?);
+        let gateway_ca = overrides.gateway_ca.or(env_parsed("GATEWAY_CA")?);
+        if tls.is_some() && gateway_addr.is_some() && gateway_ca.is_none() {
+            whatever!(
+                "The gateway dials the server over TLS, set RSKETCH_GATEWAY_CA to the CA \
+                 certificate to verify it with"
+            );
+        }
+        let drain_timeout = overrides
+            .drain_timeout_secs
+            .or(env_parsed("DRAIN_TIMEOUT_SECS")?)
+            .map_or(defaults.drain_timeout, Duration::from_secs);
+        let method_timeouts = match overrides.method_timeouts.or(env("METHOD_TIMEOUTS")?) {
+            Some(pairs) => parse_method_timeouts(&pairs)?,
+            None => defaults.method_timeouts,
+        };
+        let default_timeout = overrides
+            .default_timeout
+            .or(env("DEFAULT_TIMEOUT")?)
+            .map(|timeout| parse_timeout(&timeout))
+            .transpose()?;
+
+        Ok(Self {
+            addr,
+            tls,
+            metrics_addr: overrides.metrics_addr.or(env("METRICS_ADDR")?),
+            gateway_addr,
+            gateway_ca,
+            log_level: overrides.log_level.or(env("LOG_LEVEL")?),
+            drain_timeout,
+            method_timeouts,
+            default_timeout,
+        })
+    }
+}
+
+/// Parses comma-separated `method=timeout` pairs.
+fn parse_method_timeouts(pairs: &str) -> Result<Vec<(String, Duration)>, Whatever> {
+    pairs
+        .split(',')
+        .map(str::trim)
+        .filter(|pair| !pair.is_empty())
+        .map(|pair| match pair.split_once('=') {
+            Some((method, timeout)) => Ok((method.trim().to_string(), parse_timeout(timeout)?)),
+            None => whatever!("Method timeout {pair:?} isn't a method=timeout pair"),
+        })
+        .collect()
+}
+
+/// Parses a timeout like `300ms`, `2s`, `5m` or `1h`.
+fn parse_timeout(timeout: &str) -> Result<Duration, Whatever> {
+    let timeout = timeout.trim();
+    let split = timeout
+        .find(|c: char| !c.is_ascii_digit())
+        .unwrap_or(timeout.len());
+    let (value, unit) = timeout.split_at(split);
+    let Ok(value) = value.parse::<u64>() else {
+        whatever!("Timeout {timeout:?} doesn't start with a number")
+    };
+    let secs = match unit {
+        "ms" => return Ok(Duration::from_millis(value)),
+        "s" => Some(value),
+        "m" => value.checked_mul(60),
+        "h" => value.checked_mul(60 * 60),
+        _ => whatever!("Timeout {timeout:?} needs a unit of ms, s, m or h"),
+    };
+    let Some(secs) = secs else {
+        whatever!("Timeout {timeout:?} is too long")
+    };
+    Ok(Duration::from_secs(secs))
+}
+
+fn env(name: &str) -> Result<Option<String>, Whatever> { var(&format!("{ENV_PREFIX}{name}")) }
+
+fn env_parsed<T>(name: &str) -> Result<Option<T>, Whatever>
+where
+    T: std::str::FromStr,
+    T::Err: std::error::Error + Send + Sync + 'static,
+{
+    var_parsed(&format!("{ENV_PREFIX}{name}"))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn parses_timeouts_in_every_unit() {
+        assert_eq!(parse_timeout("300ms").unwrap(), Duration::from_millis(300));
+        assert_eq!(parse_timeout("2s").unwrap(), Duration::from_secs(2));
+        assert_eq!(parse_timeout(" 5m ").unwrap(), Duration::from_secs(5 * 60));
+        assert_eq!(parse_timeout("1h").unwrap(), Duration::from_secs(60 * 60));
+        assert!(parse_timeout("5").is_err());
+        assert!(parse_timeout("m").is_err());
+        assert!(parse_timeout("5d").is_err());
+    }
+
+    #[test]
+    fn rejects_timeouts_overflowing_a_duration() {
+        let err = parse_timeout(&format!("{}h", u64::MAX)).unwrap_err();
+        assert!(err.to_string().contains("too long"), "{err}");
+        let err = parse_timeout(&format!("{}m", u64::MAX / 2)).unwrap_err();
+        assert!(err.to_string().contains("too long"), "{err}");
+    }
+
+    /// The only test touching the environment, which is shared by every
+    /// test of the process.
+    #[test]
+    fn loads_from_the_environment_under_the_overrides() {
+        let vars = [
+            ("ADDR", "0.0.0.0:6000"),
+            ("TLS_CERT", "/etc/rsketch/cert.pem"),
+            ("TLS_KEY", "/etc/rsketch/key.pem"),
+            ("METRICS_ADDR", "0.0.0.0:9090"),
+            ("GATEWAY_ADDR", "0.0.0.0:8080"),
+            ("GATEWAY_CA", "/etc/rsketch/ca.pem"),
+            ("LOG_LEVEL", "debug"),
+            ("DRAIN_TIMEOUT_SECS", "5"),
+            (
+                "METHOD_TIMEOUTS",
+                "/rsketch.v1.hello.Hello/HelloStream=5m, /rsketch.v1.hello.Hello/Hello=2s",
+            ),
+            ("DEFAULT_TIMEOUT", "500ms"),
+        ];
+        for (name, value) in vars {
+            std::env::set_var(format!("{ENV_PREFIX}{name}"), value);
+        }
+
+        let loaded = ServerConfig::load(Overrides::default());
+        let overridden = ServerConfig::load(Overrides {
+            addr: Some("127.0.0.1:7000".to_string()),
+            drain_timeout_secs: Some(1),
+            ..Overrides::default()
+        });
+        for (name, _) in vars {
+            std::env::remove_var(format!("{ENV_PREFIX}{name}"));
+        }
+
+        let loaded = loaded.unwrap();
+        assert_eq!(
+            loaded,
+            ServerConfig {
+                addr:            "0.0.0.0:6000".to_string(),
+                tls:             Some(TlsConfig {
+                    cert: PathBuf::from("/etc/rsketch/cert.pem"),
+                    key:  PathBuf::from("/etc/rsketch/key.pem"),
+                }),
+                metrics_addr:    Some("0.0.0.0:9090".to_string()),
+                gateway_addr:    Some("0.0.0.0:8080".to_string()),
+                gateway_ca:      Some(PathBuf::from("/etc/rsketch/ca.pem")),
+                log_level:       Some("debug".to_string()),
+                drain_timeout:   Duration::from_secs(5),
+                method_timeouts: vec![
+                    (
+                        "/rsketch.v1.hello.Hello/HelloStream".to_string(),
+                        Duration::from_secs(5 * 60),
+                    ),
+                    (
+                        "/rsketch.v1.hello.Hello/Hello".to_string(),
+                        Duration::from_secs(2),
+                    ),
+                ],
+                default_timeout: Some(Duration::from_millis(500)),
+            }
+        );
+
+        let overridden = overridden.unwrap();
+        assert_eq!(overridden.addr, "127.0.0.1:7000");
+        assert_eq!(overridden.drain_timeout, Duration::from_secs(1));
+        assert_eq!(overridden.log_level, loaded.log_level);
+    }
+}
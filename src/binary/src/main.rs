@@ -12,9 +12,17 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+use std::path::PathBuf;
+
 use clap::{Args, Parser, Subcommand};
-use snafu::Whatever;
+use rsketch_common::logger::{init_global_logging, LoggingOptions};
+use rsketch_server::{gateway, Server};
+use snafu::{whatever, ResultExt, Whatever};
+
+use crate::config::{Overrides, ServerConfig};
+
 mod build_info;
+mod config;
 
 #[derive(Debug, Parser)]
 #[clap(
@@ -30,6 +38,7 @@ struct Cli {
 #[derive(Debug, Subcommand)]
 enum Commands {
     Hello(HelloArgs),
+    Server(ServerArgs),
 }
 
 #[derive(Debug, Clone, Args)]
@@ -50,9 +59,175 @@ impl HelloArgs {
     }
 }
 
+#[derive(Debug, Clone, Args)]
+#[command(flatten_help = true)]
+#[command(long_about = r"
+
+Start the gRPC server, SIGINT or SIGTERM shuts it down gracefully.
+Every flag can also be set through its RSKETCH_* environment variable.
+Examples:
+
+rsketch server --addr 127.0.0.1:50051
+RSKETCH_METRICS_ADDR=127.0.0.1:9090 rsketch server
+")]
+struct ServerArgs {
+    /// Address to listen on [env: RSKETCH_ADDR] [default: 127.0.0.1:50051].
+    #[arg(long)]
+    addr:               Option<String>,
+    /// PEM certificate chain to serve TLS with, together with --tls-key
+    /// [env: RSKETCH_TLS_CERT].
+    #[arg(long)]
+    tls_cert:           Option<PathBuf>,
+    /// PEM private key to serve TLS with [env: RSKETCH_TLS_KEY].
+    #[arg(long)]
+    tls_key:            Option<PathBuf>,
+    /// Address to serve Prometheus metrics on, disabled when unset
+    /// [env: RSKETCH_METRICS_ADDR].
+    #[arg(long)]
+    metrics_addr:       Option<String>,
+    /// Address to serve the HTTP/JSON gateway on, disabled when unset
+    /// [env: RSKETCH_GATEWAY_ADDR].
+    #[arg(long)]
+    gateway_addr:       Option<String>,
+    /// PEM CA certificate the gateway verifies the server's TLS certificate
+    /// with, required with TLS and the gateway [env: RSKETCH_GATEWAY_CA].
+    #[arg(long)]
+    gateway_ca:         Option<PathBuf>,
+    /// Log filter such as `debug` [env: RSKETCH_LOG_LEVEL] [default: info].
+    #[arg(long)]
+    log_level:          Option<String>,
+    /// Seconds in-flight requests get to finish during shutdown
+    /// [env: RSKETCH_DRAIN_TIMEOUT_SECS] [default: 30].
+    #[arg(long)]
+    drain_timeout_secs: Option<u64>,
+    /// Deadlines given to calls arriving without one, as comma-separated
+    /// `method=timeout` pairs like `/rsketch.v1.hello.Hello/Hello=2s`
+    /// [env: RSKETCH_METHOD_TIMEOUTS].
+    #[arg(long)]
+    method_timeouts:    Option<String>,
+    /// Deadline given to calls of other unary methods arriving without one,
+    /// like `2s` [env: RSKETCH_DEFAULT_TIMEOUT].
+    #[arg(long)]
+    default_timeout:    Option<String>,
+}
+
+impl ServerArgs {
+    fn run(&self) -> Result<(), Whatever> {
+        let config = ServerConfig::load(Overrides {
+            addr:               self.addr.clone(),
+            tls_cert:           self.tls_cert.clone(),
+            tls_key:            self.tls_key.clone(),
+            metrics_addr:       self.metrics_addr.clone(),
+            gateway_addr:       self.gateway_addr.clone(),
+            gateway_ca:         self.gateway_ca.clone(),
+            log_level:          self.log_level.clone(),
+            drain_timeout_secs: self.drain_timeout_secs,
+            method_timeouts:    self.method_timeouts.clone(),
+            default_timeout:    self.default_timeout.clone(),
+        })?;
+        let logging = LoggingOptions {
+            level: config.log_level.clone(),
+            ..LoggingOptions::default()
+        };
+        let _guards = init_global_logging("rsketch", &logging);
+        let runtime = tokio::runtime::Builder::new_multi_thread()
+            .enable_all()
+            .build()
+            .whatever_context("Failed to build tokio runtime")?;
+
+        let server = build_server(&config)?;
+        runtime.block_on(async {
+            let gateway = match &config.gateway_addr {
+                Some(addr) => Some(spawn_gateway(addr, &config).await?),
+                None => None,
+            };
+            let result = server
+                .run(shutdown_signal())
+                .await
+                .whatever_context("gRPC server failed");
+            if let Some(gateway) = gateway {
+                gateway.abort();
+            }
+            result
+        })
+    }
+}
+
+fn build_server(config: &ServerConfig) -> Result<Server, Whatever> {
+    let mut server = Server::new(config.addr.clone())
+        .with_drain_timeout(config.drain_timeout)
+        .with_default_interceptors()
+        .with_build_info(build_info::server_build_info());
+    if !config.method_timeouts.is_empty() || config.default_timeout.is_some() {
+        server =
+            server.with_default_timeouts(config.method_timeouts.clone(), config.default_timeout);
+    }
+    if let Some(tls) = &config.tls {
+        server = server
+            .with_tls(&tls.cert, &tls.key)
+            .whatever_context("Failed to configure TLS")?;
+    }
+    if let Some(addr) = &config.metrics_addr {
+        server = server
+            .with_metrics(prometheus::default_registry().clone())
+            .whatever_context("Failed to register metrics")?
+            .with_metrics_addr(addr.clone());
+    }
+    Ok(server)
+}
+
+/// Serves the gateway on `addr`, forwarding to the configured server over TLS
+/// when it serves TLS.
+async fn spawn_gateway(
+    addr: &str,
+    config: &ServerConfig,
+) -> Result<tokio::task::JoinHandle<rsketch_server::error::Result<()>>, Whatever> {
+    let listener = tokio::net::TcpListener::bind(addr)
+        .await
+        .with_whatever_context(|_| format!("Failed to listen on {addr}"))?;
+    let backend = match (&config.tls, &config.gateway_ca) {
+        (Some(_), Some(ca)) => rsketch_client::dial_tls(&config.addr, ca),
+        (Some(_), None) => {
+            whatever!("The gateway needs a CA certificate to dial the server over TLS")
+        }
+        (None, _) => rsketch_client::dial(&config.addr),
+    }
+    .whatever_context("Failed to dial the gRPC server")?;
+    Ok(tokio::spawn(gateway::serve(
+        listener,
+        backend,
+        gateway::DEFAULT_TIMEOUT,
+    )))
+}
+
+/// Resolves once the process receives SIGINT or SIGTERM.
+async fn shutdown_signal() {
+    let interrupt = async {
+        tokio::signal::ctrl_c()
+            .await
+            .expect("failed to install SIGINT handler");
+    };
+
+    #[cfg(unix)]
+    let terminate = async {
+        tokio::signal::unix::signal(tokio::signal::unix::SignalKind::terminate())
+            .expect("failed to install SIGTERM handler")
+            .recv()
+            .await;
+    };
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    tokio::select! {
+        _ = interrupt => {},
+        _ = terminate => {},
+    }
+}
+
 fn main() -> Result<(), Whatever> {
     let cli = Cli::parse();
     match cli.commands {
         Commands::Hello(ha) => ha.run(),
+        Commands::Server(sa) => sa.run(),
     }
 }
@@ -0,0 +1,320 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Client side load balancing across every address a DNS name resolves to.
+//!
+//! The name is resolved again periodically and calls are rebalanced over the
+//! addresses found, connecting to new backends and dropping removed ones.
+//! [LoadBalancing] selects how calls are spread, round robin by default as in
+//! gRPC.
+
+use std::{
+    collections::{BTreeMap, BTreeSet},
+    net::SocketAddr,
+    str::FromStr,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc,
+    },
+    task::{Context, Poll},
+    time::Duration,
+};
+
+use tokio::sync::{mpsc::Sender, watch};
+use tonic::{
+    body::BoxBody,
+    transport::{Body, Channel, Endpoint},
+};
+use tower::{discover::Change, Service, ServiceExt};
+use tracing::warn;
+
+use crate::{
+    error::{Error, Result, UnknownLoadBalancingSnafu},
+    BoxFuture,
+};
+
+/// Prefix of targets resolved through DNS, e.g.
+/// `dns:///hello.svc.cluster.local:50051`.
+const DNS_SCHEME: &str = "dns:///";
+
+/// How often a DNS target is resolved again by default.
+pub const DEFAULT_DNS_REFRESH: Duration = Duration::from_secs(30);
+
+/// How many endpoint changes may queue up before the balancer takes them.
+const CHANGE_BUFFER: usize = 64;
+
+/// How calls to a `dns:///` target are spread over its backends.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum LoadBalancing {
+    /// Sends calls to each backend in turn, gRPC's `round_robin`.
+    #[default]
+    RoundRobin,
+    /// Sends each call to the less loaded of two random backends, steering
+    /// around slow backends.
+    PowerOfTwoChoices,
+}
+
+impl FromStr for LoadBalancing {
+    type Err = Error;
+
+    /// Parses `round_robin` or `p2c`.
+    fn from_str(name: &str) -> Result<Self> {
+        match name {
+            "round_robin" => Ok(Self::RoundRobin),
+            "p2c" => Ok(Self::PowerOfTwoChoices),
+            _ => UnknownLoadBalancingSnafu { name }.fail(),
+        }
+    }
+}
+
+/// Returns the `host:port` of a DNS target.
+pub(crate) fn dns_target(addr: &str) -> Option<&str> { addr.strip_prefix(DNS_SCHEME) }
+
+/// Returns a channel balancing over the addresses `target` resolves to with
+/// the power of two choices, resolving it again every `refresh`.
+///
+/// `endpoint` configures the connection to each resolved address.
+pub(crate) fn dns_channel<F>(target: String, refresh: Duration, endpoint: F) -> Channel
+where
+    F: Fn(SocketAddr) -> Result<Endpoint> + Send + 'static,
+{
+    let (channel, changes) = Channel::balance_channel(CHANGE_BUFFER);
+    let (addrs, resolved) = watch::channel(BTreeSet::new());
+    tokio::spawn(resolve(target, refresh, addrs));
+    tokio::spawn(feed_balancer(resolved, endpoint, changes));
+    channel
+}
+
+/// Returns a [RoundRobin] over the addresses `target` resolves to, resolving
+/// it again every `refresh`.
+pub(crate) fn dns_round_robin<F>(target: String, refresh: Duration, endpoint: F) -> RoundRobin
+where
+    F: Fn(SocketAddr) -> Result<Endpoint> + Send + 'static,
+{
+    let (addrs, resolved) = watch::channel(BTreeSet::new());
+    tokio::spawn(resolve(target, refresh, addrs));
+    RoundRobin::new(resolved, endpoint)
+}
+
+/// Resolves `target` every `refresh` into `addrs`, until nothing watches
+/// them anymore.
+async fn resolve(target: String, refresh: Duration, addrs: watch::Sender<BTreeSet<SocketAddr>>) {
+    let mut interval = tokio::time::interval(refresh);
+    while !addrs.is_closed() {
+        interval.tick().await;
+        let resolved: BTreeSet<SocketAddr> = match tokio::net::lookup_host(&target).await {
+            Ok(resolved) => resolved.collect(),
+            Err(err) => {
+                warn!("failed to resolve {target}: {err}");
+                continue;
+            }
+        };
+        // Keep the last known backends rather than failing every call.
+        if resolved.is_empty() {
+            warn!("{target} resolved to no addresses");
+            continue;
+        }
+        addrs.send_if_modified(|known| {
+            let changed = *known != resolved;
+            *known = resolved;
+            changed
+        });
+    }
+}
+
+/// Turns the resolved addresses into the changes tower's balancer takes,
+/// until every clone of its channel is dropped.
+async fn feed_balancer<F>(
+    mut resolved: watch::Receiver<BTreeSet<SocketAddr>>,
+    endpoint: F,
+    changes: Sender<Change<SocketAddr, Endpoint>>,
+) where
+    F: Fn(SocketAddr) -> Result<Endpoint>,
+{
+    let mut known = BTreeSet::new();
+    loop {
+        tokio::select! {
+            changed = resolved.changed() => if changed.is_err() {
+                return;
+            },
+            () = changes.closed() => return,
+        }
+        let addrs = resolved.borrow_and_update().clone();
+        for &addr in known.difference(&addrs) {
+            if changes.send(Change::Remove(addr)).await.is_err() {
+                return;
+            }
+        }
+        for &addr in addrs.difference(&known) {
+            let change = match endpoint(addr) {
+                Ok(endpoint) => Change::Insert(addr, endpoint),
+                Err(err) => {
+                    warn!("skipping backend {addr}: {err}");
+                    continue;
+                }
+            };
+            if changes.send(change).await.is_err() {
+                return;
+            }
+        }
+        known = addrs;
+    }
+}
+
+/// Sends each call to the next of the resolved backends in turn.
+///
+/// Calls made before the addresses are first resolved wait for them.
+#[derive(Debug, Clone)]
+pub(crate) struct RoundRobin {
+    backends: watch::Receiver<Vec<Channel>>,
+    next:     Arc<AtomicUsize>,
+}
+
+impl RoundRobin {
+    /// Balances over a connection to each address in `resolved`, following
+    /// its changes.
+    pub(crate) fn new<F>(resolved: watch::Receiver<BTreeSet<SocketAddr>>, endpoint: F) -> Self
+    where
+        F: Fn(SocketAddr) -> Result<Endpoint> + Send + 'static,
+    {
+        let (backends, watched) = watch::channel(Vec::new());
+        tokio::spawn(feed_round_robin(resolved, endpoint, backends));
+        Self {
+            backends: watched,
+            next:     Arc::new(AtomicUsize::new(0)),
+        }
+    }
+}
+
+impl Service<http::Request<BoxBody>> for RoundRobin {
+    type Error = tonic::transport::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = http::Response<Body>;
+
+    /// Always ready, the picked backend is waited for by the call.
+    fn poll_ready(&mut self, _cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        Poll::Ready(Ok(()))
+    }
+
+    fn call(&mut self, request: http::Request<BoxBody>) -> Self::Future {
+        let mut backends = self.backends.clone();
+        let next = self.next.clone();
+        Box::pin(async move {
+            let backend = {
+                let Ok(backends) = backends.wait_for(|backends| !backends.is_empty()).await else {
+                    // The backends are kept for as long as any clone is alive.
+                    unreachable!("round robin backends dropped while in use");
+                };
+                let turn = next.fetch_add(1, Ordering::Relaxed);
+                backends[turn % backends.len()].clone()
+            };
+            backend.oneshot(request).await
+        })
+    }
+}
+
+/// Keeps a lazily connected channel to each resolved address in `backends`,
+/// until every clone of the [RoundRobin] is dropped.
+async fn feed_round_robin<F>(
+    mut resolved: watch::Receiver<BTreeSet<SocketAddr>>,
+    endpoint: F,
+    backends: watch::Sender<Vec<Channel>>,
+) where
+    F: Fn(SocketAddr) -> Result<Endpoint>,
+{
+    let mut channels = BTreeMap::new();
+    loop {
+        tokio::select! {
+            changed = resolved.changed() => if changed.is_err() {
+                // Keep the last backends for as long as calls may use them.
+                backends.closed().await;
+                return;
+            },
+            () = backends.closed() => return,
+        }
+        let addrs = resolved.borrow_and_update().clone();
+        channels.retain(|addr, _| addrs.contains(addr));
+        for &addr in &addrs {
+            if channels.contains_key(&addr) {
+                continue;
+            }
+            match endpoint(addr) {
+                Ok(endpoint) => {
+                    channels.insert(addr, endpoint.connect_lazy());
+                }
+                Err(err) => warn!("skipping backend {addr}: {err}"),
+            }
+        }
+        backends.send_replace(channels.values().cloned().collect());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use rsketch_server::Server;
+    use tonic::Status;
+
+    use super::*;
+    use crate::{dial::tests::spawn_server, test_util::Flaky};
+
+    fn local(port: u16) -> SocketAddr { SocketAddr::from(([127, 0, 0, 1], port)) }
+
+    async fn backend() -> (Flaky, SocketAddr, tokio::sync::oneshot::Sender<()>) {
+        let flaky = Flaky::new();
+        let server = Server::new("").with_interceptors([flaky.interceptor(0, Status::ok(""))]);
+        let (port, stop) = spawn_server(server).await;
+        (flaky, local(port), stop)
+    }
+
+    async fn call(client: &mut HelloClient<RoundRobin>, calls: usize) {
+        for _ in 0..calls {
+            client.hello(HelloRequest::default()).await.unwrap();
+        }
+    }
+
+    #[tokio::test]
+    async fn round_robin_spreads_calls_and_follows_resolution() {
+        let (first, first_addr, _stop_first) = backend().await;
+        let (second, second_addr, _stop_second) = backend().await;
+
+        // Stands in for DNS, resolving to whichever addresses the test sets.
+        let (resolver, resolved) = watch::channel(BTreeSet::new());
+        let balancer = RoundRobin::new(resolved, |addr| {
+            Ok(Endpoint::from_shared(format!("http://{addr}")).unwrap())
+        });
+        let mut client = HelloClient::new(balancer);
+
+        resolver.send_replace(BTreeSet::from([first_addr, second_addr]));
+        call(&mut client, 20).await;
+        assert_eq!((first.calls(), second.calls()), (10, 10));
+
+        resolver.send_replace(BTreeSet::from([second_addr]));
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        call(&mut client, 10).await;
+        assert_eq!((first.calls(), second.calls()), (10, 20));
+    }
+
+    #[test]
+    fn parses_policy_names() {
+        assert_eq!(
+            "round_robin".parse::<LoadBalancing>().unwrap(),
+            LoadBalancing::RoundRobin
+        );
+        assert_eq!(
+            "p2c".parse::<LoadBalancing>().unwrap(),
+            LoadBalancing::PowerOfTwoChoices
+        );
+        assert!("pick_first".parse::<LoadBalancing>().is_err());
+    }
+}
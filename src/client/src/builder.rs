@@ -0,0 +1,462 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::{
+    net::SocketAddr,
+    path::{Path, PathBuf},
+    time::Duration,
+};
+
+use snafu::{ensure, ResultExt};
+use tonic::{
+    body::BoxBody,
+    codec::CompressionEncoding,
+    transport::{Body, Certificate, Channel, ClientTlsConfig, Endpoint, Identity},
+};
+use tower::{util::BoxCloneService, Layer};
+
+use crate::{
+    balance::{dns_channel, dns_round_robin, dns_target, LoadBalancing, DEFAULT_DNS_REFRESH},
+    circuit::CircuitBreaker,
+    client::{CallConfig, Client},
+    error::{
+        InvalidAddrSnafu, InvalidPemSnafu, MissingPemSnafu, ReadTlsSnafu, Result, TlsConfigSnafu,
+    },
+    pool::Pool,
+    request_id::RequestIdLayer,
+    retry::{RetryBudget, RetryPolicy},
+    trace::TraceLayer,
+};
+
+/// A channel with the middleware configured on a [ClientBuilder], usable with
+/// any generated client, e.g. `HelloClient::new(channel)`.
+pub type ClientChannel =
+    BoxCloneService<http::Request<BoxBody>, http::Response<Body>, tonic::transport::Error>;
+
+/// HTTP/2 keepalive pings the client sends to detect a dead connection.
+///
+/// Servers may disconnect clients pinging too often, so keep `interval` to
+/// minutes rather than seconds.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Keepalive {
+    /// How often to ping.
+    pub interval:   Duration,
+    /// How long to wait for a ping to be acknowledged.
+    pub timeout:    Duration,
+    /// Whether to keep pinging while no call is in flight.
+    pub while_idle: bool,
+}
+
+impl Default for Keepalive {
+    /// Pings every 5 minutes while calls are in flight and waits 20 seconds,
+    /// which the server's default limits allow.
+    fn default() -> Self {
+        Self {
+            interval:   Duration::from_secs(5 * 60),
+            timeout:    Duration::from_secs(20),
+            while_idle: false,
+        }
+    }
+}
+
+/// Configures a connection to an rsketch server.
+#[derive(Debug, Clone)]
+pub struct ClientBuilder {
+    addr:            String,
+    tls:             Option<ClientTlsConfig>,
+    keepalive:       Option<Keepalive>,
+    connect_timeout: Option<Duration>,
+    dns_refresh:     Duration,
+    load_balancing:  LoadBalancing,
+    call:            CallConfig,
+    tracing:         bool,
+    request_id:      bool,
+    retry:           Option<RetryPolicy>,
+    budget:          Option<RetryBudget>,
+    breaker:         Option<CircuitBreaker>,
+}
+
+impl ClientBuilder {
+    /// Targets `addr`, e.g. `localhost:50051`, or a Unix domain socket such as
+    /// `unix:///tmp/rsketch.sock`.
+    ///
+    /// A `dns:///` target like `dns:///hello.svc.cluster.local:50051`
+    /// balances calls across every address the name resolves to, see the
+    /// [balance](crate::balance) module.
+    pub fn new(addr: impl Into<String>) -> Self {
+        Self {
+            addr:            addr.into(),
+            tls:             None,
+            keepalive:       None,
+            connect_timeout: None,
+            dns_refresh:     DEFAULT_DNS_REFRESH,
+            load_balancing:  LoadBalancing::default(),
+            call:            CallConfig::default(),
+            tracing:         false,
+            request_id:      false,
+            retry:           None,
+            budget:          None,
+            breaker:         None,
+        }
+    }
+
+    /// Connects over TLS, verifying the server certificate against the PEM
+    /// encoded CA certificate read from `ca_file`.
+    ///
+    /// The host part of the address must match a name in the server
+    /// certificate.
+    pub fn with_tls(self, ca_file: impl AsRef<Path>) -> Result<Self> {
+        let tls = ClientTlsConfig::new().ca_certificate(Certificate::from_pem(read_pem(ca_file)?));
+        Ok(Self {
+            tls: Some(tls),
+            ..self
+        })
+    }
+
+    /// Connects over TLS like [ClientBuilder::with_tls], taking the PEM
+    /// encoded CA certificate as bytes instead of reading it from a file.
+    ///
+    /// Fails if `ca_pem` doesn't hold a valid PEM encoded certificate.
+    pub fn with_tls_from_pem(self, ca_pem: impl AsRef<[u8]>) -> Result<Self> {
+        let ca_pem = ca_pem.as_ref();
+        check_certs_pem(ca_pem)?;
+        Ok(Self {
+            tls: Some(ClientTlsConfig::new().ca_certificate(Certificate::from_pem(ca_pem))),
+            ..self
+        })
+    }
+
+    /// Connects over mutual TLS, like [ClientBuilder::with_tls] but
+    /// additionally presenting the client certificate chain and key read from
+    /// `cert_file` and `key_file`.
+    pub fn with_mtls(
+        self,
+        ca_file: impl AsRef<Path>,
+        cert_file: impl AsRef<Path>,
+        key_file: impl AsRef<Path>,
+    ) -> Result<Self> {
+        let tls = ClientTlsConfig::new()
+            .ca_certificate(Certificate::from_pem(read_pem(ca_file)?))
+            .identity(Identity::from_pem(
+                read_pem(cert_file)?,
+                read_pem(key_file)?,
+            ));
+        Ok(Self {
+            tls: Some(tls),
+            ..self
+        })
+    }
+
+    /// Bounds how long establishing the connection may take.
+    pub fn with_connect_timeout(self, timeout: Duration) -> Self {
+        Self {
+            connect_timeout: Some(timeout),
+            ..self
+        }
+    }
+
+    /// Bounds every call made through the client.
+    ///
+    /// Calls made through the typed methods such as [Client::hello] also send
+    /// the timeout to the server as their deadline.
+    pub fn with_timeout(self, timeout: Duration) -> Self {
+        Self {
+            call: CallConfig {
+                timeout: Some(timeout),
+                ..self.call
+            },
+            ..self
+        }
+    }
+
+    /// Makes unary calls made through [Client::unary] wait for the connection
+    /// to become ready instead of failing with `Unavailable`, e.g. while the
+    /// server is starting or the client reconnects.
+    ///
+    /// Waiting is bounded by the timeout set with
+    /// [ClientBuilder::with_timeout], calls without one wait indefinitely.
+    pub fn with_wait_for_ready(self, wait_for_ready: bool) -> Self {
+        Self {
+            call: CallConfig {
+                wait_for_ready,
+                ..self.call
+            },
+            ..self
+        }
+    }
+
+    /// Sets how often a `dns:///` target is resolved again to pick up backends
+    /// being added or removed, every 30 seconds by default.
+    pub fn with_dns_refresh(self, dns_refresh: Duration) -> Self {
+        Self {
+            dns_refresh,
+            ..self
+        }
+    }
+
+    /// Sets how calls to a `dns:///` target are spread over its backends,
+    /// round robin by default.
+    ///
+    /// Only clients from [ClientBuilder::connect] and
+    /// [ClientBuilder::connect_pool] balance round robin, the bare channels
+    /// of the [dial](crate::dial()) functions always use the power of two
+    /// choices.
+    pub fn with_load_balancing(self, load_balancing: LoadBalancing) -> Self {
+        Self {
+            load_balancing,
+            ..self
+        }
+    }
+
+    /// Sends keepalive pings, which are disabled by default.
+    pub fn with_keepalive(self, keepalive: Keepalive) -> Self {
+        Self {
+            keepalive: Some(keepalive),
+            ..self
+        }
+    }
+
+    /// Compresses requests made through [Client::hello_client] with
+    /// `encoding` and asks the server to compress its responses too.
+    ///
+    /// The server must accept the encoding, otherwise calls fail with
+    /// `Unimplemented`.
+    pub fn with_compression(self, encoding: CompressionEncoding) -> Self {
+        Self {
+            call: CallConfig {
+                compression: Some(encoding),
+                ..self.call
+            },
+            ..self
+        }
+    }
+
+    /// Fails responses larger than `limit` bytes in place of the 4 MiB
+    /// default, applied to clients from [Client::hello_client].
+    pub fn with_max_recv_msg_size(self, limit: usize) -> Self {
+        Self {
+            call: CallConfig {
+                max_recv_msg_size: Some(limit),
+                ..self.call
+            },
+            ..self
+        }
+    }
+
+    /// Fails requests larger than `limit` bytes before sending them, applied
+    /// to clients from [Client::hello_client].
+    pub fn with_max_send_msg_size(self, limit: usize) -> Self {
+        Self {
+            call: CallConfig {
+                max_send_msg_size: Some(limit),
+                ..self.call
+            },
+            ..self
+        }
+    }
+
+    /// Wraps every call in an OpenTelemetry client span and propagates its
+    /// context to the server in the request metadata.
+    ///
+    /// Spans are exported by the OpenTelemetry layer of the installed tracing
+    /// subscriber, with that layer's tracer provider rather than one given
+    /// here.
+    pub fn with_tracing(self, tracing: bool) -> Self { Self { tracing, ..self } }
+
+    /// Tags every call without an `x-request-id` in its metadata with a
+    /// generated one, see [RequestIdLayer].
+    pub fn with_request_id(self, request_id: bool) -> Self { Self { request_id, ..self } }
+
+    /// Retries unary calls made through [Client::unary] that fail with
+    /// `Unavailable` or `ResourceExhausted`, up to `max_attempts` attempts in
+    /// total with jittered exponential backoff from `base_backoff`.
+    ///
+    /// Other codes fail immediately.
+    pub fn with_retry(self, max_attempts: usize, base_backoff: Duration) -> Self {
+        Self {
+            retry: Some(RetryPolicy::new(max_attempts, base_backoff)),
+            ..self
+        }
+    }
+
+    /// Caps the retries made by [ClientBuilder::with_retry] across all calls
+    /// to `ratio` of the successful calls plus `min_retries` per second, see
+    /// [RetryBudget]. Clients from a pool share the budget.
+    pub fn with_retry_budget(self, ratio: f64, min_retries: u32) -> Self {
+        Self {
+            budget: Some(RetryBudget::new(ratio, min_retries)),
+            ..self
+        }
+    }
+
+    /// Fails unary calls made through [Client::unary] fast with `Unavailable`
+    /// after `failure_threshold` consecutive calls found the server down,
+    /// probing it again after `cooldown`, see [CircuitBreaker].
+    pub fn with_circuit_breaker(self, failure_threshold: u32, cooldown: Duration) -> Self {
+        Self {
+            breaker: Some(CircuitBreaker::new(failure_threshold, cooldown)),
+            ..self
+        }
+    }
+
+    /// Creates the client with the configured middleware.
+    ///
+    /// The connection is established lazily on the first call, so this must
+    /// be called from within a Tokio runtime.
+    pub fn connect(self) -> Result<Client> {
+        let channel = self.clone().transport()?;
+        Ok(self.wrap(channel))
+    }
+
+    /// Creates the client over `channel` instead of connecting to the
+    /// address, e.g. a channel to a server running in-process in a test.
+    ///
+    /// The connection settings, TLS included, are those of `channel`, only
+    /// the middleware and call settings of the builder apply.
+    pub fn connect_with(self, channel: Channel) -> Client { self.wrap(ClientChannel::new(channel)) }
+
+    /// Creates the client over `channel` with the configured middleware.
+    fn wrap(self, mut channel: ClientChannel) -> Client {
+        if self.request_id {
+            channel = ClientChannel::new(RequestIdLayer.layer(channel));
+        }
+        // Outermost, so the span covers the whole call.
+        if self.tracing {
+            channel = ClientChannel::new(TraceLayer.layer(channel));
+        }
+        Client::new(channel, self.retry, self.budget, self.breaker, self.call)
+    }
+
+    /// Creates a [Pool] of `size` clients, each with its own connection and
+    /// the configured middleware. A circuit breaker or retry budget is
+    /// shared by the whole pool since it tracks the target.
+    ///
+    /// Like [ClientBuilder::connect], the connections are established lazily.
+    pub fn connect_pool(self, size: usize) -> Result<Pool> {
+        let clients = (0..size.max(1))
+            .map(|_| self.clone().connect())
+            .collect::<Result<_>>()?;
+        Ok(Pool::new(clients))
+    }
+
+    /// Creates the bare connection, balanced as configured.
+    fn transport(self) -> Result<ClientChannel> {
+        match dns_target(&self.addr) {
+            Some(target) if self.load_balancing == LoadBalancing::RoundRobin => {
+                let target = target.to_string();
+                let refresh = self.dns_refresh;
+                let endpoint = self.dns_endpoint(&target)?;
+                let balancer = dns_round_robin(target, refresh, endpoint);
+                Ok(ClientChannel::new(balancer))
+            }
+            _ => Ok(ClientChannel::new(self.channel()?)),
+        }
+    }
+
+    /// Creates the bare channel, without any middleware.
+    pub(crate) fn channel(self) -> Result<Channel> {
+        if let Some(target) = dns_target(&self.addr) {
+            return self.dns_channel(target.to_string());
+        }
+
+        let socket = unix_socket(&self.addr);
+        // Connections to a socket ignore the authority, it only fills the URI.
+        let authority = if socket.is_some() {
+            "localhost"
+        } else {
+            &self.addr
+        };
+        let endpoint = self.endpoint(authority)?;
+        #[cfg(unix)]
+        if let Some(path) = socket {
+            let connector = tower::service_fn(move |_: tonic::transport::Uri| {
+                tokio::net::UnixStream::connect(path.clone())
+            });
+            return Ok(endpoint.connect_with_connector_lazy(connector));
+        }
+        Ok(endpoint.connect_lazy())
+    }
+
+    fn dns_channel(self, target: String) -> Result<Channel> {
+        let refresh = self.dns_refresh;
+        let endpoint = self.dns_endpoint(&target)?;
+        Ok(dns_channel(target, refresh, endpoint))
+    }
+
+    /// Returns how to configure the connection to each address `target`
+    /// resolves to.
+    fn dns_endpoint(
+        self,
+        target: &str,
+    ) -> Result<impl Fn(SocketAddr) -> Result<Endpoint> + Send + 'static> {
+        // Fail on a malformed target now rather than on every resolution.
+        self.endpoint(target)?;
+        // The resolved addresses are IPs, the certificate names the host.
+        let host = target.rsplit_once(':').map_or(target, |(host, _)| host);
+        let host = host
+            .trim_start_matches('[')
+            .trim_end_matches(']')
+            .to_string();
+        let builder = Self {
+            tls: self.tls.map(|tls| tls.domain_name(host)),
+            ..self
+        };
+        Ok(move |addr: SocketAddr| builder.endpoint(&addr.to_string()))
+    }
+
+    /// Creates an endpoint for `authority` with the connection settings
+    /// applied.
+    fn endpoint(&self, authority: &str) -> Result<Endpoint> {
+        let scheme = if self.tls.is_some() { "https" } else { "http" };
+        let mut endpoint = Endpoint::from_shared(format!("{scheme}://{authority}"))
+            .context(InvalidAddrSnafu { addr: &self.addr })?;
+        if let Some(tls) = &self.tls {
+            endpoint = endpoint.tls_config(tls.clone()).context(TlsConfigSnafu)?;
+        }
+        if let Some(timeout) = self.connect_timeout {
+            endpoint = endpoint.connect_timeout(timeout);
+        }
+        if let Some(timeout) = self.call.timeout {
+            endpoint = endpoint.timeout(timeout);
+        }
+        if let Some(keepalive) = self.keepalive {
+            endpoint = endpoint
+                .http2_keep_alive_interval(keepalive.interval)
+                .keep_alive_timeout(keepalive.timeout)
+                .keep_alive_while_idle(keepalive.while_idle);
+        }
+        Ok(endpoint)
+    }
+}
+
+#[cfg(unix)]
+fn unix_socket(addr: &str) -> Option<PathBuf> { addr.strip_prefix("unix://").map(PathBuf::from) }
+
+#[cfg(not(unix))]
+fn unix_socket(_addr: &str) -> Option<PathBuf> { None }
+
+fn read_pem(path: impl AsRef<Path>) -> Result<Vec<u8>> {
+    let path = path.as_ref();
+    std::fs::read(path).context(ReadTlsSnafu { path })
+}
+
+/// Checks `pem` holds a certificate, tonic only parses it once connecting.
+fn check_certs_pem(mut pem: &[u8]) -> Result<()> {
+    let what = "CA certificate";
+    let certs = rustls_pemfile::certs(&mut pem)
+        .collect::<std::result::Result<Vec<_>, _>>()
+        .context(InvalidPemSnafu { what })?;
+    ensure!(!certs.is_empty(), MissingPemSnafu { what });
+    Ok(())
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! A circuit breaker failing calls fast while the server looks down, instead
+//! of piling more load onto it.
+//!
+//! The breaker starts closed and lets calls through. After the configured
+//! number of consecutive failures it opens and rejects calls with
+//! `Unavailable` without sending them. Once the cooldown passes it turns
+//! half-open and lets a single probe through, whose outcome closes the
+//! breaker again or reopens it for another cooldown.
+
+use std::{
+    sync::{Arc, Mutex},
+    time::{Duration, Instant},
+};
+
+use tonic::{Code, Status};
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum State {
+    Closed { failures: u32 },
+    Open { until: Instant },
+    HalfOpen,
+}
+
+/// A circuit breaker shared by every clone of a [Client](crate::Client),
+/// so it trips per target.
+#[derive(Debug, Clone)]
+pub struct CircuitBreaker {
+    failure_threshold: u32,
+    cooldown:          Duration,
+    state:             Arc<Mutex<State>>,
+}
+
+impl CircuitBreaker {
+    /// Opens after `failure_threshold` consecutive failures and stays open
+    /// for `cooldown` before probing.
+    pub fn new(failure_threshold: u32, cooldown: Duration) -> Self {
+        Self {
+            failure_threshold: failure_threshold.max(1),
+            cooldown,
+            state: Arc::new(Mutex::new(State::Closed { failures: 0 })),
+        }
+    }
+
+    /// Only failures suggesting the server is unreachable or overwhelmed
+    /// count towards opening the breaker, any other status means it
+    /// answered.
+    pub fn is_failure(code: Code) -> bool {
+        matches!(code, Code::Unavailable | Code::DeadlineExceeded)
+    }
+
+    /// Admits a call, or fails with `Unavailable` while the breaker is open
+    /// or a probe is already in flight.
+    pub(crate) fn acquire(&self) -> Result<Permit, Status> {
+        let mut state = self.lock();
+        match *state {
+            State::Closed { .. } => Ok(self.permit(false)),
+            State::Open { until } if Instant::now() >= until => {
+                *state = State::HalfOpen;
+                Ok(self.permit(true))
+            }
+            State::Open { .. } | State::HalfOpen => {
+                Err(Status::unavailable("circuit breaker is open"))
+            }
+        }
+    }
+
+    fn permit(&self, probe: bool) -> Permit {
+        Permit {
+            breaker: self.clone(),
+            probe,
+            recorded: false,
+        }
+    }
+
+    fn record(&self, failed: bool) {
+        let mut state = self.lock();
+        let open = State::Open {
+            until: Instant::now() + self.cooldown,
+        };
+        *state = match (*state, failed) {
+            (State::Closed { .. } | State::HalfOpen, false) => State::Closed { failures: 0 },
+            (State::HalfOpen, true) => open,
+            (State::Closed { failures }, true) if failures + 1 >= self.failure_threshold => open,
+            (State::Closed { failures }, true) => State::Closed {
+                failures: failures + 1,
+            },
+            // A call admitted before the breaker opened, its cooldown stands.
+            (State::Open { until }, _) => State::Open { until },
+        };
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, State> {
+        self.state.lock().unwrap_or_else(|e| e.into_inner())
+    }
+}
+
+/// An admitted call, whose outcome is fed back with [Permit::record].
+pub(crate) struct Permit {
+    breaker:  CircuitBreaker,
+    probe:    bool,
+    recorded: bool,
+}
+
+impl Permit {
+    pub(crate) fn record<T>(mut self, result: &Result<T, Status>) {
+        self.recorded = true;
+        let failed = matches!(result, Err(status) if CircuitBreaker::is_failure(status.code()));
+        self.breaker.record(failed);
+    }
+}
+
+impl Drop for Permit {
+    /// Hands the probe slot back when a probing call is cancelled, so the
+    /// next call probes instead of the breaker staying half-open forever.
+    fn drop(&mut self) {
+        if self.probe && !self.recorded {
+            *self.breaker.lock() = State::Open {
+                until: Instant::now(),
+            };
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use rsketch_server::{in_process::InProcessServer, Server};
+
+    use super::*;
+    use crate::{test_util::Flaky, Client, ClientBuilder};
+
+    const COOLDOWN: Duration = Duration::from_millis(100);
+
+    fn server(flaky: &Flaky, failures: usize) -> InProcessServer {
+        let interceptor = flaky.interceptor(failures, Status::unavailable("flaky"));
+        InProcessServer::start(Server::new("").with_interceptors([interceptor]))
+    }
+
+    fn client(server: &InProcessServer) -> Client {
+        ClientBuilder::new("")
+            .with_circuit_breaker(3, COOLDOWN)
+            .connect_with(server.channel())
+    }
+
+    #[tokio::test]
+    async fn trips_fails_fast_and_recovers_after_the_cooldown() {
+        let flaky = Flaky::new();
+        let server = server(&flaky, 3);
+        let client = client(&server);
+
+        for _ in 0..3 {
+            let status = client.hello("down").await.unwrap_err();
+            assert_eq!(status.message(), "flaky");
+        }
+        let status = client.hello("down").await.unwrap_err();
+        assert_eq!(status.code(), Code::Unavailable);
+        assert_eq!(status.message(), "circuit breaker is open");
+        assert_eq!(flaky.calls(), 3);
+
+        tokio::time::sleep(COOLDOWN + Duration::from_millis(50)).await;
+        assert_eq!(client.hello("up").await.unwrap(), "Hello, up");
+        assert_eq!(client.hello("up").await.unwrap(), "Hello, up");
+        assert_eq!(flaky.calls(), 5);
+    }
+
+    #[tokio::test]
+    async fn a_failed_probe_reopens_the_breaker() {
+        let flaky = Flaky::new();
+        let server = server(&flaky, usize::MAX);
+        let client = client(&server);
+
+        for _ in 0..3 {
+            client.hello("down").await.unwrap_err();
+        }
+        tokio::time::sleep(COOLDOWN + Duration::from_millis(50)).await;
+        let status = client.hello("probe").await.unwrap_err();
+        assert_eq!(status.message(), "flaky");
+
+        let status = client.hello("down").await.unwrap_err();
+        assert_eq!(status.message(), "circuit breaker is open");
+        assert_eq!(flaky.calls(), 4);
+    }
+
+    #[test]
+    fn only_unreachable_servers_count_as_failures() {
+        assert!(CircuitBreaker::is_failure(Code::Unavailable));
+        assert!(CircuitBreaker::is_failure(Code::DeadlineExceeded));
+        assert!(!CircuitBreaker::is_failure(Code::InvalidArgument));
+        assert!(!CircuitBreaker::is_failure(Code::Internal));
+    }
+}
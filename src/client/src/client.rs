@@ -0,0 +1,424 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::{fmt, future::Future, time::Duration};
+
+use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, InfoResponse, PingRequest};
+use tokio::time::Instant;
+use tonic::{codec::CompressionEncoding, Request, Response, Status};
+
+use crate::{
+    builder::ClientChannel,
+    circuit::CircuitBreaker,
+    error,
+    health::HealthMonitor,
+    retry::{retry, RetryBudget, RetryPolicy, WaitForReady},
+};
+
+/// Settings applied to the generated clients handed out by a [Client].
+#[derive(Debug, Clone, Copy, Default)]
+pub(crate) struct CallConfig {
+    pub(crate) timeout:           Option<Duration>,
+    pub(crate) compression:       Option<CompressionEncoding>,
+    pub(crate) max_recv_msg_size: Option<usize>,
+    pub(crate) max_send_msg_size: Option<usize>,
+    pub(crate) wait_for_ready:    bool,
+}
+
+impl CallConfig {
+    fn hello_client(self, channel: ClientChannel) -> HelloClient<ClientChannel> {
+        let mut client = HelloClient::new(channel);
+        if let Some(encoding) = self.compression {
+            client = client.send_compressed(encoding).accept_compressed(encoding);
+        }
+        if let Some(limit) = self.max_recv_msg_size {
+            client = client.max_decoding_message_size(limit);
+        }
+        if let Some(limit) = self.max_send_msg_size {
+            client = client.max_encoding_message_size(limit);
+        }
+        client
+    }
+
+    /// Wraps `message` in a request carrying `timeout`, the time left of the
+    /// call, as its deadline.
+    fn request<T>(message: T, timeout: Option<Duration>) -> Request<T> {
+        let mut request = Request::new(message);
+        if let Some(timeout) = timeout {
+            request.set_timeout(timeout);
+        }
+        request
+    }
+}
+
+/// A connection to an rsketch server, created by a
+/// [ClientBuilder](crate::ClientBuilder).
+///
+/// Clones share the underlying connection, which is reused across calls.
+#[derive(Clone)]
+pub struct Client {
+    channel: ClientChannel,
+    retry:   Option<RetryPolicy>,
+    budget:  Option<RetryBudget>,
+    breaker: Option<CircuitBreaker>,
+    call:    CallConfig,
+}
+
+impl fmt::Debug for Client {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Client")
+            .field("retry", &self.retry)
+            .field("budget", &self.budget)
+            .field("breaker", &self.breaker)
+            .field("call", &self.call)
+            .finish_non_exhaustive()
+    }
+}
+
+impl Client {
+    pub(crate) fn new(
+        channel: ClientChannel,
+        retry: Option<RetryPolicy>,
+        budget: Option<RetryBudget>,
+        breaker: Option<CircuitBreaker>,
+        call: CallConfig,
+    ) -> Self {
+        Self {
+            channel,
+            retry,
+            budget,
+            breaker,
+            call,
+        }
+    }
+
+    /// Returns the channel for building generated clients, e.g.
+    /// `HelloClient::new(client.channel())`.
+    ///
+    /// Calls made this way bypass the retry policy.
+    pub fn channel(&self) -> ClientChannel { self.channel.clone() }
+
+    /// Returns a Hello client using the configured compression and message
+    /// size limits.
+    pub fn hello_client(&self) -> HelloClient<ClientChannel> {
+        self.call.hello_client(self.channel())
+    }
+
+    /// Greets `name` through the retry policy, returning the greeting.
+    pub fn hello(&self, name: impl Into<String>) -> impl Future<Output = Result<String, Status>> {
+        let message = HelloRequest { name: name.into() };
+        let call = self.call;
+        let response = self.unary_within(move |channel, timeout| {
+            let request = CallConfig::request(message.clone(), timeout);
+            async move { call.hello_client(channel).hello(request).await }
+        });
+        async move { Ok(response.await?.into_inner().message) }
+    }
+
+    /// Sends `payload` to the server and returns the echoed payload, e.g. to
+    /// check connectivity or time a round trip.
+    pub fn ping(
+        &self,
+        payload: impl Into<Vec<u8>>,
+    ) -> impl Future<Output = Result<Vec<u8>, Status>> {
+        let message = PingRequest {
+            payload: payload.into(),
+        };
+        let call = self.call;
+        let response = self.unary_within(move |channel, timeout| {
+            let request = CallConfig::request(message.clone(), timeout);
+            async move { call.hello_client(channel).ping(request).await }
+        });
+        async move { Ok(response.await?.into_inner().payload) }
+    }
+
+    /// Describes the build of the server, e.g. to check which version is
+    /// running.
+    pub fn get_info(&self) -> impl Future<Output = Result<InfoResponse, Status>> {
+        let call = self.call;
+        let response = self.unary_within(move |channel, timeout| {
+            let request = CallConfig::request((), timeout);
+            async move { call.hello_client(channel).get_info(request).await }
+        });
+        async move { Ok(response.await?.into_inner()) }
+    }
+
+    /// Starts checking the health of the server every `interval` in the
+    /// background, see [HealthMonitor].
+    ///
+    /// Must be called from within a Tokio runtime, fails if `interval` is
+    /// zero.
+    pub fn start_health_monitor(&self, interval: Duration) -> error::Result<HealthMonitor> {
+        HealthMonitor::start(self.channel(), String::new(), interval)
+    }
+
+    /// Waits until the server can be reached, for at most `timeout`,
+    /// failing with `DeadlineExceeded` if it can't by then.
+    ///
+    /// The connection is probed with pings until one succeeds. A ping the
+    /// server rejects, e.g. with `PermissionDenied` or `Unauthenticated`,
+    /// fails with its status, since waiting longer wouldn't help.
+    pub fn wait_for_ready(&self, timeout: Duration) -> impl Future<Output = Result<(), Status>> {
+        let channel = self.channel.clone();
+        let call = self.call;
+        async move {
+            let deadline = Some(Instant::now() + timeout);
+            let ping = retry(None, None, Some(WaitForReady::new()), deadline, |timeout| {
+                let request = CallConfig::request(PingRequest::default(), timeout);
+                let channel = channel.clone();
+                async move { call.hello_client(channel).ping(request).await }
+            });
+            ping.await.map(|_| ())
+        }
+    }
+
+    /// Makes a unary call through the configured circuit breaker and retry
+    /// policy, `call` is invoked once per attempt with a fresh channel handle:
+    ///
+    /// ```ignore
+    /// let response = client
+    ///     .unary(|channel| async move { HelloClient::new(channel).hello(request.clone()).await })
+    ///     .await?;
+    /// ```
+    ///
+    /// The configured timeout bounds the call as a whole, retries included.
+    pub fn unary<T, F, Fut>(&self, mut call: F) -> impl Future<Output = Result<Response<T>, Status>>
+    where
+        F: FnMut(ClientChannel) -> Fut,
+        Fut: Future<Output = Result<Response<T>, Status>>,
+    {
+        self.unary_within(move |channel, _| call(channel))
+    }
+
+    /// Like [Client::unary], additionally passing `call` the time left of the
+    /// call to send as the attempt's deadline.
+    fn unary_within<T, F, Fut>(
+        &self,
+        mut call: F,
+    ) -> impl Future<Output = Result<Response<T>, Status>>
+    where
+        F: FnMut(ClientChannel, Option<Duration>) -> Fut,
+        Fut: Future<Output = Result<Response<T>, Status>>,
+    {
+        // Own the channel so the future doesn't borrow the !Sync client.
+        let channel = self.channel.clone();
+        let policy = self.retry;
+        let budget = self.budget.clone();
+        let breaker = self.breaker.clone();
+        let config = self.call;
+        async move {
+            // The breaker sees the call as a whole, after any retries.
+            let permit = breaker.as_ref().map(CircuitBreaker::acquire).transpose()?;
+            let deadline = config.timeout.map(|timeout| Instant::now() + timeout);
+            let wait = config.wait_for_ready.then(WaitForReady::new);
+            let result = retry(policy, budget.as_ref(), wait, deadline, |timeout| {
+                call(channel.clone(), timeout)
+            })
+            .await;
+            if let Some(permit) = permit {
+                permit.record(&result);
+            }
+            result
+        }
+    }
+
+    /// Closes this handle, the connection itself is closed once every clone
+    /// sharing it is gone.
+    pub fn close(self) { drop(self) }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::{Arc, Mutex};
+
+    use api::pb::v1::hello::HelloStreamRequest;
+    use rsketch_server::{
+        in_process::InProcessServer,
+        interceptor::{
+            auth::Claims,
+            authorize::{AuthorizationError, Authorizer},
+            GrpcRequest, GrpcService, Interceptor,
+        },
+        Server,
+    };
+    use tonic::{transport::server::TcpConnectInfo, Code};
+    use tower::ServiceExt;
+
+    use super::*;
+    use crate::{dial::tests::spawn_server, ClientBuilder};
+
+    const TIMEOUT: Duration = Duration::from_millis(300);
+
+    /// Rejects every ping, like a server the client may not probe.
+    struct DenyPing;
+
+    #[tonic::async_trait]
+    impl Authorizer for DenyPing {
+        async fn authorize(
+            &self,
+            method: &str,
+            _: Option<&Claims>,
+        ) -> Result<(), AuthorizationError> {
+            if method.ends_with("/Ping") {
+                return Err("no pings".into());
+            }
+            Ok(())
+        }
+    }
+
+    /// Records the `grpc-encoding` of every request the server receives.
+    fn record_encodings(encodings: Arc<Mutex<Vec<Option<String>>>>) -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+            let encodings = encodings.clone();
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                let encoding = request
+                    .headers()
+                    .get("grpc-encoding")
+                    .and_then(|value| value.to_str().ok())
+                    .map(str::to_string);
+                encodings.lock().unwrap().push(encoding);
+                async move { inner.oneshot(request).await }
+            })
+        }))
+    }
+
+    #[tokio::test]
+    async fn streams_round_trip_gzip_compressed() {
+        let encodings = Arc::<Mutex<Vec<Option<String>>>>::default();
+        let server = InProcessServer::start(
+            Server::new("").with_interceptors([record_encodings(encodings.clone())]),
+        );
+        let client = ClientBuilder::new("")
+            .with_compression(CompressionEncoding::Gzip)
+            .connect_with(server.channel());
+
+        let request = HelloStreamRequest {
+            names: vec!["Ada".to_string(), "Grace".to_string()],
+        };
+        let response = client.hello_client().hello_stream(request).await.unwrap();
+        assert_eq!(response.metadata().get("grpc-encoding").unwrap(), "gzip");
+        let mut replies = response.into_inner();
+        let mut messages = Vec::new();
+        while let Some(reply) = replies.message().await.unwrap() {
+            messages.push(reply.message);
+        }
+        assert_eq!(messages.len(), 2);
+        assert!(messages[0].contains("Ada"), "{messages:?}");
+        assert!(messages[1].contains("Grace"), "{messages:?}");
+
+        assert_eq!(*encodings.lock().unwrap(), [Some("gzip".to_string())]);
+        server.shutdown().await.unwrap();
+    }
+
+    /// Records the peer port of every call, one per client connection.
+    fn record_ports(ports: Arc<Mutex<Vec<u16>>>) -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+            let ports = ports.clone();
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                let port = request
+                    .extensions()
+                    .get::<TcpConnectInfo>()
+                    .and_then(TcpConnectInfo::remote_addr)
+                    .map(|addr| addr.port());
+                ports.lock().unwrap().extend(port);
+                async move { inner.oneshot(request).await }
+            })
+        }))
+    }
+
+    #[tokio::test]
+    async fn hello_returns_the_greeting() {
+        let server = InProcessServer::start(Server::new(""));
+        let client = ClientBuilder::new("").connect_with(server.channel());
+
+        assert_eq!(client.hello("Ada").await.unwrap(), "Hello, Ada");
+        assert_eq!(client.hello("").await.unwrap(), "Hello, world");
+        let status = client.hello("bell\u{7}").await.unwrap_err();
+        assert_eq!(status.code(), Code::InvalidArgument);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn calls_reuse_one_connection() {
+        let ports = Arc::<Mutex<Vec<u16>>>::default();
+        let server = Server::new("").with_interceptors([record_ports(ports.clone())]);
+        let (port, _shutdown) = spawn_server(server).await;
+
+        let client = ClientBuilder::new(format!("127.0.0.1:{port}"))
+            .connect()
+            .unwrap();
+        let clone = client.clone();
+        for name in ["Ada", "Grace", "Barbara"] {
+            client.hello(name).await.unwrap();
+        }
+        clone.hello("Edsger").await.unwrap();
+
+        let mut ports = ports.lock().unwrap().clone();
+        assert_eq!(ports.len(), 4);
+        ports.dedup();
+        assert_eq!(ports.len(), 1, "{ports:?}");
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn wait_for_ready_succeeds_once_the_server_answers() {
+        // The socket doesn't exist yet, so the first pings are refused.
+        let dir = tempfile::tempdir().unwrap();
+        let addr = format!("unix://{}", dir.path().join("rsketch.sock").display());
+        let client = ClientBuilder::new(addr.clone()).connect().unwrap();
+        let (shutdown, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+        let start_server = async move {
+            tokio::time::sleep(TIMEOUT).await;
+            tokio::spawn(Server::new(addr).run(async move {
+                let _ = shutdown_rx.await;
+            }))
+        };
+
+        let started = Instant::now();
+        let (ready, serving) =
+            tokio::join!(client.wait_for_ready(Duration::from_secs(5)), start_server);
+        ready.unwrap();
+        assert!(started.elapsed() >= TIMEOUT);
+        assert_eq!(client.hello("Ada").await.unwrap(), "Hello, Ada");
+
+        drop(client);
+        shutdown.send(()).unwrap();
+        serving.await.unwrap().unwrap();
+    }
+
+    #[tokio::test]
+    async fn wait_for_ready_fails_with_the_status_of_a_rejected_ping() {
+        let server = InProcessServer::start(Server::new("").with_authorizer(DenyPing));
+        let client = ClientBuilder::new("").connect_with(server.channel());
+
+        let started = Instant::now();
+        let status = client.wait_for_ready(TIMEOUT).await.unwrap_err();
+        assert_eq!(status.code(), Code::PermissionDenied);
+        assert!(started.elapsed() < TIMEOUT);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn wait_for_ready_gives_up_at_the_timeout() {
+        let server = InProcessServer::start(Server::new(""));
+        let channel = server.channel();
+        server.shutdown().await.unwrap();
+        let client = ClientBuilder::new("").connect_with(channel);
+
+        let status = client.wait_for_ready(TIMEOUT).await.unwrap_err();
+        assert_eq!(status.code(), Code::DeadlineExceeded);
+    }
+}
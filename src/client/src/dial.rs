@@ -0,0 +1,231 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::path::Path;
+
+use tonic::transport::Channel;
+
+use crate::{builder::ClientBuilder, error::Result};
+
+/// Creates a plaintext channel to `addr`, e.g. `localhost:50051`.
+///
+/// The connection is established lazily on the first call, so this must be
+/// called from within a Tokio runtime.
+pub fn dial(addr: &str) -> Result<Channel> { ClientBuilder::new(addr).channel() }
+
+/// Creates a TLS channel to `addr`, verifying the server certificate against
+/// the PEM encoded CA certificate read from `ca_file`.
+///
+/// The host part of `addr` must match a name in the server certificate.
+pub fn dial_tls(addr: &str, ca_file: impl AsRef<Path>) -> Result<Channel> {
+    ClientBuilder::new(addr).with_tls(ca_file)?.channel()
+}
+
+/// Creates a TLS channel to `addr` like [dial_tls], verifying the server
+/// certificate against the PEM encoded CA certificate in `ca_pem`.
+pub fn dial_tls_from_pem(addr: &str, ca_pem: impl AsRef<[u8]>) -> Result<Channel> {
+    ClientBuilder::new(addr)
+        .with_tls_from_pem(ca_pem)?
+        .channel()
+}
+
+/// Creates a mutual TLS channel to `addr`, like [dial_tls] but additionally
+/// presenting the client certificate chain and key read from `cert_file` and
+/// `key_file`.
+pub fn dial_mtls(
+    addr: &str,
+    ca_file: impl AsRef<Path>,
+    cert_file: impl AsRef<Path>,
+    key_file: impl AsRef<Path>,
+) -> Result<Channel> {
+    ClientBuilder::new(addr)
+        .with_mtls(ca_file, cert_file, key_file)?
+        .channel()
+}
+
+#[cfg(test)]
+pub(crate) mod tests {
+    use std::path::{Path, PathBuf};
+
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use rcgen::{BasicConstraints, Certificate, CertificateParams, DnType, IsCa};
+    use rsketch_server::Server;
+    use tempfile::TempDir;
+    use tokio::{net::TcpListener, sync::oneshot};
+
+    use super::*;
+
+    /// A CA along with a `localhost` server certificate and a client
+    /// certificate it signed, written as PEM files to a temporary directory.
+    pub(crate) struct Pki {
+        dir: TempDir,
+    }
+
+    impl Pki {
+        pub(crate) fn new() -> Self {
+            let dir = tempfile::tempdir().unwrap();
+            let mut params = CertificateParams::new(Vec::new());
+            params.is_ca = IsCa::Ca(BasicConstraints::Unconstrained);
+            params
+                .distinguished_name
+                .push(DnType::CommonName, "rsketch test CA");
+            let ca = Certificate::from_params(params).unwrap();
+            write_pem(dir.path(), "ca.pem", &ca.serialize_pem().unwrap());
+            for (name, host) in [("server", "localhost"), ("client", "client.rsketch")] {
+                let mut params = CertificateParams::new(vec![host.to_string()]);
+                params.distinguished_name.push(DnType::CommonName, host);
+                let cert = Certificate::from_params(params).unwrap();
+                let pem = cert.serialize_pem_with_signer(&ca).unwrap();
+                write_pem(dir.path(), &format!("{name}.pem"), &pem);
+                let key = cert.serialize_private_key_pem();
+                write_pem(dir.path(), &format!("{name}.key"), &key);
+            }
+            Self { dir }
+        }
+
+        pub(crate) fn ca(&self) -> PathBuf { self.dir.path().join("ca.pem") }
+
+        pub(crate) fn cert(&self, name: &str) -> PathBuf {
+            self.dir.path().join(format!("{name}.pem"))
+        }
+
+        pub(crate) fn key(&self, name: &str) -> PathBuf {
+            self.dir.path().join(format!("{name}.key"))
+        }
+    }
+
+    fn write_pem(dir: &Path, file: &str, pem: &str) { std::fs::write(dir.join(file), pem).unwrap() }
+
+    /// Runs `server` on a free local port until the returned sender fires or
+    /// is dropped.
+    pub(crate) async fn spawn_server(server: Server) -> (u16, oneshot::Sender<()>) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        let (shutdown, shutdown_rx) = oneshot::channel::<()>();
+        tokio::spawn(server.with_listener(listener).run(async {
+            let _ = shutdown_rx.await;
+        }));
+        (port, shutdown)
+    }
+
+    fn hello(name: &str) -> HelloRequest {
+        HelloRequest {
+            name: name.to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn tls_hello() {
+        let pki = Pki::new();
+        let server = Server::new("")
+            .with_tls(pki.cert("server"), pki.key("server"))
+            .unwrap();
+        let (port, _shutdown) = spawn_server(server).await;
+
+        let channel = dial_tls(&format!("localhost:{port}"), pki.ca()).unwrap();
+        let response = HelloClient::new(channel).hello(hello("tls")).await.unwrap();
+        assert_eq!(response.into_inner().message, "Hello, tls");
+    }
+
+    #[tokio::test]
+    async fn tls_hello_from_pem() {
+        let pki = Pki::new();
+        let read = |path: PathBuf| std::fs::read(path).unwrap();
+        let server = Server::new("")
+            .with_tls_from_pem(read(pki.cert("server")), read(pki.key("server")))
+            .unwrap();
+        let (port, _shutdown) = spawn_server(server).await;
+
+        let channel = dial_tls_from_pem(&format!("localhost:{port}"), read(pki.ca())).unwrap();
+        let response = HelloClient::new(channel).hello(hello("pem")).await.unwrap();
+        assert_eq!(response.into_inner().message, "Hello, pem");
+    }
+
+    #[tokio::test]
+    async fn tls_from_pem_rejects_invalid_pem() {
+        let pki = Pki::new();
+        let cert = std::fs::read(pki.cert("server")).unwrap();
+        assert!(Server::new("")
+            .with_tls_from_pem(&cert, "not a key")
+            .is_err());
+        assert!(dial_tls_from_pem("localhost:1", "not a certificate").is_err());
+    }
+
+    #[tokio::test]
+    async fn tls_rejects_missing_files() {
+        let pki = Pki::new();
+        let missing = pki.dir.path().join("missing.pem");
+        assert!(Server::new("")
+            .with_tls(&missing, pki.key("server"))
+            .is_err());
+        assert!(dial_tls("localhost:50051", &missing).is_err());
+    }
+
+    #[tokio::test]
+    async fn mtls_accepts_signed_client_certificate() {
+        let pki = Pki::new();
+        let server = Server::new("")
+            .with_mtls(pki.cert("server"), pki.key("server"), pki.ca())
+            .unwrap();
+        let (port, _shutdown) = spawn_server(server).await;
+
+        let addr = format!("localhost:{port}");
+        let channel = dial_mtls(&addr, pki.ca(), pki.cert("client"), pki.key("client")).unwrap();
+        let response = HelloClient::new(channel)
+            .hello(hello("mtls"))
+            .await
+            .unwrap();
+        assert_eq!(response.into_inner().message, "Hello, mtls");
+    }
+
+    #[tokio::test]
+    async fn mtls_rejects_client_without_certificate() {
+        let pki = Pki::new();
+        let server = Server::new("")
+            .with_mtls(pki.cert("server"), pki.key("server"), pki.ca())
+            .unwrap();
+        let (port, _shutdown) = spawn_server(server).await;
+
+        // The handshake fails, so the call never reaches the server.
+        let channel = dial_tls(&format!("localhost:{port}"), pki.ca()).unwrap();
+        let result = HelloClient::new(channel).hello(hello("mtls")).await;
+        assert!(result.is_err(), "{result:?}");
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn unix_socket_hello() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("rsketch.sock");
+        let addr = format!("unix://{}", path.display());
+        let (shutdown, shutdown_rx) = oneshot::channel::<()>();
+        let serving = tokio::spawn(Server::new(addr.clone()).run(async {
+            let _ = shutdown_rx.await;
+        }));
+
+        let client = ClientBuilder::new(addr).connect().unwrap();
+        client
+            .wait_for_ready(std::time::Duration::from_secs(5))
+            .await
+            .unwrap();
+        assert!(path.exists());
+        let greeting = client.hello("uds").await.unwrap();
+        assert!(greeting.contains("uds"), "{greeting}");
+
+        drop(client);
+        shutdown.send(()).unwrap();
+        serving.await.unwrap().unwrap();
+        assert!(!path.exists(), "socket file left at {}", path.display());
+    }
+}
@@ -0,0 +1,53 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::path::PathBuf;
+
+use snafu::Snafu;
+
+pub type Result<T> = std::result::Result<T, Error>;
+
+#[derive(Snafu, Debug)]
+#[snafu(visibility(pub))]
+pub enum Error {
+    #[snafu(display("Invalid server address {addr}"))]
+    InvalidAddr {
+        addr:   String,
+        source: tonic::transport::Error,
+    },
+
+    #[snafu(display("Failed to read TLS material from {}", path.display()))]
+    ReadTls {
+        path:   PathBuf,
+        source: std::io::Error,
+    },
+
+    #[snafu(display("Invalid PEM encoded {what}"))]
+    InvalidPem {
+        what:   &'static str,
+        source: std::io::Error,
+    },
+
+    #[snafu(display("No PEM encoded {what} found"))]
+    MissingPem { what: &'static str },
+
+    #[snafu(display("Invalid TLS configuration"))]
+    TlsConfig { source: tonic::transport::Error },
+
+    #[snafu(display("Unknown load balancing policy {name:?}, expected round_robin or p2c"))]
+    UnknownLoadBalancing { name: String },
+
+    #[snafu(display("Health check interval must not be zero"))]
+    ZeroHealthInterval,
+}
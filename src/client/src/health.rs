@@ -0,0 +1,183 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Background monitoring of the server's health through the standard
+//! `grpc.health.v1.Health/Check` method, for long-running clients that
+//! would otherwise only notice a lost server on their next call.
+
+use std::time::Duration;
+
+use snafu::ensure;
+use tokio::{
+    sync::{mpsc, watch},
+    task::JoinHandle,
+};
+use tonic::Request;
+use tonic_health::pb::{
+    health_check_response::ServingStatus, health_client::HealthClient, HealthCheckRequest,
+};
+
+use crate::{
+    error::{Result, ZeroHealthIntervalSnafu},
+    ClientChannel,
+};
+
+/// How many checks in a row must fail before the server is considered
+/// unreachable, so a single lost check doesn't flap the status.
+const FAILURE_THRESHOLD: u32 = 3;
+
+/// The health of the server as seen by a [HealthMonitor].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HealthStatus {
+    /// The server reports it is serving.
+    Serving,
+    /// The server answers but reports it isn't serving, e.g. while it
+    /// drains.
+    NotServing,
+    /// Several checks in a row failed, e.g. because the server is down.
+    Unreachable,
+}
+
+/// Checks the server's health periodically, reporting every change of
+/// status. Dropping the monitor stops it.
+///
+/// Changes can be awaited one by one with [HealthMonitor::next], or watched
+/// through [HealthMonitor::status] by any number of tasks.
+#[derive(Debug)]
+pub struct HealthMonitor {
+    events: mpsc::UnboundedReceiver<HealthStatus>,
+    status: watch::Receiver<Option<HealthStatus>>,
+    task:   JoinHandle<()>,
+}
+
+impl HealthMonitor {
+    /// Checks `service`, the empty string for the server as a whole, every
+    /// `interval`. Each check is bounded by the interval too.
+    ///
+    /// Fails if `interval` is zero.
+    pub(crate) fn start(
+        channel: ClientChannel,
+        service: String,
+        interval: Duration,
+    ) -> Result<Self> {
+        ensure!(!interval.is_zero(), ZeroHealthIntervalSnafu);
+        let (tx, events) = mpsc::unbounded_channel();
+        let (current_tx, status) = watch::channel(None);
+        let task = tokio::spawn(async move {
+            let mut client = HealthClient::new(channel);
+            let mut ticker = tokio::time::interval(interval);
+            let mut current = None;
+            let mut failures = 0;
+            loop {
+                ticker.tick().await;
+                let mut request = Request::new(HealthCheckRequest {
+                    service: service.clone(),
+                });
+                request.set_timeout(interval);
+                let status = match client.check(request).await {
+                    Ok(response) => {
+                        failures = 0;
+                        if response.into_inner().status() == ServingStatus::Serving {
+                            HealthStatus::Serving
+                        } else {
+                            HealthStatus::NotServing
+                        }
+                    }
+                    Err(_) => {
+                        failures += 1;
+                        if failures < FAILURE_THRESHOLD {
+                            continue;
+                        }
+                        HealthStatus::Unreachable
+                    }
+                };
+                if current != Some(status) {
+                    current = Some(status);
+                    current_tx.send_replace(current);
+                    // Nobody is listening anymore.
+                    if tx.send(status).is_err() {
+                        break;
+                    }
+                }
+            }
+        });
+        Ok(Self {
+            events,
+            status,
+            task,
+        })
+    }
+
+    /// Waits for the next change of status, the first check reports the
+    /// initial one.
+    pub async fn next(&mut self) -> Option<HealthStatus> { self.events.recv().await }
+
+    /// Returns a receiver of the latest status, `None` until the first
+    /// check completes. It sees the same changes as [HealthMonitor::next]
+    /// but may skip some if it doesn't keep up.
+    pub fn status(&self) -> watch::Receiver<Option<HealthStatus>> { self.status.clone() }
+
+    pub fn stop(self) { drop(self) }
+}
+
+impl Drop for HealthMonitor {
+    fn drop(&mut self) { self.task.abort() }
+}
+
+#[cfg(test)]
+mod tests {
+    use rsketch_server::{in_process::InProcessServer, Server};
+
+    use super::*;
+    use crate::{error::Error, ClientBuilder};
+
+    const INTERVAL: Duration = Duration::from_millis(20);
+
+    #[tokio::test]
+    async fn reports_serving_status_changes() {
+        let server = Server::new("");
+        let health = server.health();
+        let server = InProcessServer::start(server);
+        let client = ClientBuilder::new("").connect_with(server.channel());
+        let mut monitor = client.start_health_monitor(INTERVAL).unwrap();
+        let mut status = monitor.status();
+
+        assert_eq!(monitor.next().await, Some(HealthStatus::Serving));
+        assert_eq!(*status.borrow_and_update(), Some(HealthStatus::Serving));
+
+        health.set_serving_status("", false).await;
+        assert_eq!(monitor.next().await, Some(HealthStatus::NotServing));
+        status.changed().await.unwrap();
+        assert_eq!(*status.borrow_and_update(), Some(HealthStatus::NotServing));
+
+        health.set_serving_status("", true).await;
+        assert_eq!(monitor.next().await, Some(HealthStatus::Serving));
+
+        monitor.stop();
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn rejects_a_zero_interval() {
+        let server = InProcessServer::start(Server::new(""));
+        let client = ClientBuilder::new("").connect_with(server.channel());
+
+        let result = client.start_health_monitor(Duration::ZERO);
+        assert!(
+            matches!(result, Err(Error::ZeroHealthInterval)),
+            "{result:?}"
+        );
+        server.shutdown().await.unwrap();
+    }
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+pub mod balance;
+mod builder;
+pub mod circuit;
+mod client;
+mod dial;
+pub mod error;
+pub mod health;
+mod pool;
+pub mod request_id;
+pub mod retry;
+#[cfg(test)]
+mod test_util;
+pub mod trace;
+
+use std::{future::Future, pin::Pin};
+
+pub use balance::LoadBalancing;
+pub use builder::{ClientBuilder, ClientChannel, Keepalive};
+pub use client::Client;
+pub use dial::{dial, dial_mtls, dial_tls, dial_tls_from_pem};
+pub use pool::Pool;
+
+type BoxFuture<T> = Pin<Box<dyn Future<Output = T> + Send>>;
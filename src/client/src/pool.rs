@@ -0,0 +1,121 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::{
+    future::Future,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc,
+    },
+};
+
+use tonic::Status;
+
+use crate::Client;
+
+/// Several independent connections to the same target, handed out round
+/// robin, for callers whose load outgrows the streams of a single HTTP/2
+/// connection.
+///
+/// Created by
+/// [ClientBuilder::connect_pool](crate::ClientBuilder::connect_pool).
+/// Clones share the connections and the round robin position.
+#[derive(Debug, Clone)]
+pub struct Pool {
+    // Not behind the `Arc`, which would make the pool `!Send` since clients
+    // are `!Sync`.
+    clients: Vec<Client>,
+    next:    Arc<AtomicUsize>,
+}
+
+impl Pool {
+    pub(crate) fn new(clients: Vec<Client>) -> Self {
+        Self {
+            clients,
+            next: Arc::default(),
+        }
+    }
+
+    /// How many connections the pool holds.
+    pub fn size(&self) -> usize { self.clients.len() }
+
+    /// Returns the client whose turn it is, for calls other than the ones
+    /// the pool wraps.
+    pub fn client(&self) -> &Client {
+        let i = self.next.fetch_add(1, Ordering::Relaxed) % self.clients.len();
+        &self.clients[i]
+    }
+
+    /// Greets `name` over the next connection, see [Client::hello].
+    pub fn hello(&self, name: impl Into<String>) -> impl Future<Output = Result<String, Status>> {
+        self.client().hello(name)
+    }
+
+    /// Closes this handle, the connections themselves are closed once every
+    /// clone sharing them is gone.
+    pub fn close(self) { drop(self) }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Mutex;
+
+    use rsketch_server::{
+        interceptor::{GrpcRequest, GrpcService, Interceptor},
+        Server,
+    };
+    use tonic::transport::server::TcpConnectInfo;
+    use tower::ServiceExt;
+
+    use super::*;
+    use crate::{dial::tests::spawn_server, ClientBuilder};
+
+    /// Records the peer port of every call, one per client connection.
+    fn record_ports(ports: Arc<Mutex<Vec<u16>>>) -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+            let ports = ports.clone();
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                let port = request
+                    .extensions()
+                    .get::<TcpConnectInfo>()
+                    .and_then(TcpConnectInfo::remote_addr)
+                    .map(|addr| addr.port());
+                ports.lock().unwrap().extend(port);
+                async move { inner.oneshot(request).await }
+            })
+        }))
+    }
+
+    #[tokio::test]
+    async fn spreads_calls_over_its_connections() {
+        let ports = Arc::<Mutex<Vec<u16>>>::default();
+        let server = Server::new("").with_interceptors([record_ports(ports.clone())]);
+        let (port, _shutdown) = spawn_server(server).await;
+
+        let pool = ClientBuilder::new(format!("127.0.0.1:{port}"))
+            .connect_pool(4)
+            .unwrap();
+        assert_eq!(pool.size(), 4);
+        for _ in 0..8 {
+            pool.hello("pool").await.unwrap();
+        }
+
+        let mut ports = ports.lock().unwrap().clone();
+        assert_eq!(ports.len(), 8);
+        ports.sort_unstable();
+        ports.dedup();
+        assert_eq!(ports.len(), 4, "{ports:?}");
+    }
+}
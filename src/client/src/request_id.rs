@@ -0,0 +1,59 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Request IDs attached to outgoing calls, so the server, and every service
+//! it calls in turn, logs them under the same `x-request-id`.
+
+use std::task::{Context, Poll};
+
+use http::HeaderValue;
+use rsketch_common::propagation::{new_request_id, REQUEST_ID_HEADER};
+use tower::{Layer, Service};
+
+/// Sets a generated `x-request-id` on every call that doesn't carry one
+/// already, keeping IDs the caller set in the request metadata.
+#[derive(Debug, Clone, Default)]
+pub struct RequestIdLayer;
+
+impl<S> Layer<S> for RequestIdLayer {
+    type Service = RequestIdService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service { RequestIdService { inner } }
+}
+
+#[derive(Debug, Clone)]
+pub struct RequestIdService<S> {
+    inner: S,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for RequestIdService<S>
+where
+    S: Service<http::Request<ReqBody>>,
+{
+    type Error = S::Error;
+    type Future = S::Future;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: http::Request<ReqBody>) -> Self::Future {
+        if !request.headers().contains_key(REQUEST_ID_HEADER) {
+            if let Ok(id) = HeaderValue::from_str(&new_request_id()) {
+                request.headers_mut().insert(REQUEST_ID_HEADER, id);
+            }
+        }
+        self.inner.call(request)
+    }
+}
@@ -0,0 +1,361 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Retries unary calls failing with transient status codes, backing off
+//! exponentially with full jitter between attempts.
+//!
+//! Calls can also wait for the connection to become ready. tonic exposes no
+//! connectivity state, so a connection that isn't ready shows as calls
+//! failing with `Unavailable`, which are then repeated until they get
+//! through or the call's timeout passes.
+//!
+//! The timeout covers the call as a whole: every attempt only gets the time
+//! left of it, and no attempt is started that couldn't finish in time.
+
+use std::{
+    future::Future,
+    sync::{Arc, Mutex},
+    time::Duration,
+};
+
+use rand::Rng;
+use tokio::time::Instant;
+use tonic::{Code, Status};
+
+/// The first pause between two attempts waiting for the connection, doubled
+/// up to [MAX_READY_BACKOFF] after each one.
+const MIN_READY_BACKOFF: Duration = Duration::from_millis(50);
+const MAX_READY_BACKOFF: Duration = Duration::from_secs(1);
+
+/// How a [Client](crate::Client) retries failed unary calls.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RetryPolicy {
+    max_attempts: usize,
+    base_backoff: Duration,
+}
+
+impl RetryPolicy {
+    /// Makes up to `max_attempts` attempts in total, waiting a random time
+    /// below `base_backoff * 2^(n - 1)` before the n-th retry.
+    pub fn new(max_attempts: usize, base_backoff: Duration) -> Self {
+        Self {
+            max_attempts: max_attempts.max(1),
+            base_backoff,
+        }
+    }
+
+    /// Only failures that may go away on their own are worth another try.
+    pub fn is_retryable(code: Code) -> bool {
+        matches!(code, Code::Unavailable | Code::ResourceExhausted)
+    }
+
+    fn backoff(&self, retry: usize) -> Duration {
+        let exp = u32::try_from(retry.saturating_sub(1))
+            .unwrap_or(u32::MAX)
+            .min(16);
+        let ceiling = self.base_backoff.saturating_mul(1 << exp);
+        ceiling.mul_f64(rand::thread_rng().gen_range(0.0..=1.0))
+    }
+}
+
+/// Caps retries across every call of a [Client](crate::Client) and its
+/// clones, so a broad outage doesn't multiply the load by the number of
+/// attempts.
+///
+/// Each successful call earns `ratio` of a retry and every retry spends one.
+/// On top of that, `min_retries` per second are always available, so a
+/// client that hasn't succeeded yet, or whose calls all fail, can still
+/// retry at that rate. Retries are taken from this reserve first, which
+/// refills continuously up to `min_retries`. Once both are spent, failed
+/// calls return their error without retrying until time or successes refill
+/// the budget.
+#[derive(Debug, Clone)]
+pub struct RetryBudget {
+    ratio:       f64,
+    min_retries: f64,
+    tokens:      Arc<Mutex<Tokens>>,
+}
+
+#[derive(Debug)]
+struct Tokens {
+    /// Retries earned by successful calls.
+    earned:   f64,
+    /// Retries from the `min_retries` per second reserve.
+    reserve:  f64,
+    /// When the reserve was last refilled.
+    refilled: Instant,
+}
+
+impl RetryBudget {
+    /// How many successes the budget remembers, so a long healthy period
+    /// doesn't bank an unbounded number of retries.
+    const SUCCESS_WINDOW: f64 = 100.0;
+
+    pub fn new(ratio: f64, min_retries: u32) -> Self {
+        let min_retries = f64::from(min_retries);
+        Self {
+            ratio: ratio.max(0.0),
+            min_retries,
+            tokens: Arc::new(Mutex::new(Tokens {
+                earned:   0.0,
+                reserve:  min_retries,
+                refilled: Instant::now(),
+            })),
+        }
+    }
+
+    fn deposit(&self) {
+        let mut tokens = self.lock();
+        tokens.earned = (tokens.earned + self.ratio).min(self.ratio * Self::SUCCESS_WINDOW);
+    }
+
+    /// Spends a retry, `false` if none is left.
+    fn withdraw(&self) -> bool {
+        let mut tokens = self.lock();
+        let now = Instant::now();
+        let elapsed = now.duration_since(tokens.refilled).as_secs_f64();
+        tokens.reserve = (tokens.reserve + elapsed * self.min_retries).min(self.min_retries);
+        tokens.refilled = now;
+        if tokens.reserve >= 1.0 {
+            tokens.reserve -= 1.0;
+        } else if tokens.earned >= 1.0 {
+            tokens.earned -= 1.0;
+        } else {
+            return false;
+        }
+        true
+    }
+
+    fn lock(&self) -> std::sync::MutexGuard<'_, Tokens> {
+        self.tokens.lock().unwrap_or_else(|e| e.into_inner())
+    }
+}
+
+/// Backs off between the attempts of a call waiting for the connection to
+/// become ready.
+#[derive(Debug)]
+pub(crate) struct WaitForReady {
+    backoff: Duration,
+}
+
+impl WaitForReady {
+    pub(crate) fn new() -> Self {
+        Self {
+            backoff: MIN_READY_BACKOFF,
+        }
+    }
+
+    /// Returns the pause before the next attempt.
+    fn next_backoff(&mut self) -> Duration {
+        let backoff = self.backoff;
+        self.backoff = (backoff * 2).min(MAX_READY_BACKOFF);
+        backoff
+    }
+}
+
+/// Runs `call` until it succeeds, fails with a non-retryable code or the
+/// attempts or the `budget` run out, returning the last result.
+///
+/// `call` is given the time left before `deadline`, to send as the
+/// attempt's own deadline, and each attempt is cut off with
+/// `DeadlineExceeded` once it passes. Retries whose backoff would end past
+/// the deadline aren't made, the last failure is returned right away.
+///
+/// With `wait` set, attempts failing with `Unavailable` are repeated until
+/// the connection is ready without counting towards the policy's attempts,
+/// failing with `DeadlineExceeded` if it isn't by the deadline.
+pub(crate) async fn retry<T, F, Fut>(
+    policy: Option<RetryPolicy>,
+    budget: Option<&RetryBudget>,
+    mut wait: Option<WaitForReady>,
+    deadline: Option<Instant>,
+    mut call: F,
+) -> Result<T, Status>
+where
+    F: FnMut(Option<Duration>) -> Fut,
+    Fut: Future<Output = Result<T, Status>>,
+{
+    let mut attempt = 1;
+    loop {
+        let result = match deadline {
+            Some(deadline) => {
+                let remaining = deadline.saturating_duration_since(Instant::now());
+                tokio::time::timeout_at(deadline, call(Some(remaining)))
+                    .await
+                    .unwrap_or_else(|_| Err(Status::deadline_exceeded("deadline exceeded")))
+            }
+            None => call(None).await,
+        };
+        let status = match result {
+            Err(status) => status,
+            result => {
+                if let Some(budget) = budget {
+                    budget.deposit();
+                }
+                return result;
+            }
+        };
+        if let (Some(wait), Code::Unavailable) = (&mut wait, status.code()) {
+            let backoff = wait.next_backoff();
+            if !ends_before(deadline, backoff) {
+                return Err(Status::deadline_exceeded(format!(
+                    "connection not ready: {}",
+                    status.message()
+                )));
+            }
+            tokio::time::sleep(backoff).await;
+            continue;
+        }
+        match policy {
+            Some(policy)
+                if attempt < policy.max_attempts && RetryPolicy::is_retryable(status.code()) =>
+            {
+                let backoff = policy.backoff(attempt);
+                // Checked first so a retry that can't be made costs nothing.
+                if !ends_before(deadline, backoff) || !budget.map_or(true, RetryBudget::withdraw) {
+                    return Err(status);
+                }
+                tokio::time::sleep(backoff).await;
+                attempt += 1;
+            }
+            _ => return Err(status),
+        }
+    }
+}
+
+/// Whether a pause of `backoff` starting now ends before `deadline`, leaving
+/// time for another attempt.
+fn ends_before(deadline: Option<Instant>, backoff: Duration) -> bool {
+    deadline.map_or(true, |deadline| Instant::now() + backoff < deadline)
+}
+
+#[cfg(test)]
+mod tests {
+    use rsketch_server::{in_process::InProcessServer, Server};
+
+    use super::*;
+    use crate::{test_util::Flaky, ClientBuilder};
+
+    fn server(flaky: &Flaky, failures: usize) -> InProcessServer {
+        let interceptor = flaky.interceptor(failures, Status::unavailable("flaky"));
+        InProcessServer::start(Server::new("").with_interceptors([interceptor]))
+    }
+
+    #[tokio::test]
+    async fn retries_unavailable_until_success() {
+        let flaky = Flaky::new();
+        let server = server(&flaky, 2);
+        let client = ClientBuilder::new("")
+            .with_retry(3, Duration::from_millis(10))
+            .connect_with(server.channel());
+
+        assert_eq!(client.hello("retry").await.unwrap(), "Hello, retry");
+        assert_eq!(flaky.calls(), 3);
+    }
+
+    #[tokio::test]
+    async fn gives_up_after_max_attempts() {
+        let flaky = Flaky::new();
+        let server = server(&flaky, usize::MAX);
+        let client = ClientBuilder::new("")
+            .with_retry(3, Duration::from_millis(10))
+            .connect_with(server.channel());
+
+        let status = client.hello("retry").await.unwrap_err();
+        assert_eq!(status.code(), Code::Unavailable);
+        assert_eq!(flaky.calls(), 3);
+    }
+
+    #[tokio::test]
+    async fn fails_non_retryable_codes_immediately() {
+        let flaky = Flaky::new();
+        let server = server(&flaky, 0);
+        let client = ClientBuilder::new("")
+            .with_retry(3, Duration::from_millis(10))
+            .connect_with(server.channel());
+
+        let status = client.hello("bell\u{7}").await.unwrap_err();
+        assert_eq!(status.code(), Code::InvalidArgument);
+        assert_eq!(flaky.calls(), 1);
+    }
+
+    #[tokio::test]
+    async fn budget_refills_min_retries_per_second() {
+        let budget = RetryBudget::new(0.0, 10);
+        assert_eq!((0..20).filter(|_| budget.withdraw()).count(), 10);
+
+        tokio::time::sleep(Duration::from_millis(250)).await;
+        assert!(budget.withdraw());
+        assert!(budget.withdraw());
+    }
+
+    #[tokio::test]
+    async fn budget_earns_retries_from_successes() {
+        let budget = RetryBudget::new(0.5, 0);
+        assert!(!budget.withdraw());
+
+        budget.deposit();
+        assert!(!budget.withdraw());
+        budget.deposit();
+        assert!(budget.withdraw());
+        assert!(!budget.withdraw());
+
+        // Only the last SUCCESS_WINDOW successes count.
+        for _ in 0..1000 {
+            budget.deposit();
+        }
+        assert_eq!((0..100).filter(|_| budget.withdraw()).count(), 50);
+    }
+
+    #[tokio::test]
+    async fn spent_budget_stops_retries() {
+        let flaky = Flaky::new();
+        let server = server(&flaky, usize::MAX);
+        let client = ClientBuilder::new("")
+            .with_retry(3, Duration::from_millis(10))
+            .with_retry_budget(0.0, 1)
+            .connect_with(server.channel());
+
+        // The first call retries once, the second has nothing left to spend.
+        client.hello("retry").await.unwrap_err();
+        assert_eq!(flaky.calls(), 2);
+        client.hello("retry").await.unwrap_err();
+        assert_eq!(flaky.calls(), 3);
+    }
+
+    #[tokio::test]
+    async fn never_retries_past_the_timeout() {
+        let flaky = Flaky::new();
+        let server = server(&flaky, usize::MAX);
+        let timeout = Duration::from_millis(300);
+        let client = ClientBuilder::new("")
+            .with_retry(100, Duration::from_millis(50))
+            .with_timeout(timeout)
+            .connect_with(server.channel());
+
+        let start = Instant::now();
+        let status = client.hello("retry").await.unwrap_err();
+        // With some slack for the timer.
+        let elapsed = start.elapsed();
+        assert!(
+            elapsed < timeout + Duration::from_millis(50),
+            "took {elapsed:?}"
+        );
+        assert!(
+            matches!(status.code(), Code::Unavailable | Code::DeadlineExceeded),
+            "{status:?}"
+        );
+        assert!(flaky.calls() < 100);
+    }
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Helpers for testing clients against an in-process server.
+
+use std::sync::{
+    atomic::{AtomicUsize, Ordering},
+    Arc,
+};
+
+use rsketch_server::interceptor::{GrpcRequest, GrpcService, Interceptor};
+use tonic::Status;
+use tower::ServiceExt;
+
+/// Counts the calls reaching the server, failing those before the
+/// `failures`-th with `status`.
+#[derive(Debug, Clone)]
+pub(crate) struct Flaky {
+    calls: Arc<AtomicUsize>,
+}
+
+impl Flaky {
+    pub(crate) fn new() -> Self {
+        Self {
+            calls: Arc::default(),
+        }
+    }
+
+    pub(crate) fn calls(&self) -> usize { self.calls.load(Ordering::SeqCst) }
+
+    /// Returns the server side interceptor failing the first `failures`
+    /// calls with `status`.
+    pub(crate) fn interceptor(&self, failures: usize, status: Status) -> Interceptor {
+        let calls = self.calls.clone();
+        Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+            let calls = calls.clone();
+            let status = status.clone();
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                let failed =
+                    (calls.fetch_add(1, Ordering::SeqCst) < failures).then(|| status.clone());
+                async move {
+                    match failed {
+                        Some(status) => Ok(status.to_http()),
+                        None => inner.oneshot(request).await,
+                    }
+                }
+            })
+        }))
+    }
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! OpenTelemetry spans for outgoing calls, propagated to the server in the
+//! request metadata so its spans join the caller's trace.
+
+use std::task::{Context, Poll};
+
+use opentelemetry::global;
+use rsketch_common::propagation::HeaderInjector;
+use tonic::{Code, Status};
+use tower::{Layer, Service};
+use tracing::{field, Instrument, Span};
+use tracing_opentelemetry::OpenTelemetrySpanExt;
+
+use crate::BoxFuture;
+
+/// Wraps every call in a client span named after the full method, e.g.
+/// `rsketch.v1.hello.Hello/Hello`, recording the resulting status code.
+#[derive(Debug, Clone, Default)]
+pub struct TraceLayer;
+
+impl<S> Layer<S> for TraceLayer {
+    type Service = TraceService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service { TraceService { inner } }
+}
+
+#[derive(Debug, Clone)]
+pub struct TraceService<S> {
+    inner: S,
+}
+
+impl<S, ReqBody, ResBody> Service<http::Request<ReqBody>> for TraceService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<ResBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+
+        let span = tracing::info_span!(
+            "grpc.client",
+            otel.name = request.uri().path().trim_start_matches('/'),
+            otel.kind = "client",
+            otel.status_code = field::Empty,
+            otel.status_message = field::Empty,
+            rpc.system = "grpc",
+            rpc.grpc.status_code = field::Empty,
+        );
+        let context = span.context();
+        global::get_text_map_propagator(|propagator| {
+            propagator.inject_context(&context, &mut HeaderInjector(request.headers_mut()))
+        });
+
+        Box::pin(
+            async move {
+                let result = inner.call(request).await;
+                let span = Span::current();
+                match &result {
+                    Ok(response) => {
+                        let status = Status::from_header_map(response.headers());
+                        let code = status.as_ref().map_or(Code::Ok, |status| status.code());
+                        span.record("rpc.grpc.status_code", code as i32);
+                        if let Some(status) = status.filter(|status| status.code() != Code::Ok) {
+                            span.record("otel.status_code", "ERROR");
+                            span.record("otel.status_message", status.message());
+                        }
+                    }
+                    Err(_) => {
+                        // Transport failures surface as `Unavailable`.
+                        span.record("rpc.grpc.status_code", Code::Unavailable as i32);
+                        span.record("otel.status_code", "ERROR");
+                    }
+                }
+                result
+            }
+            .instrument(span),
+        )
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use opentelemetry::trace::{SpanKind, TracerProvider as _};
+    use opentelemetry_sdk::{
+        propagation::TraceContextPropagator, testing::trace::InMemorySpanExporter,
+        trace::TracerProvider,
+    };
+    use rsketch_server::{in_process::InProcessServer, Server};
+    use tracing_subscriber::layer::SubscriberExt;
+
+    use super::*;
+
+    // The subscriber is only installed on this thread, which the single
+    // threaded runtime runs the server on too.
+    #[tokio::test(flavor = "current_thread")]
+    async fn server_span_is_child_of_client_span() {
+        global::set_text_map_propagator(TraceContextPropagator::new());
+        let exporter = InMemorySpanExporter::default();
+        let provider = TracerProvider::builder()
+            .with_simple_exporter(exporter.clone())
+            .build();
+        let subscriber = tracing_subscriber::registry()
+            .with(tracing_opentelemetry::layer().with_tracer(provider.tracer("test")));
+        let _guard = tracing::subscriber::set_default(subscriber);
+
+        let server = InProcessServer::start(Server::new("").with_tracing(true));
+        let mut client = HelloClient::new(TraceLayer.layer(server.channel()));
+        client.hello(HelloRequest::default()).await.unwrap();
+        server.shutdown().await.unwrap();
+        provider.force_flush();
+
+        let spans = exporter.get_finished_spans().unwrap();
+        let span = |kind: SpanKind| {
+            spans
+                .iter()
+                .find(|span| span.span_kind == kind)
+                .unwrap_or_else(|| panic!("no {kind:?} span in {spans:?}"))
+        };
+        let (client, server) = (span(SpanKind::Client), span(SpanKind::Server));
+        assert_eq!(client.name, "rsketch.v1.hello.Hello/Hello");
+        assert_eq!(server.name, client.name);
+        assert_eq!(
+            server.span_context.trace_id(),
+            client.span_context.trace_id()
+        );
+        assert_eq!(server.parent_span_id, client.span_context.span_id());
+    }
+}
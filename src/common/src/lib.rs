@@ -15,4 +15,5 @@
 pub mod env;
 pub mod error;
 pub mod logger;
+pub mod propagation;
 pub mod sentry_init;
@@ -0,0 +1,55 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Carries OpenTelemetry context and request IDs across process boundaries
+//! in HTTP headers, which is also where gRPC keeps its metadata.
+
+use http::{
+    header::{HeaderName, HeaderValue},
+    HeaderMap,
+};
+use opentelemetry::propagation::{Extractor, Injector};
+
+/// The header correlating a request across every service it passes through.
+pub const REQUEST_ID_HEADER: &str = "x-request-id";
+
+/// Generates a fresh request ID, a random UUID.
+pub fn new_request_id() -> String { uuid::Uuid::new_v4().to_string() }
+
+/// Reads propagated context from incoming headers.
+pub struct HeaderExtractor<'a>(pub &'a HeaderMap);
+
+impl Extractor for HeaderExtractor<'_> {
+    fn get(&self, key: &str) -> Option<&str> {
+        self.0.get(key).and_then(|value| value.to_str().ok())
+    }
+
+    fn keys(&self) -> Vec<&str> { self.0.keys().map(HeaderName::as_str).collect() }
+}
+
+/// Writes context to propagate into outgoing headers.
+pub struct HeaderInjector<'a>(pub &'a mut HeaderMap);
+
+impl Injector for HeaderInjector<'_> {
+    fn set(&mut self, key: &str, value: String) {
+        // Keys and values come from the propagator and are valid header
+        // material, skip anything that isn't rather than failing the call.
+        if let (Ok(name), Ok(value)) = (
+            HeaderName::from_bytes(key.as_bytes()),
+            HeaderValue::from_str(&value),
+        ) {
+            self.0.insert(name, value);
+        }
+    }
+}
@@ -0,0 +1,200 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Plain HTTP endpoints for operational tooling, served on the metrics port:
+//!
+//! - `/metrics`, the Prometheus metrics
+//! - `/readyz`, 200 while the server accepts new calls and 503 from the moment
+//!   shutdown begins, so load balancers stop routing here before the
+//!   connections drain
+//! - `/livez`, 200 for as long as the process is up
+
+use std::{
+    convert::Infallible,
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc,
+    },
+};
+
+use hyper::{
+    header::{HeaderValue, CONTENT_TYPE},
+    service::{make_service_fn, service_fn},
+    Body, Request, Response, StatusCode,
+};
+use prometheus::{Encoder, Registry, TextEncoder};
+use snafu::ResultExt;
+use tokio::net::TcpListener;
+
+use crate::error::{AdminSnafu, BindSnafu, Result};
+
+/// Serves the endpoints until the task is dropped, `/metrics` from
+/// `registry` and `/readyz` from `ready`.
+pub(crate) async fn serve(
+    listener: TcpListener,
+    registry: Registry,
+    ready: Arc<AtomicBool>,
+) -> Result<()> {
+    let addr = listener
+        .local_addr()
+        .map_or_else(|_| "metrics listener".to_string(), |addr| addr.to_string());
+    let listener = listener.into_std().context(BindSnafu { addr })?;
+
+    let make_service = make_service_fn(move |_| {
+        let registry = registry.clone();
+        let ready = ready.clone();
+        async move {
+            Ok::<_, Infallible>(service_fn(move |request| {
+                let response = handle(&request, &registry, &ready);
+                async move { Ok::<_, Infallible>(response) }
+            }))
+        }
+    });
+
+    hyper::Server::from_tcp(listener)
+        .context(AdminSnafu)?
+        .serve(make_service)
+        .await
+        .context(AdminSnafu)
+}
+
+fn handle(request: &Request<Body>, registry: &Registry, ready: &AtomicBool) -> Response<Body> {
+    match request.uri().path() {
+        "/metrics" => metrics(registry),
+        "/readyz" if ready.load(Ordering::Acquire) => status(StatusCode::OK),
+        "/readyz" => status(StatusCode::SERVICE_UNAVAILABLE),
+        "/livez" => status(StatusCode::OK),
+        _ => status(StatusCode::NOT_FOUND),
+    }
+}
+
+fn metrics(registry: &Registry) -> Response<Body> {
+    let mut buffer = Vec::new();
+    if let Err(e) = TextEncoder::new().encode(&registry.gather(), &mut buffer) {
+        let mut response = Response::new(Body::from(e.to_string()));
+        *response.status_mut() = StatusCode::INTERNAL_SERVER_ERROR;
+        return response;
+    }
+
+    let mut response = Response::new(Body::from(buffer));
+    response.headers_mut().insert(
+        CONTENT_TYPE,
+        HeaderValue::from_static(prometheus::TEXT_FORMAT),
+    );
+    response
+}
+
+fn status(code: StatusCode) -> Response<Body> {
+    let mut response = Response::new(Body::empty());
+    *response.status_mut() = code;
+    response
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use hyper::Client;
+    use tokio::sync::{mpsc, oneshot};
+    use tokio_stream::wrappers::ReceiverStream;
+    use tonic::transport::Endpoint;
+
+    use super::*;
+    use crate::Server;
+
+    /// Returns the status of `GET /readyz` at `addr`, `None` while nothing
+    /// listens there.
+    async fn readyz(addr: &str) -> Option<StatusCode> {
+        let uri = format!("http://{addr}/readyz").parse().unwrap();
+        let response = Client::new().get(uri).await.ok()?;
+        Some(response.status())
+    }
+
+    /// Polls `/readyz` until it answers with `code`.
+    async fn wait_for_readyz(addr: &str, code: StatusCode) {
+        tokio::time::timeout(Duration::from_secs(5), async {
+            while readyz(addr).await != Some(code) {
+                tokio::time::sleep(Duration::from_millis(10)).await;
+            }
+        })
+        .await
+        .unwrap_or_else(|_| panic!("/readyz never answered {code}"));
+    }
+
+    #[tokio::test]
+    async fn readyz_follows_the_ready_flag() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap().to_string();
+        let ready = Arc::new(AtomicBool::new(false));
+        let admin = tokio::spawn(serve(listener, Registry::new(), ready.clone()));
+
+        assert_eq!(readyz(&addr).await, Some(StatusCode::SERVICE_UNAVAILABLE));
+        ready.store(true, Ordering::Release);
+        assert_eq!(readyz(&addr).await, Some(StatusCode::OK));
+        ready.store(false, Ordering::Release);
+        assert_eq!(readyz(&addr).await, Some(StatusCode::SERVICE_UNAVAILABLE));
+
+        let uri = format!("http://{addr}/livez").parse().unwrap();
+        let livez = Client::new().get(uri).await.unwrap();
+        assert_eq!(livez.status(), StatusCode::OK);
+        admin.abort();
+    }
+
+    #[tokio::test]
+    async fn readyz_fails_while_the_server_drains() {
+        let admin_addr = {
+            let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+            listener.local_addr().unwrap().to_string()
+        };
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let grpc_addr = listener.local_addr().unwrap();
+        let (shutdown, shutdown_rx) = oneshot::channel::<()>();
+        let serving = tokio::spawn(
+            Server::new("")
+                .with_listener(listener)
+                .with_metrics_addr(admin_addr.clone())
+                .run(async move {
+                    let _ = shutdown_rx.await;
+                }),
+        );
+        wait_for_readyz(&admin_addr, StatusCode::OK).await;
+
+        // A chat left open keeps the server draining.
+        let channel = Endpoint::from_shared(format!("http://{grpc_addr}"))
+            .unwrap()
+            .connect()
+            .await
+            .unwrap();
+        let (names, rx) = mpsc::channel(1);
+        let mut replies = HelloClient::new(channel)
+            .hello_chat(ReceiverStream::new(rx))
+            .await
+            .unwrap()
+            .into_inner();
+        let name = HelloRequest {
+            name: "Ada".to_string(),
+        };
+        names.send(name).await.unwrap();
+        replies.message().await.unwrap().unwrap();
+
+        shutdown.send(()).unwrap();
+        wait_for_readyz(&admin_addr, StatusCode::SERVICE_UNAVAILABLE).await;
+        assert!(!serving.is_finished());
+
+        drop(names);
+        assert!(replies.message().await.unwrap().is_none());
+        serving.await.unwrap().unwrap();
+    }
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/// What the `GetInfo` RPC reports about the running server, set with
+/// [Server::with_build_info](crate::Server::with_build_info).
+///
+/// Binaries usually fill it from their build script, the default only knows
+/// the version of this crate.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BuildInfo {
+    pub version:       String,
+    pub git_commit:    String,
+    pub build_time:    String,
+    pub rustc_version: String,
+}
+
+impl Default for BuildInfo {
+    fn default() -> Self {
+        Self {
+            version:       env!("CARGO_PKG_VERSION").to_string(),
+            git_commit:    String::new(),
+            build_time:    String::new(),
+            rustc_version: String::new(),
+        }
+    }
+}
@@ -0,0 +1,526 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Serving the connections of a [Server](crate::Server), with idle and age
+//! limits.
+//!
+//! Every accepted connection is served by hyper on a task of its own, after
+//! the TLS handshake if the server has TLS configured. Connections past
+//! their [Keepalive] idle time or maximum age, and all of them once the
+//! server drains, are shut down gracefully: hyper sends the client a GOAWAY,
+//! so it stops starting calls on the connection and reconnects, and closes
+//! the connection once the calls in flight have finished.
+//!
+//! The calls in flight are counted by a [ConnectionService] wrapping the
+//! server's service on each connection, which also puts the connect info of
+//! the connection, e.g. a
+//! [TcpConnectInfo](tonic::transport::server::TcpConnectInfo), into the
+//! request extensions, along with the [PeerCertificates] of TLS clients.
+
+use std::{
+    convert::Infallible,
+    pin::Pin,
+    sync::{
+        atomic::{AtomicUsize, Ordering},
+        Arc, Mutex,
+    },
+    task::{Context, Poll},
+};
+
+use http::HeaderMap;
+use hyper::{
+    body::{Bytes, HttpBody, SizeHint},
+    server::conn::{Connection, Http},
+};
+use tokio::{
+    io::{AsyncRead, AsyncWrite},
+    sync::{watch, Notify},
+    task::JoinSet,
+    time::Instant,
+};
+use tokio_rustls::TlsAcceptor;
+use tokio_stream::{Stream, StreamExt};
+use tonic::{
+    body::BoxBody,
+    transport::{server::Connected, Certificate},
+    Status,
+};
+use tower::Service;
+use tracing::{debug, warn};
+
+use crate::{
+    interceptor::{BoxFuture, GrpcRequest, GrpcResponse, GrpcService},
+    Keepalive,
+};
+
+/// The certificate chain a TLS client presented, leaf first.
+#[derive(Debug, Clone)]
+pub(crate) struct PeerCertificates(pub(crate) Arc<Vec<Certificate>>);
+
+/// Serves the connections yielded by `incoming` with `service` until the
+/// stream ends or `drain` is signalled, then waits for the open connections
+/// to close.
+///
+/// Once `drain` is signalled, by a send or by dropping its sender, every
+/// connection is shut down gracefully.
+pub(crate) async fn serve<I, IO, IE>(
+    incoming: I,
+    service: GrpcService,
+    keepalive: Keepalive,
+    tls: Option<TlsAcceptor>,
+    drain: watch::Receiver<()>,
+) where
+    I: Stream<Item = Result<IO, IE>>,
+    IO: AsyncRead + AsyncWrite + Connected + Unpin + Send + 'static,
+    IO::ConnectInfo: Clone + Send + Sync + 'static,
+    IE: Into<Box<dyn std::error::Error + Send + Sync>>,
+{
+    let mut http = Http::new();
+    http.http2_only(true)
+        .http2_keep_alive_interval(keepalive.interval);
+    if let Some(timeout) = keepalive.timeout {
+        http.http2_keep_alive_timeout(timeout);
+    }
+
+    let mut connections = JoinSet::new();
+    tokio::pin!(incoming);
+    loop {
+        let io = tokio::select! {
+            io = incoming.next() => io,
+            _ = draining(drain.clone()) => break,
+            Some(joined) = connections.join_next() => {
+                if let Err(err) = joined {
+                    warn!("connection task failed: {err}");
+                }
+                continue;
+            }
+        };
+        match io {
+            Some(Ok(io)) => {
+                connections.spawn(serve_connection(
+                    io,
+                    http.clone(),
+                    service.clone(),
+                    keepalive,
+                    tls.clone(),
+                    drain.clone(),
+                ));
+            }
+            Some(Err(err)) => {
+                let err: Box<dyn std::error::Error + Send + Sync> = err.into();
+                warn!("failed to accept a connection: {err}");
+            }
+            None => break,
+        }
+    }
+    // The connections close on their own once `drain` is signalled.
+    while connections.join_next().await.is_some() {}
+}
+
+/// Completes once `drain` is signalled.
+async fn draining(mut drain: watch::Receiver<()>) { let _ = drain.changed().await; }
+
+async fn serve_connection<IO>(
+    io: IO,
+    http: Http,
+    service: GrpcService,
+    keepalive: Keepalive,
+    tls: Option<TlsAcceptor>,
+    drain: watch::Receiver<()>,
+) where
+    IO: AsyncRead + AsyncWrite + Connected + Unpin + Send + 'static,
+    IO::ConnectInfo: Clone + Send + Sync + 'static,
+{
+    let state = Arc::new(ConnectionState::new());
+    let Some(tls) = tls else {
+        let service = ConnectionService {
+            inner: service,
+            info:  io.connect_info(),
+            certs: None,
+            state: state.clone(),
+        };
+        return drive(
+            http.serve_connection(io, service),
+            &state,
+            &keepalive,
+            drain,
+        )
+        .await;
+    };
+
+    let io = tokio::select! {
+        io = tls.accept(io) => match io {
+            Ok(io) => io,
+            Err(err) => {
+                debug!("TLS handshake failed: {err}");
+                return;
+            }
+        },
+        _ = draining(drain.clone()) => return,
+    };
+    let info = io.connect_info();
+    let service = ConnectionService {
+        inner: service,
+        certs: info.peer_certs().map(PeerCertificates),
+        info,
+        state: state.clone(),
+    };
+    drive(
+        http.serve_connection(io, service),
+        &state,
+        &keepalive,
+        drain,
+    )
+    .await
+}
+
+/// Why a connection is being closed.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Close {
+    Idle,
+    Aged,
+    Draining,
+}
+
+/// Serves `connection` until it ends, shutting it down gracefully once it is
+/// due to close.
+///
+/// Only connections past their maximum age get cut off, once the calls in
+/// flight have had [Keepalive::max_connection_age_grace] to finish.
+async fn drive<IO, C>(
+    connection: Connection<IO, ConnectionService<C>>,
+    state: &ConnectionState,
+    keepalive: &Keepalive,
+    drain: watch::Receiver<()>,
+) where
+    IO: AsyncRead + AsyncWrite + Unpin + Send + 'static,
+    C: Clone + Send + Sync + 'static,
+{
+    tokio::pin!(connection);
+    let close = tokio::select! {
+        result = connection.as_mut() => return finished(result),
+        close = closing(state, keepalive, drain) => close,
+    };
+    debug!(reason = ?close, "closing connection gracefully");
+    connection.as_mut().graceful_shutdown();
+    let result = match (close, keepalive.max_connection_age_grace) {
+        (Close::Aged, Some(grace)) => match tokio::time::timeout(grace, connection).await {
+            Ok(result) => result,
+            Err(_) => {
+                debug!("dropping connection past its maximum age's grace period");
+                return;
+            }
+        },
+        _ => connection.await,
+    };
+    finished(result)
+}
+
+fn finished(result: hyper::Result<()>) {
+    if let Err(err) = result {
+        debug!("connection failed: {err}");
+    }
+}
+
+/// Waits until the connection is due to close, returning why.
+async fn closing(
+    state: &ConnectionState,
+    keepalive: &Keepalive,
+    drain: watch::Receiver<()>,
+) -> Close {
+    let aged = sleep_until(keepalive.max_connection_age.map(|age| state.created + age));
+    let draining = draining(drain);
+    tokio::pin!(aged, draining);
+    loop {
+        let idle = sleep_until(state.idle_until(keepalive));
+        // A call starting or finishing takes precedence over the idle time
+        // computed before it, which is then recomputed.
+        tokio::select! {
+            biased;
+            _ = &mut draining => return Close::Draining,
+            _ = &mut aged => return Close::Aged,
+            _ = state.changed.notified() => {}
+            _ = idle => return Close::Idle,
+        }
+    }
+}
+
+/// Sleeps until `at`, forever if `None`.
+async fn sleep_until(at: Option<Instant>) {
+    match at {
+        Some(at) => tokio::time::sleep_until(at).await,
+        None => std::future::pending().await,
+    }
+}
+
+/// What is known of a connection to decide when to close it.
+#[derive(Debug)]
+struct ConnectionState {
+    created:    Instant,
+    /// Calls in flight.
+    active:     AtomicUsize,
+    /// When the last call finished, or the connection was accepted.
+    idle_since: Mutex<Instant>,
+    /// Notified whenever a call starts or finishes.
+    changed:    Notify,
+}
+
+impl ConnectionState {
+    fn new() -> Self {
+        let now = Instant::now();
+        Self {
+            created:    now,
+            active:     AtomicUsize::new(0),
+            idle_since: Mutex::new(now),
+            changed:    Notify::new(),
+        }
+    }
+
+    /// Returns when the connection is to be closed for being idle, `None`
+    /// while calls are in flight or if idle connections stay open.
+    fn idle_until(&self, keepalive: &Keepalive) -> Option<Instant> {
+        if self.active.load(Ordering::Acquire) > 0 {
+            return None;
+        }
+        let idle_since = *self.idle_since.lock().unwrap_or_else(|e| e.into_inner());
+        keepalive.max_connection_idle.map(|idle| idle_since + idle)
+    }
+}
+
+/// Counts a call as in flight on its connection until dropped.
+struct ActiveCall(Arc<ConnectionState>);
+
+impl ActiveCall {
+    fn enter(state: Arc<ConnectionState>) -> Self {
+        state.active.fetch_add(1, Ordering::AcqRel);
+        state.changed.notify_one();
+        Self(state)
+    }
+}
+
+impl Drop for ActiveCall {
+    fn drop(&mut self) {
+        *self.0.idle_since.lock().unwrap_or_else(|e| e.into_inner()) = Instant::now();
+        self.0.active.fetch_sub(1, Ordering::AcqRel);
+        self.0.changed.notify_one();
+    }
+}
+
+/// Serves the calls of a single connection, whose transport has connect
+/// info of type `C`.
+#[derive(Clone)]
+struct ConnectionService<C> {
+    inner: GrpcService,
+    info:  C,
+    certs: Option<PeerCertificates>,
+    state: Arc<ConnectionState>,
+}
+
+impl<C> Service<GrpcRequest> for ConnectionService<C>
+where
+    C: Clone + Send + Sync + 'static,
+{
+    type Error = Infallible;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = GrpcResponse;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: GrpcRequest) -> Self::Future {
+        // Where tonic's handlers find it, e.g. for `Request::remote_addr`.
+        request.extensions_mut().insert(self.info.clone());
+        if let Some(certs) = &self.certs {
+            request.extensions_mut().insert(certs.clone());
+        }
+        let call = ActiveCall::enter(self.state.clone());
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        let response = inner.call(request);
+        Box::pin(async move {
+            let response = response.await?;
+            // The call lasts until its response has been sent in full.
+            Ok(response.map(|body| {
+                tonic::body::boxed(TrackedBody {
+                    inner: body,
+                    _call: call,
+                })
+            }))
+        })
+    }
+}
+
+/// A response body keeping its call in flight until dropped.
+struct TrackedBody {
+    inner: BoxBody,
+    _call: ActiveCall,
+}
+
+impl HttpBody for TrackedBody {
+    type Data = Bytes;
+    type Error = Status;
+
+    fn poll_data(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Self::Data, Self::Error>>> {
+        Pin::new(&mut self.inner).poll_data(cx)
+    }
+
+    fn poll_trailers(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Option<HeaderMap>, Self::Error>> {
+        Pin::new(&mut self.inner).poll_trailers(cx)
+    }
+
+    fn is_end_stream(&self) -> bool { self.inner.is_end_stream() }
+
+    fn size_hint(&self) -> SizeHint { self.inner.size_hint() }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::time::Duration;
+
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use hyper::client::conn::{self, SendRequest};
+    use tokio::io::DuplexStream;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    fn server(keepalive: Keepalive) -> InProcessServer {
+        InProcessServer::start(Server::new("").with_keepalive(keepalive))
+    }
+
+    /// Opens an HTTP/2 connection without making any call, returning the
+    /// connection, which ends once the server has closed it.
+    async fn open(
+        server: &InProcessServer,
+    ) -> (
+        SendRequest<hyper::Body>,
+        conn::Connection<DuplexStream, hyper::Body>,
+    ) {
+        let io = server.connector().connect().unwrap();
+        conn::Builder::new()
+            .http2_only(true)
+            .handshake(io)
+            .await
+            .unwrap()
+    }
+
+    /// Waits for the server to close `connection`.
+    async fn closed(connection: conn::Connection<DuplexStream, hyper::Body>) -> bool {
+        let closed = tokio::time::timeout(Duration::from_secs(5), connection);
+        matches!(closed.await, Ok(Ok(())))
+    }
+
+    fn hello(name: &str) -> HelloRequest {
+        HelloRequest {
+            name: name.to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn closes_idle_connections() {
+        let server = server(Keepalive {
+            max_connection_idle: Some(Duration::from_millis(100)),
+            ..Keepalive::default()
+        });
+
+        let (_requests, connection) = open(&server).await;
+        assert!(closed(connection).await);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn draining_closes_open_connections() {
+        let server = server(Keepalive {
+            max_connection_idle: None,
+            ..Keepalive::default()
+        });
+
+        let (_requests, connection) = open(&server).await;
+        let connection = tokio::spawn(closed(connection));
+        server.shutdown().await.unwrap();
+        assert!(connection.await.unwrap());
+    }
+
+    #[tokio::test]
+    async fn calls_in_flight_keep_the_connection_open() {
+        let server = server(Keepalive {
+            max_connection_idle: Some(Duration::from_millis(100)),
+            ..Keepalive::default()
+        });
+        let mut client = HelloClient::new(server.channel());
+
+        let (names, rx) = tokio::sync::mpsc::unbounded_channel();
+        let requests = tokio_stream::wrappers::UnboundedReceiverStream::new(rx);
+        let mut replies = client.hello_chat(requests).await.unwrap().into_inner();
+        names.send(hello("early")).unwrap();
+        assert!(replies.next().await.unwrap().is_ok());
+
+        tokio::time::sleep(Duration::from_millis(300)).await;
+        names.send(hello("late")).unwrap();
+        let reply = replies.next().await.unwrap().unwrap();
+        assert!(reply.message.contains("late"), "{}", reply.message);
+
+        drop(names);
+        drop(replies);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn aged_connections_let_calls_in_flight_finish() {
+        let server = server(Keepalive {
+            max_connection_idle: None,
+            max_connection_age: Some(Duration::from_millis(100)),
+            ..Keepalive::default()
+        });
+        let mut client = HelloClient::new(server.channel());
+
+        let (names, rx) = tokio::sync::mpsc::unbounded_channel();
+        let requests = tokio_stream::wrappers::UnboundedReceiverStream::new(rx);
+        let mut replies = client.hello_chat(requests).await.unwrap().into_inner();
+        names.send(hello("early")).unwrap();
+        assert!(replies.next().await.unwrap().is_ok());
+
+        // The connection has been told to go away, but the chat goes on.
+        tokio::time::sleep(Duration::from_millis(300)).await;
+        names.send(hello("late")).unwrap();
+        let reply = replies.next().await.unwrap().unwrap();
+        assert!(reply.message.contains("late"), "{}", reply.message);
+        drop(names);
+        assert!(replies.next().await.is_none());
+
+        // Later calls go over a new connection.
+        client.hello(hello("again")).await.unwrap();
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn clients_reconnect_after_an_idle_close() {
+        let server = server(Keepalive {
+            max_connection_idle: Some(Duration::from_millis(100)),
+            ..Keepalive::default()
+        });
+        let mut client = HelloClient::new(server.channel());
+
+        client.hello(hello("first")).await.unwrap();
+        tokio::time::sleep(Duration::from_millis(300)).await;
+        client.hello(hello("second")).await.unwrap();
+        server.shutdown().await.unwrap();
+    }
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::{path::PathBuf, time::Duration};
+
+use snafu::Snafu;
+
+pub type Result<T> = std::result::Result<T, Error>;
+
+/// What a hook registered with
+/// [Server::with_shutdown_hook](crate::Server::with_shutdown_hook) fails with.
+pub type ShutdownHookError = Box<dyn std::error::Error + Send + Sync>;
+
+#[derive(Snafu, Debug)]
+#[snafu(visibility(pub))]
+pub enum Error {
+    #[snafu(display("Failed to listen on {addr}"))]
+    Bind {
+        addr:   String,
+        source: std::io::Error,
+    },
+
+    #[snafu(display("Failed to remove stale socket {}", path.display()))]
+    RemoveSocket {
+        path:   PathBuf,
+        source: std::io::Error,
+    },
+
+    #[snafu(display("Failed to read TLS material from {}", path.display()))]
+    ReadTls {
+        path:   PathBuf,
+        source: std::io::Error,
+    },
+
+    #[snafu(display("Invalid PEM encoded {what}"))]
+    InvalidPem {
+        what:   &'static str,
+        source: std::io::Error,
+    },
+
+    #[snafu(display("No PEM encoded {what} found"))]
+    MissingPem { what: &'static str },
+
+    #[snafu(display("Default timeout given for unknown method {method}"))]
+    UnknownMethod { method: String },
+
+    #[snafu(display("Failed to build the reflection service"))]
+    Reflection {
+        source: tonic_reflection::server::Error,
+    },
+
+    #[snafu(display("Failed to register metrics"))]
+    Metrics { source: prometheus::Error },
+
+    #[snafu(display("Metrics HTTP server failed"))]
+    Admin { source: hyper::Error },
+
+    #[snafu(display("HTTP gateway failed"))]
+    Gateway { source: hyper::Error },
+
+    #[snafu(display("Invalid TLS configuration"))]
+    TlsConfig { source: tokio_rustls::rustls::Error },
+
+    #[snafu(display("Invalid client CA"))]
+    ClientCa {
+        source: tokio_rustls::rustls::server::VerifierBuilderError,
+    },
+
+    #[snafu(display("In-flight requests didn't drain within {timeout:?}, forced shutdown"))]
+    DrainTimeout { timeout: Duration },
+
+    #[snafu(display("{} shutdown hook(s) failed", errors.len()))]
+    ShutdownHooks { errors: Vec<ShutdownHookError> },
+
+    #[snafu(display("gRPC server task failed"))]
+    ServerTask { source: tokio::task::JoinError },
+}
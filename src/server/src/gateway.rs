@@ -0,0 +1,363 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! HTTP/JSON gateway translating REST calls into gRPC calls on a backend
+//! server, for clients that don't speak gRPC.
+//!
+//! Routes:
+//!
+//! - `GET /v1/hello/{name}` calls `rsketch.v1.hello.Hello/Hello` and returns
+//!   `{"message": "Hello, {name}"}`.
+//!
+//! Failed calls return `{"code": .., "message": ..}` with the HTTP status
+//! matching the gRPC code, e.g. 503 when the backend is unreachable. Other
+//! methods than `GET` on a route get a 405 listing the allowed ones in the
+//! `Allow` header.
+//!
+//! The `Authorization` and `x-request-id` headers are passed on to the
+//! backend as metadata, so the gateway works in front of a server requiring
+//! tokens. Backend calls are bounded by a timeout, sent along as their
+//! deadline, and answer 504 once it passes.
+
+use std::{convert::Infallible, time::Duration};
+
+use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+use hyper::{
+    header::{HeaderValue, ALLOW, CONTENT_TYPE},
+    service::{make_service_fn, service_fn},
+    Body, Method, Request, Response, StatusCode,
+};
+use percent_encoding::percent_decode_str;
+use rsketch_common::propagation::REQUEST_ID_HEADER;
+use snafu::ResultExt;
+use tokio::net::TcpListener;
+use tonic::{metadata::AsciiMetadataValue, transport::Channel, Code, Status};
+
+use crate::error::{BindSnafu, GatewaySnafu, Result};
+
+/// How long the gateway waits for the backend by default.
+pub const DEFAULT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Headers passed on to the backend as metadata of the same name.
+const FORWARDED_HEADERS: [&str; 2] = ["authorization", REQUEST_ID_HEADER];
+
+/// Serves the gateway on `listener`, forwarding to the server behind
+/// `backend`, until the task is dropped.
+///
+/// Each backend call fails with `DeadlineExceeded` after `timeout`.
+pub async fn serve(listener: TcpListener, backend: Channel, timeout: Duration) -> Result<()> {
+    let addr = listener
+        .local_addr()
+        .map_or_else(|_| "gateway listener".to_string(), |addr| addr.to_string());
+    let listener = listener.into_std().context(BindSnafu { addr })?;
+
+    let make_service = make_service_fn(move |_| {
+        let client = HelloClient::new(backend.clone());
+        async move {
+            Ok::<_, Infallible>(service_fn(move |request| {
+                let client = client.clone();
+                async move { Ok::<_, Infallible>(handle(request, client, timeout).await) }
+            }))
+        }
+    });
+
+    hyper::Server::from_tcp(listener)
+        .context(GatewaySnafu)?
+        .serve(make_service)
+        .await
+        .context(GatewaySnafu)
+}
+
+async fn handle(
+    request: Request<Body>,
+    mut client: HelloClient<Channel>,
+    timeout: Duration,
+) -> Response<Body> {
+    let Some(name) = request.uri().path().strip_prefix("/v1/hello/") else {
+        return error(Status::not_found("no such route"));
+    };
+    if name.is_empty() || name.contains('/') {
+        return error(Status::not_found("no such route"));
+    }
+    if request.method() != Method::GET {
+        return method_not_allowed();
+    }
+    let Ok(name) = percent_decode_str(name).decode_utf8() else {
+        return error(Status::invalid_argument("name must be valid UTF-8"));
+    };
+
+    let mut call = tonic::Request::new(HelloRequest {
+        name: name.into_owned(),
+    });
+    forward_headers(&request, &mut call);
+    // The deadline tells the backend when to give up, the timeout covers a
+    // backend that doesn't answer at all.
+    call.set_timeout(timeout);
+    let response = tokio::time::timeout(timeout, client.hello(call))
+        .await
+        .unwrap_or_else(|_| Err(Status::deadline_exceeded("backend timed out")));
+    match response {
+        Ok(response) => json(StatusCode::OK, &response.into_inner()),
+        Err(status) => error(status),
+    }
+}
+
+/// Copies the [FORWARDED_HEADERS] of `request` into the metadata of `call`.
+fn forward_headers<T>(request: &Request<Body>, call: &mut tonic::Request<T>) {
+    for name in FORWARDED_HEADERS {
+        let value = request
+            .headers()
+            .get(name)
+            .and_then(|value| AsciiMetadataValue::try_from(value.as_bytes()).ok());
+        if let Some(value) = value {
+            call.metadata_mut().insert(name, value);
+        }
+    }
+}
+
+#[derive(serde::Serialize)]
+struct ErrorBody<'a> {
+    code:    i32,
+    message: &'a str,
+}
+
+fn error(status: Status) -> Response<Body> {
+    json(
+        http_status(status.code()),
+        &ErrorBody {
+            code:    status.code() as i32,
+            message: status.message(),
+        },
+    )
+}
+
+/// Answers a call to a route with a method it doesn't serve.
+fn method_not_allowed() -> Response<Body> {
+    let mut response = error(Status::unimplemented("only GET is supported"));
+    *response.status_mut() = StatusCode::METHOD_NOT_ALLOWED;
+    response
+        .headers_mut()
+        .insert(ALLOW, HeaderValue::from_static("GET"));
+    response
+}
+
+fn json<T: serde::Serialize>(code: StatusCode, value: &T) -> Response<Body> {
+    let (code, body) = match serde_json::to_vec(value) {
+        Ok(body) => (code, body),
+        Err(e) => (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            e.to_string().into_bytes(),
+        ),
+    };
+    let mut response = Response::new(Body::from(body));
+    *response.status_mut() = code;
+    response
+        .headers_mut()
+        .insert(CONTENT_TYPE, HeaderValue::from_static("application/json"));
+    response
+}
+
+/// Maps a gRPC code to its HTTP counterpart, following
+/// `google.rpc.Code`.
+fn http_status(code: Code) -> StatusCode {
+    match code {
+        Code::Ok => StatusCode::OK,
+        Code::Cancelled => StatusCode::from_u16(499).unwrap_or(StatusCode::BAD_REQUEST),
+        Code::InvalidArgument | Code::FailedPrecondition | Code::OutOfRange => {
+            StatusCode::BAD_REQUEST
+        }
+        Code::DeadlineExceeded => StatusCode::GATEWAY_TIMEOUT,
+        Code::NotFound => StatusCode::NOT_FOUND,
+        Code::AlreadyExists | Code::Aborted => StatusCode::CONFLICT,
+        Code::PermissionDenied => StatusCode::FORBIDDEN,
+        Code::Unauthenticated => StatusCode::UNAUTHORIZED,
+        Code::ResourceExhausted => StatusCode::TOO_MANY_REQUESTS,
+        Code::Unimplemented => StatusCode::NOT_IMPLEMENTED,
+        Code::Unavailable => StatusCode::SERVICE_UNAVAILABLE,
+        Code::Unknown | Code::Internal | Code::DataLoss => StatusCode::INTERNAL_SERVER_ERROR,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::{Arc, Mutex};
+
+    use hyper::{body::to_bytes, Client};
+    use tonic::transport::Endpoint;
+    use tower::ServiceExt;
+
+    use super::*;
+    use crate::{
+        in_process::InProcessServer,
+        interceptor::{
+            auth::{AuthLayer, Claims, TokenValidator, ValidationError},
+            GrpcRequest, GrpcResponse, GrpcService, Interceptor,
+        },
+        Server,
+    };
+
+    /// Accepts only `good-token`.
+    struct FakeValidator;
+
+    #[tonic::async_trait]
+    impl TokenValidator for FakeValidator {
+        async fn validate(&self, token: &str) -> std::result::Result<Claims, ValidationError> {
+            if token != "good-token" {
+                return Err("unknown token".into());
+            }
+            Ok(Claims {
+                subject: "alice".to_string(),
+                ..Claims::default()
+            })
+        }
+    }
+
+    /// Serves the gateway on a free local port, returning its base URL.
+    async fn gateway(backend: Channel) -> String {
+        gateway_with_timeout(backend, DEFAULT_TIMEOUT).await
+    }
+
+    async fn gateway_with_timeout(backend: Channel, timeout: Duration) -> String {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(serve(listener, backend, timeout));
+        format!("http://{addr}")
+    }
+
+    async fn send(method: Method, uri: &str) -> (Response<()>, serde_json::Value) {
+        send_with(method, uri, &[]).await
+    }
+
+    async fn send_with(
+        method: Method,
+        uri: &str,
+        headers: &[(&str, &str)],
+    ) -> (Response<()>, serde_json::Value) {
+        let mut request = Request::builder().method(method).uri(uri);
+        for (name, value) in headers {
+            request = request.header(*name, *value);
+        }
+        let request = request.body(Body::empty()).unwrap();
+        let (parts, body) = Client::new().request(request).await.unwrap().into_parts();
+        let body = serde_json::from_slice(&to_bytes(body).await.unwrap()).unwrap();
+        (Response::from_parts(parts, ()), body)
+    }
+
+    #[tokio::test]
+    async fn get_returns_the_greeting() {
+        let server = InProcessServer::start(Server::new(""));
+        let base = gateway(server.channel()).await;
+
+        let (response, body) = send(Method::GET, &format!("{base}/v1/hello/dear%20friend")).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(response.headers()[CONTENT_TYPE], "application/json");
+        assert_eq!(body["message"], "Hello, dear friend");
+    }
+
+    #[tokio::test]
+    async fn other_methods_are_not_allowed() {
+        let server = InProcessServer::start(Server::new(""));
+        let base = gateway(server.channel()).await;
+
+        let (response, _) = send(Method::POST, &format!("{base}/v1/hello/world")).await;
+        assert_eq!(response.status(), StatusCode::METHOD_NOT_ALLOWED);
+        assert_eq!(response.headers()[ALLOW], "GET");
+
+        let (response, _) = send(Method::GET, &format!("{base}/v1/goodbye/world")).await;
+        assert_eq!(response.status(), StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn unreachable_backend_returns_503() {
+        // Nothing listens on the port once the listener is dropped.
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        drop(listener);
+        let backend = Endpoint::from_shared(format!("http://{addr}"))
+            .unwrap()
+            .connect_lazy();
+        let base = gateway(backend).await;
+
+        let (response, body) = send(Method::GET, &format!("{base}/v1/hello/world")).await;
+        assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(body["code"], Code::Unavailable as i32);
+    }
+
+    #[tokio::test]
+    async fn forwards_the_authorization_header() {
+        let server = Server::new("").with_auth(AuthLayer::new(FakeValidator));
+        let server = InProcessServer::start(server);
+        let base = gateway(server.channel()).await;
+        let uri = format!("{base}/v1/hello/world");
+
+        let headers = [("authorization", "Bearer good-token")];
+        let (response, body) = send_with(Method::GET, &uri, &headers).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(body["message"], "Hello, world");
+
+        let (response, body) = send(Method::GET, &uri).await;
+        assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+        assert_eq!(body["code"], Code::Unauthenticated as i32);
+
+        let headers = [("authorization", "Bearer stolen-token")];
+        let (response, _) = send_with(Method::GET, &uri, &headers).await;
+        assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+    }
+
+    #[tokio::test]
+    async fn forwards_the_request_id() {
+        let seen = Arc::new(Mutex::new(None));
+        let record = {
+            let seen = seen.clone();
+            Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+                let seen = seen.clone();
+                tower::service_fn(move |request: GrpcRequest| {
+                    let inner = inner.clone();
+                    *seen.lock().unwrap() = request.headers().get(REQUEST_ID_HEADER).cloned();
+                    async move { inner.oneshot(request).await }
+                })
+            }))
+        };
+        let server = InProcessServer::start(Server::new("").with_interceptors([record]));
+        let base = gateway(server.channel()).await;
+
+        let headers = [(REQUEST_ID_HEADER, "call-42")];
+        let (response, _) =
+            send_with(Method::GET, &format!("{base}/v1/hello/world"), &headers).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        let seen = seen.lock().unwrap().clone();
+        assert_eq!(
+            seen.as_ref().and_then(|id| id.to_str().ok()),
+            Some("call-42")
+        );
+    }
+
+    #[tokio::test]
+    async fn hung_backend_times_out_with_504() {
+        let hang = Interceptor::new(tower::layer::layer_fn(|_: GrpcService| {
+            tower::service_fn(|_: GrpcRequest| {
+                std::future::pending::<std::result::Result<GrpcResponse, Infallible>>()
+            })
+        }));
+        let server = InProcessServer::start(Server::new("").with_interceptors([hang]));
+        let timeout = Duration::from_millis(100);
+        let base = gateway_with_timeout(server.channel(), timeout).await;
+
+        let started = tokio::time::Instant::now();
+        let (response, body) = send(Method::GET, &format!("{base}/v1/hello/world")).await;
+        assert_eq!(response.status(), StatusCode::GATEWAY_TIMEOUT);
+        assert_eq!(body["code"], Code::DeadlineExceeded as i32);
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use tonic_health::{server::HealthReporter, ServingStatus};
+
+/// Updates the statuses reported by a [Server](crate::Server)'s
+/// `grpc.health.v1.Health` service.
+///
+/// Handles are cheap to clone and stay valid while the server runs.
+#[derive(Debug, Clone)]
+pub struct HealthHandle {
+    reporter: HealthReporter,
+}
+
+impl HealthHandle {
+    pub(crate) fn new(reporter: HealthReporter) -> Self { Self { reporter } }
+
+    /// Reports `service` as `SERVING` or `NOT_SERVING`, an empty `service`
+    /// names the server as a whole.
+    pub async fn set_serving_status(&self, service: &str, serving: bool) {
+        let status = if serving {
+            ServingStatus::Serving
+        } else {
+            ServingStatus::NotServing
+        };
+        self.reporter
+            .clone()
+            .set_service_status(service, status)
+            .await;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use tonic::Streaming;
+    use tonic_health::pb::{
+        health_check_response::ServingStatus, health_client::HealthClient, HealthCheckRequest,
+        HealthCheckResponse,
+    };
+
+    use crate::{in_process::InProcessServer, Server};
+
+    const HELLO: &str = "rsketch.v1.hello.Hello";
+
+    fn request(service: &str) -> HealthCheckRequest {
+        HealthCheckRequest {
+            service: service.to_string(),
+        }
+    }
+
+    async fn next(watch: &mut Streaming<HealthCheckResponse>) -> ServingStatus {
+        watch.message().await.unwrap().unwrap().status()
+    }
+
+    #[tokio::test]
+    async fn check_and_watch_follow_status() {
+        let server = Server::new("");
+        let health = server.health();
+        let server = InProcessServer::start(server);
+        let mut client = HealthClient::new(server.channel());
+
+        let response = client.check(request(HELLO)).await.unwrap().into_inner();
+        assert_eq!(response.status(), ServingStatus::Serving);
+
+        let mut watch = client.watch(request(HELLO)).await.unwrap().into_inner();
+        assert_eq!(next(&mut watch).await, ServingStatus::Serving);
+        health.set_serving_status(HELLO, false).await;
+        assert_eq!(next(&mut watch).await, ServingStatus::NotServing);
+        health.set_serving_status(HELLO, true).await;
+        assert_eq!(next(&mut watch).await, ServingStatus::Serving);
+        let response = client.check(request(HELLO)).await.unwrap().into_inner();
+        assert_eq!(response.status(), ServingStatus::Serving);
+    }
+
+    #[tokio::test]
+    async fn shutdown_reports_not_serving_before_draining() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HealthClient::new(server.channel());
+        let mut watch = client.watch(request(HELLO)).await.unwrap().into_inner();
+        assert_eq!(next(&mut watch).await, ServingStatus::Serving);
+
+        // The open watch keeps the server draining until it is dropped.
+        let shutdown = tokio::spawn(server.shutdown());
+        assert_eq!(next(&mut watch).await, ServingStatus::NotServing);
+        drop(watch);
+        shutdown.await.unwrap().unwrap();
+    }
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Runs a [Server] over in-memory pipes instead of TCP, so tests and embedders
+//! get the full server, interceptors included, without binding a port.
+//!
+//! The server runs exactly as configured, it gets no interceptors beyond the
+//! ones on by default. Build it with
+//! [Server::with_default_interceptors] to serve with the interceptors the
+//! `rsketch` binary installs.
+//!
+//! ```ignore
+//! let server = InProcessServer::start(Server::new("in-process").with_default_interceptors());
+//! let mut client = HelloClient::new(server.channel());
+//! client.hello(HelloRequest::default()).await?;
+//! server.shutdown().await?;
+//! ```
+
+use std::io;
+
+use http::Uri;
+use snafu::ResultExt;
+use tokio::{
+    io::DuplexStream,
+    sync::{mpsc, oneshot},
+    task::JoinHandle,
+};
+use tokio_stream::{wrappers::UnboundedReceiverStream, StreamExt};
+use tonic::transport::{Channel, Endpoint};
+use tower::service_fn;
+
+use crate::{
+    error::{Result, ServerTaskSnafu},
+    Server,
+};
+
+/// How many bytes a connection buffers in each direction.
+const PIPE_CAPACITY: usize = 1 << 20;
+
+/// Hands out in-memory connections to an [InProcessServer].
+#[derive(Debug, Clone)]
+pub struct InProcessConnector {
+    connections: mpsc::UnboundedSender<DuplexStream>,
+}
+
+impl InProcessConnector {
+    /// Opens a new connection, failing once the server has stopped.
+    pub fn connect(&self) -> io::Result<DuplexStream> {
+        let (client, server) = tokio::io::duplex(PIPE_CAPACITY);
+        self.connections
+            .send(server)
+            .map_err(|_| io::Error::new(io::ErrorKind::ConnectionRefused, "server stopped"))?;
+        Ok(client)
+    }
+
+    /// Creates a channel whose connections go through this connector.
+    pub fn channel(&self) -> Channel {
+        let connector = self.clone();
+        // The URI is required by the endpoint but never resolved.
+        Endpoint::from_static("http://in-process").connect_with_connector_lazy(service_fn(
+            move |_: Uri| {
+                let connection = connector.connect();
+                async move { connection }
+            },
+        ))
+    }
+}
+
+/// A [Server] running in the background over in-memory connections.
+#[derive(Debug)]
+pub struct InProcessServer {
+    connector: InProcessConnector,
+    shutdown:  oneshot::Sender<()>,
+    serving:   JoinHandle<Result<()>>,
+}
+
+impl InProcessServer {
+    /// Starts `server`, its address is ignored. Must be called from within a
+    /// Tokio runtime.
+    ///
+    /// The server runs through [Server::run_with_incoming], the same path as
+    /// [Server::run], so calls go through the exact interceptor chain
+    /// configured on `server` and only the transport differs. Nothing is
+    /// added to that chain, see [Server::with_default_interceptors].
+    pub fn start(server: Server) -> Self {
+        let (connections, incoming) = mpsc::unbounded_channel();
+        let (shutdown, shutdown_rx) = oneshot::channel::<()>();
+        let incoming = UnboundedReceiverStream::new(incoming).map(Ok::<_, io::Error>);
+        let serving = tokio::spawn(server.run_with_incoming(incoming, async {
+            let _ = shutdown_rx.await;
+        }));
+
+        Self {
+            connector: InProcessConnector { connections },
+            shutdown,
+            serving,
+        }
+    }
+
+    pub fn connector(&self) -> InProcessConnector { self.connector.clone() }
+
+    /// Creates a channel to the server, see [InProcessConnector::channel].
+    pub fn channel(&self) -> Channel { self.connector.channel() }
+
+    /// Gracefully shuts the server down and waits for it to stop.
+    pub async fn shutdown(self) -> Result<()> {
+        let _ = self.shutdown.send(());
+        self.serving.await.context(ServerTaskSnafu)?
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use rsketch_common::propagation::REQUEST_ID_HEADER;
+    use tonic::Code;
+
+    use super::*;
+
+    #[tokio::test]
+    async fn serves_hello_without_a_port() {
+        let server = InProcessServer::start(Server::new("in-process"));
+        let mut client = HelloClient::new(server.channel());
+
+        let request = HelloRequest {
+            name: "in-process".to_string(),
+        };
+        let response = client.hello(request).await.unwrap();
+        assert_eq!(response.into_inner().message, "Hello, in-process");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn calls_go_through_the_configured_interceptors() {
+        let server = Server::new("")
+            .with_request_id(true)
+            .with_require_deadline(true);
+        let server = InProcessServer::start(server);
+        let mut client = HelloClient::new(server.channel());
+
+        let status = client.hello(HelloRequest::default()).await.unwrap_err();
+        assert_eq!(status.code(), Code::InvalidArgument);
+
+        let mut request = tonic::Request::new(HelloRequest::default());
+        request.set_timeout(std::time::Duration::from_secs(5));
+        let response = client.hello(request).await.unwrap();
+        assert!(response.metadata().contains_key(REQUEST_ID_HEADER));
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn default_interceptors_match_the_binary() {
+        let server = InProcessServer::start(Server::new("").with_default_interceptors());
+        let mut client = HelloClient::new(server.channel());
+
+        let response = client.hello(HelloRequest::default()).await.unwrap();
+        assert!(response.metadata().contains_key(REQUEST_ID_HEADER));
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn connect_fails_once_stopped() {
+        let server = InProcessServer::start(Server::new(""));
+        let connector = server.connector();
+        server.shutdown().await.unwrap();
+
+        let err = connector.connect().unwrap_err();
+        assert_eq!(err.kind(), io::ErrorKind::ConnectionRefused);
+    }
+}
@@ -0,0 +1,242 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Bearer token authentication, rejecting calls without a valid
+//! `authorization: Bearer <token>` entry with `Unauthenticated`.
+
+use std::{
+    collections::{HashMap, HashSet},
+    fmt,
+    sync::Arc,
+    task::{Context, Poll},
+};
+
+use http::header::AUTHORIZATION;
+use tonic::{body::BoxBody, Status};
+use tower::{Layer, Service};
+
+use super::{identity::Identity, BoxFuture};
+
+/// What a validated token says about the caller.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Claims {
+    pub subject: String,
+    pub issuer:  String,
+    pub extra:   HashMap<String, String>,
+}
+
+pub type ValidationError = Box<dyn std::error::Error + Send + Sync>;
+
+/// Checks bearer tokens, e.g. by verifying a JWT signature or asking an
+/// identity provider.
+#[tonic::async_trait]
+pub trait TokenValidator: Send + Sync + 'static {
+    async fn validate(&self, token: &str) -> Result<Claims, ValidationError>;
+}
+
+/// Returns the claims the auth interceptor attached to `request`, if the call
+/// was authenticated.
+pub fn claims_from_request<T>(request: &tonic::Request<T>) -> Option<&Claims> {
+    request.extensions().get::<Claims>()
+}
+
+/// Authenticates every call with a [TokenValidator], attaching the claims to
+/// the request for [claims_from_request] along with the caller's
+/// [Identity].
+#[derive(Clone)]
+pub struct AuthLayer {
+    validator: Arc<dyn TokenValidator>,
+    exempt:    Arc<HashSet<String>>,
+}
+
+impl fmt::Debug for AuthLayer {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("AuthLayer")
+            .field("exempt", &self.exempt)
+            .finish_non_exhaustive()
+    }
+}
+
+impl AuthLayer {
+    pub fn new(validator: impl TokenValidator) -> Self {
+        Self {
+            validator: Arc::new(validator),
+            exempt:    Arc::default(),
+        }
+    }
+
+    /// Lets calls to `method`, a full method like
+    /// `/grpc.health.v1.Health/Check`, through without a token.
+    pub fn with_exempt(self, method: impl Into<String>) -> Self {
+        let mut exempt = HashSet::clone(&self.exempt);
+        exempt.insert(method.into());
+        Self {
+            exempt: Arc::new(exempt),
+            ..self
+        }
+    }
+}
+
+impl<S> Layer<S> for AuthLayer {
+    type Service = AuthService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        AuthService {
+            inner,
+            auth: self.clone(),
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct AuthService<S> {
+    inner: S,
+    auth:  AuthLayer,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for AuthService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        if self.auth.exempt.contains(request.uri().path()) {
+            return Box::pin(inner.call(request));
+        }
+        let validator = self.auth.validator.clone();
+
+        Box::pin(async move {
+            let Some(token) = bearer_token(&request) else {
+                return Ok(Status::unauthenticated("missing bearer token").to_http());
+            };
+            match validator.validate(&token).await {
+                Ok(claims) => {
+                    request
+                        .extensions_mut()
+                        .insert(Identity::from_claims(&claims));
+                    request.extensions_mut().insert(claims);
+                    inner.call(request).await
+                }
+                Err(_) => Ok(Status::unauthenticated("invalid bearer token").to_http()),
+            }
+        })
+    }
+}
+
+fn bearer_token<B>(request: &http::Request<B>) -> Option<String> {
+    let value = request.headers().get(AUTHORIZATION)?.to_str().ok()?;
+    let (scheme, token) = value.split_once(' ')?;
+    let token = token.trim();
+    (scheme.eq_ignore_ascii_case("bearer") && !token.is_empty()).then(|| token.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, PingRequest};
+    use tonic::{Code, Request};
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    const PING: &str = "/rsketch.v1.hello.Hello/Ping";
+
+    /// Accepts only `good-token`, issued to alice.
+    struct FakeValidator;
+
+    #[tonic::async_trait]
+    impl TokenValidator for FakeValidator {
+        async fn validate(&self, token: &str) -> Result<Claims, ValidationError> {
+            if token != "good-token" {
+                return Err("unknown token".into());
+            }
+            Ok(Claims {
+                subject: "alice".to_string(),
+                ..Claims::default()
+            })
+        }
+    }
+
+    fn with_authorization<T>(message: T, value: &str) -> Request<T> {
+        let mut request = Request::new(message);
+        request
+            .metadata_mut()
+            .insert("authorization", value.parse().unwrap());
+        request
+    }
+
+    fn server() -> InProcessServer {
+        let auth = AuthLayer::new(FakeValidator).with_exempt(PING);
+        InProcessServer::start(Server::new("").with_auth(auth))
+    }
+
+    #[tokio::test]
+    async fn accepts_valid_tokens() {
+        let server = server();
+        let mut client = HelloClient::new(server.channel());
+
+        let request = with_authorization(HelloRequest::default(), "Bearer good-token");
+        let reply = client.hello(request).await.unwrap().into_inner();
+        assert_eq!(reply.message, "Hello, alice");
+        // The scheme is case insensitive.
+        let request = with_authorization(HelloRequest::default(), "bearer good-token");
+        client.hello(request).await.unwrap();
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn rejects_missing_and_invalid_tokens() {
+        let server = server();
+        let mut client = HelloClient::new(server.channel());
+
+        let status = client.hello(HelloRequest::default()).await.unwrap_err();
+        assert_eq!(status.code(), Code::Unauthenticated);
+        assert_eq!(status.message(), "missing bearer token");
+
+        for value in ["Basic good-token", "Bearer "] {
+            let request = with_authorization(HelloRequest::default(), value);
+            let status = client.hello(request).await.unwrap_err();
+            assert_eq!(status.code(), Code::Unauthenticated, "{value}");
+            assert_eq!(status.message(), "missing bearer token", "{value}");
+        }
+
+        let request = with_authorization(HelloRequest::default(), "Bearer stolen-token");
+        let status = client.hello(request).await.unwrap_err();
+        assert_eq!(status.code(), Code::Unauthenticated);
+        assert_eq!(status.message(), "invalid bearer token");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn lets_exempt_methods_through_without_a_token() {
+        let server = server();
+        let mut client = HelloClient::new(server.channel());
+
+        client.ping(PingRequest::default()).await.unwrap();
+        // Exempt methods don't even look at the token.
+        let request = with_authorization(PingRequest::default(), "Bearer stolen-token");
+        client.ping(request).await.unwrap();
+        server.shutdown().await.unwrap();
+    }
+}
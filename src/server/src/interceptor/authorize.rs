@@ -0,0 +1,217 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Per-method authorization, rejecting calls the configured [Authorizer]
+//! disallows with `PermissionDenied`.
+//!
+//! Runs after [auth](super::auth), so the authorizer sees the caller's
+//! [Claims].
+
+use std::{
+    fmt,
+    sync::Arc,
+    task::{Context, Poll},
+};
+
+use tonic::{body::BoxBody, Status};
+use tower::{Layer, Service};
+
+use super::{auth::Claims, BoxFuture};
+
+pub type AuthorizationError = Box<dyn std::error::Error + Send + Sync>;
+
+/// Decides whether a caller may invoke a method.
+#[tonic::async_trait]
+pub trait Authorizer: Send + Sync + 'static {
+    /// Checks a call to `method`, a full method like
+    /// `/hello.v1.Hello/Hello`. `claims` is `None` for calls that were not
+    /// authenticated, e.g. ones to methods exempt from auth.
+    ///
+    /// The error message is returned to the caller.
+    async fn authorize(
+        &self,
+        method: &str,
+        claims: Option<&Claims>,
+    ) -> Result<(), AuthorizationError>;
+}
+
+/// Allows every call, the behavior of a server without an authorizer.
+#[derive(Debug, Clone, Copy, Default)]
+pub struct AllowAll;
+
+#[tonic::async_trait]
+impl Authorizer for AllowAll {
+    async fn authorize(&self, _: &str, _: Option<&Claims>) -> Result<(), AuthorizationError> {
+        Ok(())
+    }
+}
+
+/// Authorizes every call with an [Authorizer].
+#[derive(Clone)]
+pub struct AuthorizeLayer {
+    authorizer: Arc<dyn Authorizer>,
+}
+
+impl fmt::Debug for AuthorizeLayer {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("AuthorizeLayer").finish_non_exhaustive()
+    }
+}
+
+impl Default for AuthorizeLayer {
+    fn default() -> Self { Self::new(AllowAll) }
+}
+
+impl AuthorizeLayer {
+    pub fn new(authorizer: impl Authorizer) -> Self {
+        Self {
+            authorizer: Arc::new(authorizer),
+        }
+    }
+}
+
+impl<S> Layer<S> for AuthorizeLayer {
+    type Service = AuthorizeService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        AuthorizeService {
+            inner,
+            authorizer: self.authorizer.clone(),
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct AuthorizeService<S> {
+    inner:      S,
+    authorizer: Arc<dyn Authorizer>,
+}
+
+impl<S: fmt::Debug> fmt::Debug for AuthorizeService<S> {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("AuthorizeService")
+            .field("inner", &self.inner)
+            .finish_non_exhaustive()
+    }
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for AuthorizeService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        let authorizer = self.authorizer.clone();
+        // Owned, so the future doesn't borrow the request across the await.
+        let method = request.uri().path().to_string();
+        let claims = request.extensions().get::<Claims>().cloned();
+
+        Box::pin(async move {
+            if let Err(err) = authorizer.authorize(&method, claims.as_ref()).await {
+                return Ok(Status::permission_denied(err.to_string()).to_http());
+            }
+            inner.call(request).await
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, PingRequest};
+    use tonic::{Code, Request};
+
+    use super::*;
+    use crate::{
+        in_process::InProcessServer,
+        interceptor::auth::{AuthLayer, TokenValidator, ValidationError},
+        Server,
+    };
+
+    const HELLO: &str = "/rsketch.v1.hello.Hello/Hello";
+
+    /// Accepts every token, naming the caller after it.
+    struct TokenIsSubject;
+
+    #[tonic::async_trait]
+    impl TokenValidator for TokenIsSubject {
+        async fn validate(&self, token: &str) -> Result<Claims, ValidationError> {
+            Ok(Claims {
+                subject: token.to_string(),
+                ..Claims::default()
+            })
+        }
+    }
+
+    /// Keeps mallory from calling Hello.
+    struct DenyMallory;
+
+    #[tonic::async_trait]
+    impl Authorizer for DenyMallory {
+        async fn authorize(
+            &self,
+            method: &str,
+            claims: Option<&Claims>,
+        ) -> Result<(), AuthorizationError> {
+            match claims {
+                Some(claims) if claims.subject == "mallory" && method == HELLO => {
+                    Err("mallory may not say hello".into())
+                }
+                _ => Ok(()),
+            }
+        }
+    }
+
+    fn as_caller<T>(message: T, subject: &str) -> Request<T> {
+        let mut request = Request::new(message);
+        let token = format!("Bearer {subject}").parse().unwrap();
+        request.metadata_mut().insert("authorization", token);
+        request
+    }
+
+    #[tokio::test]
+    async fn denies_only_what_the_authorizer_disallows() {
+        let server = InProcessServer::start(
+            Server::new("")
+                .with_auth(AuthLayer::new(TokenIsSubject))
+                .with_authorizer(DenyMallory),
+        );
+        let mut client = HelloClient::new(server.channel());
+
+        let request = as_caller(HelloRequest::default(), "alice");
+        assert_eq!(
+            client.hello(request).await.unwrap().into_inner().message,
+            "Hello, alice"
+        );
+
+        let request = as_caller(HelloRequest::default(), "mallory");
+        let status = client.hello(request).await.unwrap_err();
+        assert_eq!(status.code(), Code::PermissionDenied);
+        assert_eq!(status.message(), "mallory may not say hello");
+
+        let request = as_caller(PingRequest::default(), "mallory");
+        client.ping(request).await.unwrap();
+        server.shutdown().await.unwrap();
+    }
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Tells when a call really ends and with which status.
+//!
+//! A unary call is over with its response, but a streaming one only once
+//! its body has been sent, and a stream failing after its first message
+//! carries its status in the trailers rather than the response headers.
+
+use std::{
+    pin::Pin,
+    task::{Context, Poll},
+};
+
+use http::HeaderMap;
+use hyper::body::{Bytes, HttpBody, SizeHint};
+use tonic::{body::BoxBody, Code, Status};
+
+use super::{response_status, GrpcResponse};
+
+type OnEnd = Box<dyn FnOnce(&Status) + Send>;
+
+/// Calls `on_end` with the final status of the call `response` answers,
+/// once the call ends.
+///
+/// A response carrying its status in the headers ends the call right away,
+/// any other once the status is read from its trailers. A body dropped
+/// before, e.g. because the client went away, ends the call with
+/// `Cancelled`.
+pub(super) fn on_end(
+    response: GrpcResponse,
+    on_end: impl FnOnce(&Status) + Send + 'static,
+) -> GrpcResponse {
+    if let Some(status) = response_status(&response) {
+        on_end(&status);
+        return response;
+    }
+    response.map(|inner| {
+        tonic::body::boxed(CompletionBody {
+            inner,
+            on_end: Some(Box::new(on_end)),
+        })
+    })
+}
+
+/// A response body calling its `on_end` once it is done.
+struct CompletionBody {
+    inner:  BoxBody,
+    on_end: Option<OnEnd>,
+}
+
+impl CompletionBody {
+    fn end(&mut self, status: &Status) {
+        if let Some(on_end) = self.on_end.take() {
+            on_end(status);
+        }
+    }
+}
+
+impl HttpBody for CompletionBody {
+    type Data = Bytes;
+    type Error = Status;
+
+    fn poll_data(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Self::Data, Self::Error>>> {
+        let poll = Pin::new(&mut self.inner).poll_data(cx);
+        if let Poll::Ready(Some(Err(status))) = &poll {
+            self.end(status);
+        }
+        poll
+    }
+
+    fn poll_trailers(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Option<HeaderMap>, Self::Error>> {
+        let poll = Pin::new(&mut self.inner).poll_trailers(cx);
+        match &poll {
+            Poll::Ready(Ok(trailers)) => {
+                let status = trailers
+                    .as_ref()
+                    .and_then(Status::from_header_map)
+                    .unwrap_or_else(|| Status::unknown("call ended without a status"));
+                self.end(&status);
+            }
+            Poll::Ready(Err(status)) => self.end(status),
+            Poll::Pending => {}
+        }
+        poll
+    }
+
+    fn is_end_stream(&self) -> bool { self.inner.is_end_stream() }
+
+    fn size_hint(&self) -> SizeHint { self.inner.size_hint() }
+}
+
+impl Drop for CompletionBody {
+    fn drop(&mut self) { self.end(&Status::new(Code::Cancelled, "call cancelled")) }
+}
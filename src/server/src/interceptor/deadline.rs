@@ -0,0 +1,560 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Enforcement of the deadlines callers send in the `grpc-timeout` header.
+//!
+//! Unary calls still running when their deadline passes are dropped and
+//! answered with `DeadlineExceeded`. Streaming handlers outlive the call
+//! future, so they read the [Deadline] from the request extensions and stop
+//! producing messages themselves.
+//!
+//! Every method not known to stream counts as unary, including those of
+//! services mounted next to the rsketch ones. The streaming methods are read
+//! from the rsketch descriptors, the health and reflection ones are known and
+//! others are added with [DeadlineLayer::with_streaming_method].
+//!
+//! A server-wide handler timeout can additionally bound unary calls, whether
+//! or not the caller set a deadline, and calls without one can get a default
+//! deadline per method.
+
+use std::{
+    collections::{HashMap, HashSet},
+    sync::Arc,
+    task::{Context, Poll},
+    time::Duration,
+};
+
+use tokio::time::Instant;
+use tonic::{body::BoxBody, Status};
+use tower::{Layer, Service};
+use tracing::warn;
+
+use super::{rsketch_methods, streaming_methods, BoxFuture};
+
+const GRPC_TIMEOUT_HEADER: &str = "grpc-timeout";
+
+/// Streaming methods of the services mounted alongside the rsketch ones.
+const KNOWN_STREAMING_METHODS: [&str; 3] = [
+    "/grpc.health.v1.Health/Watch",
+    "/grpc.reflection.v1alpha.ServerReflection/ServerReflectionInfo",
+    "/grpc.reflection.v1.ServerReflection/ServerReflectionInfo",
+];
+
+/// The instant by which the caller expects a response, available to
+/// handlers through [Deadline::from_request].
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub struct Deadline(Instant);
+
+impl Deadline {
+    /// Returns the deadline of `request`, if the caller set one.
+    pub fn from_request<T>(request: &tonic::Request<T>) -> Option<Self> {
+        request.extensions().get::<Self>().copied()
+    }
+
+    pub fn instant(&self) -> Instant { self.0 }
+
+    /// Returns the time left, zero once the deadline has passed.
+    pub fn remaining(&self) -> Duration { self.0.saturating_duration_since(Instant::now()) }
+
+    pub fn is_expired(&self) -> bool { Instant::now() >= self.0 }
+}
+
+/// Enforces caller deadlines, and optionally requires unary calls to set
+/// one or bounds them by a handler timeout.
+#[derive(Debug, Clone)]
+pub struct DeadlineLayer {
+    require_deadline: bool,
+    handler_timeout:  Option<Duration>,
+    method_defaults:  Arc<HashMap<String, Duration>>,
+    global_default:   Option<Duration>,
+    streaming:        Arc<HashSet<String>>,
+}
+
+impl Default for DeadlineLayer {
+    fn default() -> Self { Self::new() }
+}
+
+impl DeadlineLayer {
+    pub fn new() -> Self {
+        let mut streaming = streaming_methods();
+        streaming.extend(KNOWN_STREAMING_METHODS.map(String::from));
+        Self {
+            require_deadline: false,
+            handler_timeout:  None,
+            method_defaults:  Arc::default(),
+            global_default:   None,
+            streaming:        Arc::new(streaming),
+        }
+    }
+
+    /// Rejects unary calls without a deadline with `InvalidArgument` instead
+    /// of only logging a warning.
+    ///
+    /// Streaming calls aren't checked, they are often meant to stay open
+    /// indefinitely.
+    pub fn with_require_deadline(self, require_deadline: bool) -> Self {
+        Self {
+            require_deadline,
+            ..self
+        }
+    }
+
+    /// Bounds the execution of unary calls to `timeout`, or to the caller's
+    /// deadline if that is sooner, answering with `DeadlineExceeded` once it
+    /// passes.
+    ///
+    /// Streaming calls are exempt since they are often long-lived, their
+    /// handlers only see the caller's deadline.
+    pub fn with_handler_timeout(self, timeout: Duration) -> Self {
+        Self {
+            handler_timeout: Some(timeout),
+            ..self
+        }
+    }
+
+    /// Gives calls to `method`, a full method like
+    /// `/rsketch.v1.hello.Hello/HelloStream`, a deadline of `timeout` when
+    /// the caller sets none. Applies to streaming methods too, whose
+    /// handlers see the deadline like one the caller set.
+    ///
+    /// Unknown methods make the server fail to start, see
+    /// [DeadlineLayer::check_methods].
+    pub fn with_method_default(self, method: impl Into<String>, timeout: Duration) -> Self {
+        let mut method_defaults = HashMap::clone(&self.method_defaults);
+        method_defaults.insert(method.into(), timeout);
+        Self {
+            method_defaults: Arc::new(method_defaults),
+            ..self
+        }
+    }
+
+    /// Treats `method`, a full method like `/foo.v1.Foo/Watch`, as
+    /// streaming, exempting it from the handler timeout and the required
+    /// deadline. Meant for the streaming methods of services mounted with
+    /// [Server::with_service](crate::Server::with_service), which would
+    /// count as unary otherwise.
+    pub fn with_streaming_method(self, method: impl Into<String>) -> Self {
+        let mut streaming = HashSet::clone(&self.streaming);
+        streaming.insert(method.into());
+        Self {
+            streaming: Arc::new(streaming),
+            ..self
+        }
+    }
+
+    /// Gives unary calls to methods without a default of their own a
+    /// deadline of `timeout` when the caller sets none.
+    pub fn with_global_default(self, timeout: Duration) -> Self {
+        Self {
+            global_default: Some(timeout),
+            ..self
+        }
+    }
+
+    /// Fails with the first method given a default that isn't served: one
+    /// that is neither a method of the rsketch services, nor one of
+    /// `methods`, nor of the services in `services`, whose methods can't be
+    /// listed.
+    pub fn check_methods(&self, services: &[&str], methods: &[&str]) -> Result<(), String> {
+        let known = rsketch_methods(|_| true);
+        let is_known = |method: &str| {
+            known.contains(method)
+                || methods.contains(&method)
+                || method
+                    .strip_prefix('/')
+                    .and_then(|method| method.split_once('/'))
+                    .is_some_and(|(service, name)| !name.is_empty() && services.contains(&service))
+        };
+        match self.method_defaults.keys().find(|method| !is_known(method)) {
+            Some(method) => Err(method.clone()),
+            None => Ok(()),
+        }
+    }
+
+    /// Returns the default timeout of calls to `method`.
+    fn default_timeout(&self, method: &str, unary: bool) -> Option<Duration> {
+        match self.method_defaults.get(method) {
+            Some(timeout) => Some(*timeout),
+            None if unary => self.global_default,
+            None => None,
+        }
+    }
+}
+
+impl<S> Layer<S> for DeadlineLayer {
+    type Service = DeadlineService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        DeadlineService {
+            inner,
+            layer: self.clone(),
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct DeadlineService<S> {
+    inner: S,
+    layer: DeadlineLayer,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for DeadlineService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: http::Request<ReqBody>) -> Self::Future {
+        let method = request.uri().path();
+        let unary = !self.layer.streaming.contains(method);
+        let deadline = request
+            .headers()
+            .get(GRPC_TIMEOUT_HEADER)
+            .and_then(|value| value.to_str().ok())
+            .and_then(parse_timeout)
+            .map(|timeout| Deadline(Instant::now() + timeout));
+
+        if unary && deadline.is_none() && self.layer.require_deadline {
+            let status = Status::invalid_argument("a deadline is required");
+            return Box::pin(async move { Ok(status.to_http()) });
+        }
+        let deadline = deadline.or_else(|| {
+            let timeout = self.layer.default_timeout(method, unary)?;
+            Some(Deadline(Instant::now() + timeout))
+        });
+        if unary && deadline.is_none() {
+            warn!(grpc.method = method, "request has no deadline");
+        }
+        let deadline = match self.layer.handler_timeout {
+            Some(timeout) if unary => {
+                let max = Deadline(Instant::now() + timeout);
+                Some(deadline.map_or(max, |deadline| deadline.min(max)))
+            }
+            _ => deadline,
+        };
+
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        match deadline {
+            // Streaming handlers get the deadline but enforce it themselves,
+            // the call future only covers producing the response headers.
+            Some(deadline) if unary => {
+                request.extensions_mut().insert(deadline);
+                let call = inner.call(request);
+                Box::pin(async move {
+                    match tokio::time::timeout_at(deadline.instant(), call).await {
+                        Ok(result) => result,
+                        Err(_) => Ok(Status::deadline_exceeded("deadline exceeded").to_http()),
+                    }
+                })
+            }
+            Some(deadline) => {
+                request.extensions_mut().insert(deadline);
+                Box::pin(inner.call(request))
+            }
+            None => Box::pin(inner.call(request)),
+        }
+    }
+}
+
+/// Parses a `grpc-timeout` value, up to 8 digits followed by a unit.
+fn parse_timeout(value: &str) -> Option<Duration> {
+    if !value.is_ascii() {
+        return None;
+    }
+    let (digits, unit) = value.split_at(value.len().checked_sub(1)?);
+    if digits.is_empty() || digits.len() > 8 {
+        return None;
+    }
+    let amount: u64 = digits.parse().ok()?;
+    let timeout = match unit {
+        "H" => Duration::from_secs(amount * 60 * 60),
+        "M" => Duration::from_secs(amount * 60),
+        "S" => Duration::from_secs(amount),
+        "m" => Duration::from_millis(amount),
+        "u" => Duration::from_micros(amount),
+        "n" => Duration::from_nanos(amount),
+        _ => return None,
+    };
+    Some(timeout)
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{convert::Infallible, sync::Mutex};
+
+    use api::pb::v1::hello::{
+        hello_client::HelloClient, HelloRequest, HelloStreamRequest, PingRequest,
+    };
+    use http::{uri::PathAndQuery, Uri};
+    use hyper::client::conn::{self, SendRequest};
+    use tonic::{codec::ProstCodec, server::NamedService, transport::Body, Code, Request};
+    use tonic_health::pb::{health_client::HealthClient, HealthCheckRequest};
+    use tower::{util::MapRequest, ServiceExt};
+
+    use super::*;
+    use crate::{
+        error::Error,
+        in_process::InProcessServer,
+        interceptor::{GrpcRequest, GrpcService, Interceptor},
+        Server,
+    };
+
+    const HELLO: &str = "/rsketch.v1.hello.Hello/Hello";
+    const HELLO_STREAM: &str = "/rsketch.v1.hello.Hello/HelloStream";
+    const PING: &str = "/rsketch.v1.hello.Hello/Ping";
+    const HEALTH_CHECK: &str = "/grpc.health.v1.Health/Check";
+
+    type Seen = Arc<Mutex<HashMap<String, Option<Duration>>>>;
+
+    type ClientRequest = http::Request<BoxBody>;
+    type RawClient =
+        HelloClient<MapRequest<SendRequest<BoxBody>, fn(ClientRequest) -> ClientRequest>>;
+
+    /// Takes a second to pass each call on, standing in for a slow handler.
+    fn slow() -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(|inner: GrpcService| {
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                async move {
+                    tokio::time::sleep(Duration::from_secs(1)).await;
+                    inner.oneshot(request).await
+                }
+            })
+        }))
+    }
+
+    /// Records the time each call has left once past the deadline layer, by
+    /// method.
+    fn record_deadlines(seen: Seen) -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+            let seen = seen.clone();
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                let left = request
+                    .extensions()
+                    .get::<Deadline>()
+                    .map(Deadline::remaining);
+                let method = request.uri().path().to_string();
+                seen.lock().unwrap().insert(method, left);
+                async move { inner.oneshot(request).await }
+            })
+        }))
+    }
+
+    /// A mounted service taking a second to answer every call with
+    /// `Unimplemented`.
+    #[derive(Clone)]
+    struct SlowService;
+
+    impl NamedService for SlowService {
+        const NAME: &'static str = "rsketch.test.Slow";
+    }
+
+    impl Service<http::Request<Body>> for SlowService {
+        type Error = Infallible;
+        type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+        type Response = http::Response<BoxBody>;
+
+        fn poll_ready(&mut self, _: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+            Poll::Ready(Ok(()))
+        }
+
+        fn call(&mut self, _: http::Request<Body>) -> Self::Future {
+            Box::pin(async {
+                tokio::time::sleep(Duration::from_secs(1)).await;
+                Ok(Status::unimplemented("slow").to_http())
+            })
+        }
+    }
+
+    const SLOW_CALL: &str = "/rsketch.test.Slow/Call";
+
+    /// Calls [SlowService] through `server`, without a deadline.
+    async fn call_slow(server: &InProcessServer) -> Status {
+        let mut grpc = tonic::client::Grpc::new(server.channel());
+        grpc.ready().await.unwrap();
+        let path = PathAndQuery::from_static(SLOW_CALL);
+        grpc.unary(Request::new(()), path, ProstCodec::<(), ()>::default())
+            .await
+            .unwrap_err()
+    }
+
+    /// Connects a client that leaves deadlines to the server, unlike a tonic
+    /// channel, which enforces them on its own too.
+    async fn raw_client(server: &InProcessServer) -> RawClient {
+        let io = server.connector().connect().unwrap();
+        let (sender, connection) = conn::Builder::new()
+            .http2_only(true)
+            .handshake(io)
+            .await
+            .unwrap();
+        tokio::spawn(connection);
+        // tonic leaves adding the origin to the transport.
+        let with_origin: fn(ClientRequest) -> ClientRequest = |mut request| {
+            let path = request.uri().path().to_string();
+            *request.uri_mut() = Uri::builder()
+                .scheme("http")
+                .authority("in-process")
+                .path_and_query(path)
+                .build()
+                .unwrap();
+            request
+        };
+        HelloClient::new(sender.map_request(with_origin))
+    }
+
+    #[tokio::test]
+    async fn slow_calls_exceed_the_callers_deadline() {
+        let server = InProcessServer::start(Server::new("").with_interceptors([slow()]));
+        let mut client = raw_client(&server).await;
+
+        let mut request = Request::new(HelloRequest::default());
+        request.set_timeout(Duration::from_millis(10));
+        let started = Instant::now();
+        let status = client.hello(request).await.unwrap_err();
+        assert_eq!(status.code(), Code::DeadlineExceeded, "{status:?}");
+        assert!(started.elapsed() < Duration::from_millis(500));
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn calls_without_a_deadline_get_the_configured_default() {
+        let seen = Seen::default();
+        let defaults = [
+            (HELLO, Duration::from_secs(5)),
+            (HEALTH_CHECK, Duration::from_secs(3)),
+        ];
+        let server = Server::new("")
+            .with_default_timeouts(defaults, Some(Duration::from_secs(1)))
+            .with_interceptors([record_deadlines(seen.clone())]);
+        let server = InProcessServer::start(server);
+        let mut client = HelloClient::new(server.channel());
+
+        client.hello(HelloRequest::default()).await.unwrap();
+        client.ping(PingRequest::default()).await.unwrap();
+        let request = HelloStreamRequest {
+            names: vec!["Ada".to_string()],
+        };
+        let mut replies = client.hello_stream(request).await.unwrap().into_inner();
+        while replies.message().await.unwrap().is_some() {}
+        HealthClient::new(server.channel())
+            .check(HealthCheckRequest::default())
+            .await
+            .unwrap();
+
+        let seen = seen.lock().unwrap().clone();
+        let left_about = |method: &str, timeout: Duration| {
+            seen[method]
+                .is_some_and(|left| left <= timeout && left > timeout - Duration::from_millis(500))
+        };
+        assert!(left_about(HELLO, Duration::from_secs(5)), "{seen:?}");
+        assert!(left_about(HEALTH_CHECK, Duration::from_secs(3)), "{seen:?}");
+        // The global default covers the other unary methods only.
+        assert!(left_about(PING, Duration::from_secs(1)), "{seen:?}");
+        assert_eq!(seen[HELLO_STREAM], None);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn the_handler_timeout_covers_health_and_mounted_services() {
+        let server = Server::new("")
+            .with_service(SlowService)
+            .with_handler_timeout(Duration::from_millis(50))
+            .with_interceptors([slow()]);
+        let server = InProcessServer::start(server);
+
+        let started = Instant::now();
+        let status = HealthClient::new(server.channel())
+            .check(HealthCheckRequest::default())
+            .await
+            .unwrap_err();
+        assert_eq!(status.code(), Code::DeadlineExceeded, "{status:?}");
+        assert!(started.elapsed() < Duration::from_millis(500));
+
+        let started = Instant::now();
+        let status = call_slow(&server).await;
+        assert_eq!(status.code(), Code::DeadlineExceeded, "{status:?}");
+        assert!(started.elapsed() < Duration::from_millis(500));
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn required_deadlines_spare_only_streaming_methods() {
+        let server = Server::new("")
+            .with_service(SlowService)
+            .with_require_deadline(true);
+        let server = InProcessServer::start(server);
+        let mut health = HealthClient::new(server.channel());
+
+        let status = health
+            .check(HealthCheckRequest::default())
+            .await
+            .unwrap_err();
+        assert_eq!(status.code(), Code::InvalidArgument, "{status:?}");
+        let status = call_slow(&server).await;
+        assert_eq!(status.code(), Code::InvalidArgument, "{status:?}");
+        let mut statuses = health
+            .watch(HealthCheckRequest::default())
+            .await
+            .unwrap()
+            .into_inner();
+        assert!(statuses.message().await.unwrap().is_some());
+        server.shutdown().await.unwrap();
+
+        // Declared streaming, the mounted method is let through.
+        let server = Server::new("")
+            .with_service(SlowService)
+            .with_require_deadline(true)
+            .with_streaming_methods([SLOW_CALL]);
+        let server = InProcessServer::start(server);
+        let status = call_slow(&server).await;
+        assert_eq!(status.code(), Code::Unimplemented, "{status:?}");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn unknown_methods_fail_before_anything_is_bound() {
+        for unknown in [
+            "/rsketch.v1.hello.Hello/Helo",
+            "/grpc.health.v1.Health/Chek",
+        ] {
+            // Binding the metrics address would fail too, if it were tried.
+            let server = Server::new("")
+                .with_metrics_addr("not an address")
+                .with_default_timeouts([(unknown, Duration::from_secs(1))], None);
+            let result = server.run(std::future::pending()).await;
+            assert!(
+                matches!(&result, Err(Error::UnknownMethod { method }) if method == unknown),
+                "{result:?}"
+            );
+        }
+    }
+
+    #[test]
+    fn parses_grpc_timeouts() {
+        assert_eq!(parse_timeout("10m"), Some(Duration::from_millis(10)));
+        assert_eq!(parse_timeout("3S"), Some(Duration::from_secs(3)));
+        assert_eq!(parse_timeout("123456789S"), None);
+        assert_eq!(parse_timeout("10x"), None);
+        assert_eq!(parse_timeout("m"), None);
+    }
+}
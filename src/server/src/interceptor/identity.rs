@@ -0,0 +1,247 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Who is calling, as established by mutual TLS or token authentication,
+//! available to handlers through [identity_from_request].
+//!
+//! The identity of a mutual TLS client comes from its certificate, whether
+//! it connected over TCP or a Unix socket, that of a token holder from the
+//! validated [Claims], which win when a call carries both.
+
+use std::task::{Context, Poll};
+
+use tower::{Layer, Service};
+use x509_parser::{
+    certificate::X509Certificate, extensions::GeneralName, prelude::FromDer, x509::X509Name,
+};
+
+use super::auth::Claims;
+use crate::connection::PeerCertificates;
+
+/// How a caller proved its [Identity].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AuthMethod {
+    /// A client certificate presented during the TLS handshake.
+    MutualTls,
+    /// A bearer token accepted by the [auth](super::auth) interceptor.
+    Token,
+}
+
+/// The authenticated caller of an RPC.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Identity {
+    /// The certificate's common name, or its first alternative name without
+    /// one, or the token's subject.
+    pub subject: String,
+    /// The common name of the certificate's issuer, or the token's issuer.
+    pub issuer:  String,
+    pub method:  AuthMethod,
+    /// The DNS, email and URI alternative names of the certificate, empty for
+    /// tokens.
+    pub names:   Vec<String>,
+}
+
+impl Identity {
+    pub(crate) fn from_claims(claims: &Claims) -> Self {
+        Self {
+            subject: claims.subject.clone(),
+            issuer:  claims.issuer.clone(),
+            method:  AuthMethod::Token,
+            names:   Vec::new(),
+        }
+    }
+
+    /// Reads the identity from a DER encoded client certificate.
+    fn from_certificate(der: &[u8]) -> Option<Self> {
+        let (_, cert) = X509Certificate::from_der(der).ok()?;
+        let names: Vec<String> = cert
+            .subject_alternative_name()
+            .ok()
+            .flatten()
+            .map(|san| {
+                san.value
+                    .general_names
+                    .iter()
+                    .filter_map(|name| match name {
+                        GeneralName::DNSName(name)
+                        | GeneralName::RFC822Name(name)
+                        | GeneralName::URI(name) => Some(name.to_string()),
+                        _ => None,
+                    })
+                    .collect()
+            })
+            .unwrap_or_default();
+        let subject = common_name(cert.subject()).or_else(|| names.first().cloned())?;
+        Some(Self {
+            subject,
+            issuer: common_name(cert.issuer()).unwrap_or_default(),
+            method: AuthMethod::MutualTls,
+            names,
+        })
+    }
+}
+
+/// Returns the identity of the caller of `request`, if it authenticated.
+pub fn identity_from_request<T>(request: &tonic::Request<T>) -> Option<&Identity> {
+    request.extensions().get::<Identity>()
+}
+
+fn common_name(name: &X509Name<'_>) -> Option<String> {
+    let cn = name.iter_common_name().next()?;
+    cn.as_str().ok().map(str::to_string)
+}
+
+/// Attaches the [Identity] of mutual TLS clients to their requests, enabled
+/// by [Server::with_mtls](crate::Server::with_mtls).
+#[derive(Debug, Clone, Copy, Default)]
+pub struct IdentityLayer;
+
+impl<S> Layer<S> for IdentityLayer {
+    type Service = IdentityService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service { IdentityService { inner } }
+}
+
+#[derive(Debug, Clone)]
+pub struct IdentityService<S> {
+    inner: S,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for IdentityService<S>
+where
+    S: Service<http::Request<ReqBody>>,
+{
+    type Error = S::Error;
+    type Future = S::Future;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: http::Request<ReqBody>) -> Self::Future {
+        let identity = request
+            .extensions()
+            .get::<PeerCertificates>()
+            .and_then(|certs| {
+                // The leaf certificate comes first.
+                let leaf = certs.0.first()?;
+                Identity::from_certificate(leaf.get_ref())
+            });
+        if let Some(identity) = identity {
+            request.extensions_mut().insert(identity);
+        }
+        self.inner.call(request)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, HelloStreamRequest};
+    use tonic::Request;
+
+    use super::*;
+    use crate::{
+        in_process::InProcessServer,
+        interceptor::auth::{AuthLayer, TokenValidator, ValidationError},
+        Server,
+    };
+
+    /// Accepts every token, naming the caller after it.
+    struct TokenIsSubject;
+
+    #[tonic::async_trait]
+    impl TokenValidator for TokenIsSubject {
+        async fn validate(&self, token: &str) -> Result<Claims, ValidationError> {
+            Ok(Claims {
+                subject: token.to_string(),
+                issuer: "tests".to_string(),
+                ..Claims::default()
+            })
+        }
+    }
+
+    fn as_caller<T>(message: T, subject: &str) -> Request<T> {
+        let mut request = Request::new(message);
+        let token = format!("Bearer {subject}").parse().unwrap();
+        request.metadata_mut().insert("authorization", token);
+        request
+    }
+
+    #[test]
+    fn token_identity_comes_from_the_claims() {
+        let claims = Claims {
+            subject: "alice".to_string(),
+            issuer: "issuer".to_string(),
+            ..Claims::default()
+        };
+        assert_eq!(
+            Identity::from_claims(&claims),
+            Identity {
+                subject: "alice".to_string(),
+                issuer:  "issuer".to_string(),
+                method:  AuthMethod::Token,
+                names:   Vec::new(),
+            }
+        );
+    }
+
+    #[test]
+    fn certificate_identity_needs_a_parsable_certificate() {
+        assert_eq!(Identity::from_certificate(b"not a certificate"), None);
+    }
+
+    #[tokio::test]
+    async fn every_hello_method_greets_the_token_holder() {
+        let server =
+            InProcessServer::start(Server::new("").with_auth(AuthLayer::new(TokenIsSubject)));
+        let mut client = HelloClient::new(server.channel());
+
+        let request = as_caller(HelloRequest::default(), "alice");
+        let reply = client.hello(request).await.unwrap().into_inner();
+        assert_eq!(reply.message, "Hello, alice");
+
+        // An explicit name still wins over the caller.
+        let request = as_caller(
+            HelloRequest {
+                name: "Ada".to_string(),
+            },
+            "alice",
+        );
+        let reply = client.hello(request).await.unwrap().into_inner();
+        assert_eq!(reply.message, "Hello, Ada");
+
+        let names = vec![String::new(), "Ada".to_string()];
+        let request = as_caller(HelloStreamRequest { names }, "bob");
+        let mut replies = client.hello_stream(request).await.unwrap().into_inner();
+        assert_eq!(
+            replies.message().await.unwrap().unwrap().message,
+            "Hello, bob"
+        );
+        assert_eq!(
+            replies.message().await.unwrap().unwrap().message,
+            "Hello, Ada"
+        );
+        assert!(replies.message().await.unwrap().is_none());
+
+        let request = as_caller(tokio_stream::iter([HelloRequest::default()]), "carol");
+        let mut replies = client.hello_chat(request).await.unwrap().into_inner();
+        assert_eq!(
+            replies.message().await.unwrap().unwrap().message,
+            "Hello, carol"
+        );
+        assert!(replies.message().await.unwrap().is_none());
+        server.shutdown().await.unwrap();
+    }
+}
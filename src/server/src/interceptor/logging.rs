@@ -0,0 +1,247 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! One log event per RPC with its method, peer, duration and status code, and
+//! its request ID when [request IDs](super::request_id) are enabled.
+//!
+//! Events are logged once the call ends, for streaming calls once the last
+//! message is sent, with the status of their trailers.
+//!
+//! Events go through [tracing], so their format follows whatever subscriber
+//! is installed, e.g. JSON files and pretty stdout from
+//! [init_global_logging](rsketch_common::logger::init_global_logging).
+
+use std::{
+    task::{Context, Poll},
+    time::Instant,
+};
+
+use rsketch_common::propagation::REQUEST_ID_HEADER;
+use tonic::{body::BoxBody, Code, Status};
+use tower::{Layer, Service};
+use tracing::{error, info};
+
+use super::{completion::on_end, peer_addr, BoxFuture};
+
+/// Prefix of the methods served by the `grpc.health.v1.Health` service.
+const HEALTH_METHOD_PREFIX: &str = "/grpc.health.v1.Health/";
+
+/// Logs every completed RPC, at error level when it failed.
+///
+/// Health checks are probed often and skipped unless enabled with
+/// [LoggingLayer::with_health_checks].
+#[derive(Debug, Clone, Default)]
+pub struct LoggingLayer {
+    health_checks: bool,
+}
+
+impl LoggingLayer {
+    pub fn new() -> Self { Self::default() }
+
+    /// Also logs calls to the health checking service.
+    pub fn with_health_checks(self, health_checks: bool) -> Self { Self { health_checks } }
+}
+
+impl<S> Layer<S> for LoggingLayer {
+    type Service = LoggingService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        LoggingService {
+            inner,
+            health_checks: self.health_checks,
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct LoggingService<S> {
+    inner:         S,
+    health_checks: bool,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for LoggingService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+
+        let method = request.uri().path().to_string();
+        if !self.health_checks && method.starts_with(HEALTH_METHOD_PREFIX) {
+            return Box::pin(inner.call(request));
+        }
+        let peer = peer_addr(&request).map_or_else(|| "unknown".to_string(), |a| a.to_string());
+        let request_id = request
+            .headers()
+            .get(REQUEST_ID_HEADER)
+            .and_then(|value| value.to_str().ok())
+            .unwrap_or_default()
+            .to_string();
+
+        Box::pin(async move {
+            let start = Instant::now();
+            let log = move |status: &Status| {
+                log_rpc(&method, &peer, &request_id, start, status.code());
+            };
+            match inner.call(request).await {
+                Ok(response) => Ok(on_end(response, log)),
+                Err(err) => {
+                    log(&Status::unknown("service failed"));
+                    Err(err)
+                }
+            }
+        })
+    }
+}
+
+/// Logs the end of the call to `method` started at `start`.
+fn log_rpc(method: &str, peer: &str, request_id: &str, start: Instant, code: Code) {
+    let duration = start.elapsed();
+    if code == Code::Ok {
+        info!(
+            grpc.method = %method,
+            grpc.code = ?code,
+            %peer,
+            %request_id,
+            ?duration,
+            "rpc finished"
+        );
+    } else {
+        error!(
+            grpc.method = %method,
+            grpc.code = ?code,
+            %peer,
+            %request_id,
+            ?duration,
+            "rpc failed"
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        io,
+        sync::{Arc, Mutex},
+    };
+
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use tonic_health::pb::{health_client::HealthClient, HealthCheckRequest};
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    /// Collects the output of a subscriber.
+    #[derive(Clone, Default)]
+    struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+    impl Buffer {
+        /// Returns the lines of the `rpc finished` and `rpc failed` events.
+        fn rpc_lines(&self) -> Vec<String> {
+            let output = String::from_utf8(self.0.lock().unwrap().clone()).unwrap();
+            output
+                .lines()
+                .filter(|line| line.contains("rpc finished") || line.contains("rpc failed"))
+                .map(ToString::to_string)
+                .collect()
+        }
+    }
+
+    impl io::Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> io::Result<()> { Ok(()) }
+    }
+
+    // The subscriber is only installed on this thread, which the single
+    // threaded runtime runs the server on too.
+    #[tokio::test(flavor = "current_thread")]
+    async fn logs_calls_with_their_fields() {
+        let buffer = Buffer::default();
+        let writer = buffer.clone();
+        let subscriber = tracing_subscriber::fmt()
+            .with_ansi(false)
+            .with_writer(move || writer.clone())
+            .finish();
+        let _guard = tracing::subscriber::set_default(subscriber);
+
+        let server = InProcessServer::start(Server::new("").with_logging(LoggingLayer::new()));
+        let mut client = HelloClient::new(server.channel());
+        client.hello(HelloRequest::default()).await.unwrap();
+        let invalid = HelloRequest {
+            name: "bell\u{7}".to_string(),
+        };
+        client.hello(invalid).await.unwrap_err();
+        let names = ["Ada", "bell\u{7}"].map(|name| HelloRequest {
+            name: name.to_string(),
+        });
+        let mut replies = client
+            .hello_chat(tokio_stream::iter(names))
+            .await
+            .unwrap()
+            .into_inner();
+        replies.message().await.unwrap().unwrap();
+        replies.message().await.unwrap_err();
+        // Skipped by default.
+        let mut health = HealthClient::new(server.channel());
+        health.check(HealthCheckRequest::default()).await.unwrap();
+        server.shutdown().await.unwrap();
+
+        let lines = buffer.rpc_lines();
+        let [finished, failed, chat] = lines.as_slice() else {
+            panic!("expected three rpc events, got {lines:?}");
+        };
+        for field in [
+            "INFO",
+            "rpc finished",
+            "grpc.method=/rsketch.v1.hello.Hello/Hello",
+            "grpc.code=Ok",
+            "peer=unknown",
+            "duration=",
+        ] {
+            assert!(finished.contains(field), "{field} missing from {finished}");
+        }
+        for field in [
+            "ERROR",
+            "rpc failed",
+            "grpc.method=/rsketch.v1.hello.Hello/Hello",
+            "grpc.code=InvalidArgument",
+        ] {
+            assert!(failed.contains(field), "{field} missing from {failed}");
+        }
+        // The stream failed after its first reply, and is logged as such.
+        for field in [
+            "ERROR",
+            "rpc failed",
+            "grpc.method=/rsketch.v1.hello.Hello/HelloChat",
+            "grpc.code=InvalidArgument",
+        ] {
+            assert!(chat.contains(field), "{field} missing from {chat}");
+        }
+    }
+}
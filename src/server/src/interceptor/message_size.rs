@@ -0,0 +1,189 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Reports messages over the size limits with `ResourceExhausted`, the code
+//! gRPC specifies for them, rather than the `OutOfRange` tonic fails them
+//! with.
+//!
+//! Oversized requests fail before their handler runs, so the status is in
+//! the response headers, while oversized responses fail as they are encoded,
+//! so it is in the trailers. Both are rewritten.
+
+use std::{
+    pin::Pin,
+    task::{Context, Poll},
+};
+
+use http::HeaderMap;
+use hyper::body::{Bytes, HttpBody, SizeHint};
+use tonic::{body::BoxBody, transport::Body, Code, Status};
+use tower::{Layer, Service};
+
+use super::BoxFuture;
+
+/// How tonic's messages on oversized messages start, telling them apart
+/// from `OutOfRange` statuses returned by handlers.
+const TOO_LARGE: &str = "Error, message length too large";
+
+/// Rewrites the status of calls whose messages exceed the size limits.
+#[derive(Debug, Clone, Copy, Default)]
+pub(crate) struct MessageSizeLayer;
+
+impl<S> Layer<S> for MessageSizeLayer {
+    type Service = MessageSizeService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service { MessageSizeService { inner } }
+}
+
+#[derive(Debug, Clone)]
+pub(crate) struct MessageSizeService<S> {
+    inner: S,
+}
+
+impl<S> Service<http::Request<Body>> for MessageSizeService<S>
+where
+    S: Service<http::Request<Body>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<Body>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        Box::pin(async move {
+            let mut response = inner.call(request).await?;
+            remap(response.headers_mut());
+            Ok(response.map(|inner| tonic::body::boxed(MessageSizeBody { inner })))
+        })
+    }
+}
+
+/// Replaces a too large message's `OutOfRange` status in `headers`.
+fn remap(headers: &mut HeaderMap) {
+    let Some(status) = Status::from_header_map(headers) else {
+        return;
+    };
+    if status.code() != Code::OutOfRange || !status.message().starts_with(TOO_LARGE) {
+        return;
+    }
+    let _ = Status::new(Code::ResourceExhausted, status.message()).add_header(headers);
+}
+
+/// A response body whose trailers are [remap]ped.
+struct MessageSizeBody {
+    inner: BoxBody,
+}
+
+impl HttpBody for MessageSizeBody {
+    type Data = Bytes;
+    type Error = Status;
+
+    fn poll_data(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Self::Data, Self::Error>>> {
+        Pin::new(&mut self.inner).poll_data(cx)
+    }
+
+    fn poll_trailers(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Option<HeaderMap>, Self::Error>> {
+        Pin::new(&mut self.inner)
+            .poll_trailers(cx)
+            .map_ok(|trailers| {
+                trailers.map(|mut trailers| {
+                    remap(&mut trailers);
+                    trailers
+                })
+            })
+    }
+
+    fn is_end_stream(&self) -> bool { self.inner.is_end_stream() }
+
+    fn size_hint(&self) -> SizeHint { self.inner.size_hint() }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, HelloStreamRequest};
+    use tokio_stream::StreamExt;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    /// Names adding up to about 5 MB, over the 4 MiB default limit.
+    fn many_names() -> HelloStreamRequest {
+        HelloStreamRequest {
+            names: vec!["n".repeat(250); 20_000],
+        }
+    }
+
+    #[tokio::test]
+    async fn oversized_requests_are_resource_exhausted() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel());
+
+        let status = client.hello_stream(many_names()).await.unwrap_err();
+        assert_eq!(status.code(), Code::ResourceExhausted, "{status:?}");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn raising_the_limit_accepts_large_requests() {
+        let server = InProcessServer::start(Server::new("").with_max_recv_msg_size(8 << 20));
+        let mut client = HelloClient::new(server.channel());
+
+        let greetings = client
+            .hello_stream(many_names())
+            .await
+            .unwrap()
+            .into_inner()
+            .collect::<Result<Vec<_>, _>>()
+            .await
+            .unwrap();
+        assert_eq!(greetings.len(), 20_000);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn oversized_responses_are_resource_exhausted() {
+        let server = InProcessServer::start(Server::new("").with_max_send_msg_size(8));
+        let mut client = HelloClient::new(server.channel());
+
+        let request = HelloRequest {
+            name: "a name longer than the limit".to_string(),
+        };
+        let status = client.hello(request).await.unwrap_err();
+        assert_eq!(status.code(), Code::ResourceExhausted, "{status:?}");
+        server.shutdown().await.unwrap();
+    }
+
+    #[test]
+    fn other_out_of_range_statuses_are_kept() {
+        let mut headers = HeaderMap::new();
+        Status::out_of_range("page 3 of 2")
+            .add_header(&mut headers)
+            .unwrap();
+        remap(&mut headers);
+        let status = Status::from_header_map(&headers).unwrap();
+        assert_eq!(status.code(), Code::OutOfRange);
+    }
+}
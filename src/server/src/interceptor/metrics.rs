@@ -0,0 +1,424 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Prometheus metrics for every RPC, labeled by `grpc_method` and, once the
+//! call completes, `grpc_code`. Streaming calls complete once their last
+//! message is sent, with the status of their trailers.
+//!
+//! Streaming methods also count the messages they receive and send, without
+//! touching the messages themselves.
+
+use std::{
+    collections::HashSet,
+    pin::Pin,
+    sync::Arc,
+    task::{Context, Poll},
+    time::Instant,
+};
+
+use http::HeaderMap;
+use hyper::body::{Bytes, HttpBody, SizeHint};
+use prometheus::{
+    HistogramOpts, HistogramVec, IntCounter, IntCounterVec, IntGauge, IntGaugeVec, Opts, Registry,
+};
+use tonic::{body::BoxBody, transport::Body, Code, Status};
+use tower::{Layer, Service};
+
+use super::{completion::on_end, streaming_methods, BoxFuture, FRAME_HEADER_LEN};
+
+struct Metrics {
+    handled:      IntCounterVec,
+    in_flight:    IntGaugeVec,
+    latency:      HistogramVec,
+    msg_received: IntCounterVec,
+    msg_sent:     IntCounterVec,
+    streaming:    HashSet<String>,
+}
+
+impl Metrics {
+    fn new(registry: &Registry) -> prometheus::Result<Self> {
+        let handled = IntCounterVec::new(
+            Opts::new(
+                "grpc_server_handled_total",
+                "Total number of RPCs completed on the server.",
+            ),
+            &["grpc_method", "grpc_code"],
+        )?;
+        let in_flight = IntGaugeVec::new(
+            Opts::new(
+                "grpc_server_in_flight",
+                "Number of RPCs currently being handled on the server.",
+            ),
+            &["grpc_method"],
+        )?;
+        let latency = HistogramVec::new(
+            HistogramOpts::new(
+                "grpc_server_handling_seconds",
+                "Time taken by the server to produce a response.",
+            ),
+            &["grpc_method", "grpc_code"],
+        )?;
+
+        let msg_received = IntCounterVec::new(
+            Opts::new(
+                "grpc_stream_msg_received_total",
+                "Total number of messages received on streaming RPCs.",
+            ),
+            &["grpc_method"],
+        )?;
+        let msg_sent = IntCounterVec::new(
+            Opts::new(
+                "grpc_stream_msg_sent_total",
+                "Total number of messages sent on streaming RPCs.",
+            ),
+            &["grpc_method"],
+        )?;
+
+        registry.register(Box::new(handled.clone()))?;
+        registry.register(Box::new(in_flight.clone()))?;
+        registry.register(Box::new(latency.clone()))?;
+        registry.register(Box::new(msg_received.clone()))?;
+        registry.register(Box::new(msg_sent.clone()))?;
+        Ok(Self {
+            handled,
+            in_flight,
+            latency,
+            msg_received,
+            msg_sent,
+            streaming: streaming_methods(),
+        })
+    }
+}
+
+/// Keeps an RPC counted as in flight until dropped, so cancelled calls are
+/// released as well.
+struct InFlight(IntGauge);
+
+impl InFlight {
+    fn enter(gauge: IntGauge) -> Self {
+        gauge.inc();
+        Self(gauge)
+    }
+}
+
+impl Drop for InFlight {
+    fn drop(&mut self) { self.0.dec(); }
+}
+
+/// Records request counts, in-flight calls and latency for each RPC, and
+/// message counts for the streaming methods of the rsketch services.
+///
+/// For streaming methods the latency covers the whole stream.
+#[derive(Clone)]
+pub struct MetricsLayer {
+    metrics: Arc<Metrics>,
+}
+
+impl MetricsLayer {
+    /// Creates the layer, registering its collectors with `registry`.
+    ///
+    /// Fails if `registry` already holds collectors with the same names.
+    pub fn new(registry: &Registry) -> prometheus::Result<Self> {
+        Ok(Self {
+            metrics: Arc::new(Metrics::new(registry)?),
+        })
+    }
+}
+
+impl<S> Layer<S> for MetricsLayer {
+    type Service = MetricsService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        MetricsService {
+            inner,
+            metrics: self.metrics.clone(),
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct MetricsService<S> {
+    inner:   S,
+    metrics: Arc<Metrics>,
+}
+
+impl<S> Service<http::Request<Body>> for MetricsService<S>
+where
+    S: Service<http::Request<Body>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: http::Request<Body>) -> Self::Future {
+        // The clone may not be ready, keep the service polled by `poll_ready`.
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        let metrics = self.metrics.clone();
+        let method = request.uri().path().to_string();
+        let sent = metrics.streaming.contains(&method).then(|| {
+            let received = metrics.msg_received.with_label_values(&[&method]);
+            let body = std::mem::take(request.body_mut());
+            *request.body_mut() = count_received(body, received);
+            metrics.msg_sent.with_label_values(&[&method])
+        });
+
+        Box::pin(async move {
+            let in_flight = InFlight::enter(metrics.in_flight.with_label_values(&[&method]));
+            let start = Instant::now();
+            let record = move |code: Code| {
+                drop(in_flight);
+                let code = format!("{code:?}");
+                metrics.handled.with_label_values(&[&method, &code]).inc();
+                metrics
+                    .latency
+                    .with_label_values(&[&method, &code])
+                    .observe(start.elapsed().as_secs_f64());
+            };
+            let response = match inner.call(request).await {
+                Ok(response) => response,
+                Err(err) => {
+                    record(Code::Unknown);
+                    return Err(err);
+                }
+            };
+            let response = match sent {
+                Some(sent) => response.map(|body| {
+                    tonic::body::boxed(CountedBody {
+                        inner: body,
+                        frames: FrameCounter::default(),
+                        sent,
+                    })
+                }),
+                None => response,
+            };
+            Ok(on_end(response, move |status| record(status.code())))
+        })
+    }
+}
+
+/// Counts the gRPC messages in a body's data frames, which may split a
+/// message or hold several.
+#[derive(Debug, Default)]
+struct FrameCounter {
+    header:     [u8; FRAME_HEADER_LEN],
+    header_len: usize,
+    /// Bytes left of the current message.
+    remaining:  usize,
+}
+
+impl FrameCounter {
+    /// Consumes the next data frame, returning how many messages start in
+    /// it.
+    fn feed(&mut self, mut data: &[u8]) -> u64 {
+        let mut messages = 0;
+        while !data.is_empty() {
+            if self.remaining > 0 {
+                let skipped = self.remaining.min(data.len());
+                self.remaining -= skipped;
+                data = &data[skipped..];
+                continue;
+            }
+            let read = (FRAME_HEADER_LEN - self.header_len).min(data.len());
+            self.header[self.header_len..self.header_len + read].copy_from_slice(&data[..read]);
+            self.header_len += read;
+            data = &data[read..];
+            if self.header_len == FRAME_HEADER_LEN {
+                let [_, len @ ..] = self.header;
+                self.remaining = u32::from_be_bytes(len) as usize;
+                self.header_len = 0;
+                messages += 1;
+            }
+        }
+        messages
+    }
+}
+
+/// Wraps a request body, counting the messages in it into `received`.
+fn count_received(body: Body, received: IntCounter) -> Body {
+    let state = (body, FrameCounter::default(), received);
+    Body::wrap_stream(futures::stream::unfold(
+        state,
+        |(mut body, mut frames, received)| async move {
+            let data = body.data().await?;
+            if let Ok(data) = &data {
+                received.inc_by(frames.feed(data));
+            }
+            Some((data, (body, frames, received)))
+        },
+    ))
+}
+
+/// A response body counting the messages it sends into `sent`.
+struct CountedBody {
+    inner:  BoxBody,
+    frames: FrameCounter,
+    sent:   IntCounter,
+}
+
+impl HttpBody for CountedBody {
+    type Data = Bytes;
+    type Error = Status;
+
+    fn poll_data(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Self::Data, Self::Error>>> {
+        let poll = Pin::new(&mut self.inner).poll_data(cx);
+        if let Poll::Ready(Some(Ok(data))) = &poll {
+            let messages = self.frames.feed(data);
+            self.sent.inc_by(messages);
+        }
+        poll
+    }
+
+    fn poll_trailers(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Option<HeaderMap>, Self::Error>> {
+        Pin::new(&mut self.inner).poll_trailers(cx)
+    }
+
+    fn is_end_stream(&self) -> bool { self.inner.is_end_stream() }
+
+    fn size_hint(&self) -> SizeHint { self.inner.size_hint() }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, HelloStreamRequest};
+    use tonic::Code;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    const HELLO: &str = "/rsketch.v1.hello.Hello/Hello";
+    const HELLO_STREAM: &str = "/rsketch.v1.hello.Hello/HelloStream";
+    const HELLO_CHAT: &str = "/rsketch.v1.hello.Hello/HelloChat";
+
+    /// Returns the value of the counter `name` with the given labels, zero
+    /// if it was never incremented.
+    fn counter(registry: &Registry, name: &str, labels: &[(&str, &str)]) -> u64 {
+        registry
+            .gather()
+            .iter()
+            .filter(|family| family.get_name() == name)
+            .flat_map(|family| family.get_metric())
+            .find(|metric| {
+                labels.iter().all(|(name, value)| {
+                    metric
+                        .get_label()
+                        .iter()
+                        .any(|label| label.get_name() == *name && label.get_value() == *value)
+                })
+            })
+            .map_or(0, |metric| metric.get_counter().get_value() as u64)
+    }
+
+    fn hello(name: &str) -> HelloRequest {
+        HelloRequest {
+            name: name.to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn counts_calls_per_status_code() {
+        let registry = Registry::new();
+        let server = Server::new("").with_metrics(registry.clone()).unwrap();
+        let server = InProcessServer::start(server);
+        let mut client = HelloClient::new(server.channel());
+
+        client.hello(hello("ok")).await.unwrap();
+        client.hello(hello("again")).await.unwrap();
+        let status = client.hello(hello("bell\u{7}")).await.unwrap_err();
+        assert_eq!(status.code(), Code::InvalidArgument);
+
+        let handled = "grpc_server_handled_total";
+        let ok = [("grpc_method", HELLO), ("grpc_code", "Ok")];
+        assert_eq!(counter(&registry, handled, &ok), 2);
+        let invalid = [("grpc_method", HELLO), ("grpc_code", "InvalidArgument")];
+        assert_eq!(counter(&registry, handled, &invalid), 1);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn counts_streamed_messages() {
+        let registry = Registry::new();
+        let server = Server::new("").with_metrics(registry.clone()).unwrap();
+        let server = InProcessServer::start(server);
+        let mut client = HelloClient::new(server.channel());
+
+        let request = HelloStreamRequest {
+            names: ["a", "b", "c", "d", "e"].map(String::from).to_vec(),
+        };
+        let mut replies = client.hello_stream(request).await.unwrap().into_inner();
+        while replies.message().await.unwrap().is_some() {}
+
+        let names = ["Ada", "Grace", "Linus"].map(hello);
+        let mut replies = client
+            .hello_chat(tokio_stream::iter(names))
+            .await
+            .unwrap()
+            .into_inner();
+        while replies.message().await.unwrap().is_some() {}
+
+        let (received, sent) = (
+            "grpc_stream_msg_received_total",
+            "grpc_stream_msg_sent_total",
+        );
+        let stream = [("grpc_method", HELLO_STREAM)];
+        assert_eq!(counter(&registry, received, &stream), 1);
+        assert_eq!(counter(&registry, sent, &stream), 5);
+        let chat = [("grpc_method", HELLO_CHAT)];
+        assert_eq!(counter(&registry, received, &chat), 3);
+        assert_eq!(counter(&registry, sent, &chat), 3);
+        // Unary calls aren't counted per message.
+        client.hello(hello("unary")).await.unwrap();
+        assert_eq!(counter(&registry, sent, &[("grpc_method", HELLO)]), 0);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn counts_streams_failing_after_their_first_message_by_their_status() {
+        let registry = Registry::new();
+        let server = Server::new("").with_metrics(registry.clone()).unwrap();
+        let server = InProcessServer::start(server);
+        let mut client = HelloClient::new(server.channel());
+
+        let names = ["Ada", "bell\u{7}"].map(hello);
+        let mut replies = client
+            .hello_chat(tokio_stream::iter(names))
+            .await
+            .unwrap()
+            .into_inner();
+        replies.message().await.unwrap().unwrap();
+        let status = replies.message().await.unwrap_err();
+        assert_eq!(status.code(), Code::InvalidArgument);
+
+        let handled = "grpc_server_handled_total";
+        let ok = [("grpc_method", HELLO_CHAT), ("grpc_code", "Ok")];
+        assert_eq!(counter(&registry, handled, &ok), 0);
+        let invalid = [
+            ("grpc_method", HELLO_CHAT),
+            ("grpc_code", "InvalidArgument"),
+        ];
+        assert_eq!(counter(&registry, handled, &invalid), 1);
+        server.shutdown().await.unwrap();
+    }
+}
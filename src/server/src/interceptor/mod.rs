@@ -0,0 +1,388 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Tower middleware wrapping every RPC hosted by a [Server](crate::Server).
+//!
+//! Interceptors see the raw HTTP/2 exchange, so they work the same for unary
+//! and streaming methods and for every registered service.
+//!
+//! Enabled interceptors always run in this order, from the first to see a
+//! request to the last:
+//!
+//! 1. [recovery](recovery::RecoveryLayer), on by default
+//! 2. [request_id](request_id::RequestIdLayer)
+//! 3. [trace](trace::TraceLayer)
+//! 4. [logging](logging::LoggingLayer)
+//! 5. [slow_request](slow_request::SlowRequestLayer)
+//! 6. [metrics](metrics::MetricsLayer)
+//! 7. [deadline](deadline::DeadlineLayer), on by default
+//! 8. [rate_limit](rate_limit::RateLimitLayer)
+//! 9. [identity](identity::IdentityLayer), on with mutual TLS
+//! 10. [auth](auth::AuthLayer)
+//! 11. [authorize](authorize::AuthorizeLayer)
+//! 12. [payload](payload::PayloadLoggingLayer)
+//! 13. the custom [Interceptor]s added through
+//!     [Server::with_interceptors](crate::Server::with_interceptors), in the
+//!     order they were added
+//!
+//! Innermost of all, request messages are [validated](validate) against the
+//! constraints documented in the protos, and calls whose messages exceed the
+//! size limits are reported with `ResourceExhausted`, the code gRPC specifies
+//! for them, in place of the `OutOfRange` tonic fails them with, so every
+//! interceptor sees the former.
+//!
+//! The built-in layers are [Interceptor]s too, so a server that needs a
+//! different order can leave their dedicated options unset and add them
+//! through `with_interceptors` instead.
+
+pub mod auth;
+pub mod authorize;
+mod completion;
+pub mod deadline;
+pub mod identity;
+pub mod logging;
+mod message_size;
+pub mod metrics;
+pub mod payload;
+pub mod rate_limit;
+pub mod recovery;
+pub mod request_id;
+pub mod slow_request;
+pub mod trace;
+pub(crate) mod validate;
+
+use std::{
+    collections::HashSet, convert::Infallible, fmt, future::Future, net::SocketAddr, pin::Pin,
+    sync::Arc,
+};
+
+use prost::Message;
+use prost_types::{FileDescriptorSet, MethodDescriptorProto};
+use tonic::{
+    body::BoxBody,
+    transport::{
+        server::{TcpConnectInfo, TlsConnectInfo},
+        Body,
+    },
+    Status,
+};
+use tower::{util::BoxCloneService, Layer, Service};
+
+use self::{
+    auth::AuthLayer, authorize::AuthorizeLayer, deadline::DeadlineLayer, identity::IdentityLayer,
+    logging::LoggingLayer, message_size::MessageSizeLayer, metrics::MetricsLayer,
+    payload::PayloadLoggingLayer, rate_limit::RateLimitLayer, recovery::RecoveryLayer,
+    request_id::RequestIdLayer, slow_request::SlowRequestLayer, trace::TraceLayer,
+    validate::ValidateLayer,
+};
+
+/// Length of the prefix of every gRPC message, its compression flag followed
+/// by its length as a big endian `u32`.
+const FRAME_HEADER_LEN: usize = 5;
+
+pub type GrpcRequest = http::Request<Body>;
+pub type GrpcResponse = http::Response<BoxBody>;
+
+/// A type erased gRPC service, the unit interceptors are composed over.
+pub type GrpcService = BoxCloneService<GrpcRequest, GrpcResponse, Infallible>;
+
+pub(crate) type BoxFuture<T> = Pin<Box<dyn Future<Output = T> + Send>>;
+
+/// A type erased middleware layer that can be added to a server's
+/// interceptor chain.
+#[derive(Clone)]
+pub struct Interceptor(Arc<dyn Fn(GrpcService) -> GrpcService + Send + Sync>);
+
+impl fmt::Debug for Interceptor {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Interceptor").finish_non_exhaustive()
+    }
+}
+
+impl Interceptor {
+    /// Wraps a tower layer, e.g. one built with [tower::layer::layer_fn] or
+    /// one of the built-in layers.
+    pub fn new<L>(layer: L) -> Self
+    where
+        L: Layer<GrpcService> + Send + Sync + 'static,
+        L::Service: Service<GrpcRequest, Response = GrpcResponse, Error = Infallible>
+            + Clone
+            + Send
+            + 'static,
+        <L::Service as Service<GrpcRequest>>::Future: Send + 'static,
+    {
+        Self(Arc::new(move |service| {
+            GrpcService::new(layer.layer(service))
+        }))
+    }
+
+    fn wrap(&self, service: GrpcService) -> GrpcService { (self.0)(service) }
+}
+
+/// The interceptors enabled on a server, applied as a single layer.
+#[derive(Clone)]
+pub(crate) struct Interceptors {
+    pub(crate) recovery:   Option<RecoveryLayer>,
+    pub(crate) request_id: Option<RequestIdLayer>,
+    pub(crate) logging:    Option<LoggingLayer>,
+    pub(crate) slow:       Option<SlowRequestLayer>,
+    pub(crate) metrics:    Option<MetricsLayer>,
+    pub(crate) deadline:   Option<DeadlineLayer>,
+    pub(crate) rate_limit: Option<RateLimitLayer>,
+    pub(crate) identity:   Option<IdentityLayer>,
+    pub(crate) auth:       Option<AuthLayer>,
+    pub(crate) authorize:  Option<AuthorizeLayer>,
+    pub(crate) payload:    Option<PayloadLoggingLayer>,
+    pub(crate) trace:      Option<TraceLayer>,
+    pub(crate) custom:     Vec<Interceptor>,
+    pub(crate) validate:   ValidateLayer,
+}
+
+impl Default for Interceptors {
+    fn default() -> Self {
+        Self {
+            recovery:   Some(RecoveryLayer::default()),
+            request_id: None,
+            logging:    None,
+            slow:       None,
+            metrics:    None,
+            deadline:   Some(DeadlineLayer::default()),
+            rate_limit: None,
+            identity:   None,
+            auth:       None,
+            authorize:  None,
+            payload:    None,
+            trace:      None,
+            custom:     Vec::new(),
+            validate:   ValidateLayer::default(),
+        }
+    }
+}
+
+impl<S> Layer<S> for Interceptors
+where
+    S: Service<GrpcRequest, Response = GrpcResponse, Error = Infallible> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Service = GrpcService;
+
+    /// Wraps `inner` from the inside out, the reverse of the order documented
+    /// on the [module](self).
+    fn layer(&self, inner: S) -> Self::Service {
+        let mut service = GrpcService::new(MessageSizeLayer.layer(inner));
+        service = GrpcService::new(self.validate.layer(service));
+        for interceptor in self.custom.iter().rev() {
+            service = interceptor.wrap(service);
+        }
+        // Innermost, so only calls that reach the handler are buffered.
+        if let Some(payload) = &self.payload {
+            service = GrpcService::new(payload.layer(service));
+        }
+        // Inside of auth so the claims are attached.
+        if let Some(authorize) = &self.authorize {
+            service = GrpcService::new(authorize.layer(service));
+        }
+        if let Some(auth) = &self.auth {
+            service = GrpcService::new(auth.layer(service));
+        }
+        // Outside of auth so a token identity replaces the certificate's.
+        if let Some(identity) = &self.identity {
+            service = GrpcService::new(identity.layer(service));
+        }
+        // Inside of metrics and logging so rejected calls show up there.
+        if let Some(rate_limit) = &self.rate_limit {
+            service = GrpcService::new(rate_limit.layer(service));
+        }
+        // Inside of metrics so expired calls are counted as such.
+        if let Some(deadline) = &self.deadline {
+            service = GrpcService::new(deadline.layer(service));
+        }
+        if let Some(metrics) = &self.metrics {
+            service = GrpcService::new(metrics.layer(service));
+        }
+        if let Some(slow) = &self.slow {
+            service = GrpcService::new(slow.layer(service));
+        }
+        if let Some(logging) = &self.logging {
+            service = GrpcService::new(logging.layer(service));
+        }
+        // Outside of metrics so the span covers everything else.
+        if let Some(trace) = &self.trace {
+            service = GrpcService::new(trace.layer(service));
+        }
+        // Outside of trace and logging so they can record the ID.
+        if let Some(request_id) = &self.request_id {
+            service = GrpcService::new(request_id.layer(service));
+        }
+        // Outermost, so a panic in any other interceptor is recovered too.
+        if let Some(recovery) = &self.recovery {
+            service = GrpcService::new(recovery.layer(service));
+        }
+        service
+    }
+}
+
+/// Returns the address of the peer that sent `request`, found in the
+/// connect info of TCP connections, wrapped in that of TLS if encrypted.
+fn peer_addr<B>(request: &http::Request<B>) -> Option<SocketAddr> {
+    let extensions = request.extensions();
+    extensions
+        .get::<TcpConnectInfo>()
+        .or_else(|| {
+            extensions
+                .get::<TlsConnectInfo<TcpConnectInfo>>()
+                .map(TlsConnectInfo::get_ref)
+        })
+        .and_then(TcpConnectInfo::remote_addr)
+}
+
+/// Returns the gRPC status a response carries in its headers.
+///
+/// Failed calls carry `grpc-status` in the headers, successful ones only in
+/// the trailers, so a missing header means the call succeeded.
+fn response_status<B>(response: &http::Response<B>) -> Option<Status> {
+    Status::from_header_map(response.headers())
+}
+
+/// Returns the full names of the streaming methods of the rsketch services,
+/// read from their descriptors.
+fn streaming_methods() -> HashSet<String> {
+    rsketch_methods(|method| method.client_streaming() || method.server_streaming())
+}
+
+fn rsketch_methods(keep: impl Fn(&MethodDescriptorProto) -> bool) -> HashSet<String> {
+    let Ok(descriptors) = FileDescriptorSet::decode(api::pb::GRPC_DESC) else {
+        return HashSet::new();
+    };
+    let mut methods = HashSet::new();
+    for file in &descriptors.file {
+        for service in &file.service {
+            for method in &service.method {
+                if keep(method) {
+                    methods.insert(format!(
+                        "/{}.{}/{}",
+                        file.package(),
+                        service.name(),
+                        method.name()
+                    ));
+                }
+            }
+        }
+    }
+    methods
+}
+
+#[cfg(test)]
+mod tests {
+    use std::sync::Mutex;
+
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use rsketch_common::propagation::REQUEST_ID_HEADER;
+    use tower::ServiceExt;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    type Events = Arc<Mutex<Vec<String>>>;
+
+    /// Records `name` when a request passes on its way in, and when its
+    /// response passes on the way out.
+    fn record(name: &'static str, events: Events) -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+            let events = events.clone();
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                let events = events.clone();
+                events.lock().unwrap().push(format!("{name} in"));
+                async move {
+                    let response = inner.oneshot(request).await;
+                    events.lock().unwrap().push(format!("{name} out"));
+                    response
+                }
+            })
+        }))
+    }
+
+    /// Records the request ID every request reaches the interceptor with.
+    fn record_request_ids(events: Events) -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(move |inner: GrpcService| {
+            let events = events.clone();
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                let id = request
+                    .headers()
+                    .get(REQUEST_ID_HEADER)
+                    .and_then(|value| value.to_str().ok())
+                    .unwrap_or("none")
+                    .to_string();
+                events.lock().unwrap().push(id);
+                async move { inner.oneshot(request).await }
+            })
+        }))
+    }
+
+    fn hello() -> HelloRequest {
+        HelloRequest {
+            name: "Ada".to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn custom_interceptors_run_in_the_order_added() {
+        let events = Events::default();
+        let server = InProcessServer::start(
+            Server::new("")
+                .with_interceptors([
+                    record("first", events.clone()),
+                    record("second", events.clone()),
+                ])
+                .with_interceptors([record("third", events.clone())]),
+        );
+
+        HelloClient::new(server.channel())
+            .hello(hello())
+            .await
+            .unwrap();
+        assert_eq!(
+            *events.lock().unwrap(),
+            [
+                "first in",
+                "second in",
+                "third in",
+                "third out",
+                "second out",
+                "first out",
+            ]
+        );
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn custom_interceptors_run_inside_the_built_in_ones() {
+        let events = Events::default();
+        let server = InProcessServer::start(
+            Server::new("")
+                .with_request_id(true)
+                .with_interceptors([record_request_ids(events.clone())]),
+        );
+
+        let response = HelloClient::new(server.channel())
+            .hello(hello())
+            .await
+            .unwrap();
+        let id = response.metadata().get(REQUEST_ID_HEADER).unwrap();
+        assert_eq!(*events.lock().unwrap(), [id.to_str().unwrap()]);
+        server.shutdown().await.unwrap();
+    }
+}
@@ -0,0 +1,503 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Opt-in logging of request and response payloads rendered as JSON, to
+//! debug what a client actually sends and gets back.
+//!
+//! Only the unary methods of the Hello services can be rendered, calls to
+//! anything else pass through untouched. Messages are rendered following the
+//! protobuf JSON mapping, with camelCase field names and bytes in base64.
+//!
+//! The request body is buffered whole before it reaches the handler, up to
+//! the largest message the server accepts, one more reason to keep this out
+//! of production.
+
+use std::{
+    collections::HashSet,
+    pin::Pin,
+    sync::Arc,
+    task::{Context, Poll},
+};
+
+use api::pb::{
+    v1::hello::{
+        HelloRequest, HelloResponse, InfoResponse, ListGreetingsRequest, ListGreetingsResponse,
+        PingRequest, PingResponse,
+    },
+    v2,
+};
+use bytes::BytesMut;
+use futures::StreamExt;
+use http::HeaderMap;
+use hyper::body::{Bytes, HttpBody, SizeHint};
+use prost::Message;
+use serde::Serialize;
+use serde_json::Value;
+use tonic::{body::BoxBody, transport::Body, Status};
+use tower::{Layer, Service};
+use tracing::{info, warn};
+
+use super::{validate::DEFAULT_MAX_MESSAGE_SIZE, BoxFuture, FRAME_HEADER_LEN};
+
+/// The value logged in place of a redacted field.
+const REDACTED: &str = "[REDACTED]";
+
+/// Decodes a message and renders it as JSON.
+type Render = fn(&[u8]) -> Result<Value, String>;
+
+/// Logs the request and response payload of every call it can render,
+/// replacing the fields added with [PayloadLoggingLayer::with_redacted] by
+/// `"[REDACTED]"`.
+///
+/// Payloads that can't be rendered, e.g. compressed ones or messages over
+/// the size limit, are reported in a warning while the call goes on
+/// unaffected.
+#[derive(Debug, Clone)]
+pub struct PayloadLoggingLayer {
+    redacted:         Arc<HashSet<String>>,
+    max_message_size: usize,
+}
+
+impl PayloadLoggingLayer {
+    pub fn new() -> Self { Self::default() }
+
+    /// Redacts every field named `field`, as rendered in the JSON, at any
+    /// depth.
+    pub fn with_redacted(self, field: impl Into<String>) -> Self {
+        let mut redacted = HashSet::clone(&self.redacted);
+        redacted.insert(field.into());
+        Self {
+            redacted: Arc::new(redacted),
+            ..self
+        }
+    }
+
+    /// Buffers and renders messages of up to `max_message_size` bytes, set by
+    /// the server to the largest message it decodes.
+    pub(crate) fn with_max_message_size(self, max_message_size: usize) -> Self {
+        Self {
+            max_message_size,
+            ..self
+        }
+    }
+}
+
+impl Default for PayloadLoggingLayer {
+    fn default() -> Self {
+        Self {
+            redacted:         Arc::default(),
+            max_message_size: DEFAULT_MAX_MESSAGE_SIZE,
+        }
+    }
+}
+
+impl<S> Layer<S> for PayloadLoggingLayer {
+    type Service = PayloadLoggingService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        PayloadLoggingService {
+            inner,
+            redacted: self.redacted.clone(),
+            limit: FRAME_HEADER_LEN + self.max_message_size,
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct PayloadLoggingService<S> {
+    inner:    S,
+    redacted: Arc<HashSet<String>>,
+    /// The most bytes buffered of a body.
+    limit:    usize,
+}
+
+impl<S> Service<http::Request<Body>> for PayloadLoggingService<S>
+where
+    S: Service<http::Request<Body>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<Body>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        let method = request.uri().path().to_string();
+        let Some((render_request, render_response)) = renderers(&method) else {
+            return Box::pin(inner.call(request));
+        };
+        let redacted = self.redacted.clone();
+        let limit = self.limit;
+
+        Box::pin(async move {
+            let (parts, body) = request.into_parts();
+            let body = match buffer(body, limit).await {
+                Ok(Ok(payload)) => {
+                    log_payload(
+                        &method,
+                        "request",
+                        render_payload(&payload, render_request, &redacted),
+                    );
+                    Body::from(payload)
+                }
+                Ok(Err(body)) => {
+                    log_payload(&method, "request", Err(too_large(limit)));
+                    body
+                }
+                Err(err) => {
+                    let status = Status::unknown(format!("failed to read request: {err}"));
+                    return Ok(status.to_http());
+                }
+            };
+
+            let request = http::Request::from_parts(parts, body);
+            let response = inner.call(request).await?;
+            Ok(response.map(|body| {
+                tonic::body::boxed(LoggedBody {
+                    inner: body,
+                    payload: Vec::new(),
+                    limit,
+                    oversized: false,
+                    method,
+                    render: render_response,
+                    redacted,
+                    logged: false,
+                })
+            }))
+        })
+    }
+}
+
+/// Reads `body` whole, unless it is longer than `limit` bytes, which returns
+/// the body itself again with the data read so far put back in front.
+async fn buffer(mut body: Body, limit: usize) -> Result<Result<Bytes, Body>, hyper::Error> {
+    let mut buffered = BytesMut::new();
+    while let Some(data) = body.data().await {
+        buffered.extend_from_slice(&data?);
+        if buffered.len() > limit {
+            let read = futures::stream::once(async move { Ok(buffered.freeze()) });
+            return Ok(Err(Body::wrap_stream(read.chain(body))));
+        }
+    }
+    Ok(Ok(buffered.freeze()))
+}
+
+fn too_large(limit: usize) -> String { format!("message over {limit} bytes") }
+
+/// A response body copying its data frames, logged once it ends.
+struct LoggedBody {
+    inner:     BoxBody,
+    payload:   Vec<u8>,
+    /// The most bytes copied, the payload is dropped once it grows past.
+    limit:     usize,
+    oversized: bool,
+    method:    String,
+    render:    Render,
+    redacted:  Arc<HashSet<String>>,
+    logged:    bool,
+}
+
+impl LoggedBody {
+    fn copy(&mut self, data: &[u8]) {
+        if self.oversized {
+            return;
+        }
+        self.payload.extend_from_slice(data);
+        if self.payload.len() > self.limit {
+            self.oversized = true;
+            self.payload = Vec::new();
+        }
+    }
+
+    fn log(&mut self) {
+        // Trailers-only responses, e.g. errors, have no payload.
+        if self.logged || (self.payload.is_empty() && !self.oversized) {
+            return;
+        }
+        self.logged = true;
+        let rendered = if self.oversized {
+            Err(too_large(self.limit))
+        } else {
+            render_payload(&self.payload, self.render, &self.redacted)
+        };
+        log_payload(&self.method, "response", rendered);
+    }
+}
+
+impl HttpBody for LoggedBody {
+    type Data = Bytes;
+    type Error = Status;
+
+    fn poll_data(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Self::Data, Self::Error>>> {
+        let poll = Pin::new(&mut self.inner).poll_data(cx);
+        match &poll {
+            Poll::Ready(Some(Ok(data))) => {
+                let data = data.clone();
+                self.copy(&data);
+            }
+            Poll::Ready(None) => self.log(),
+            _ => {}
+        }
+        poll
+    }
+
+    fn poll_trailers(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Option<HeaderMap>, Self::Error>> {
+        // The data may not have been polled to its end.
+        self.log();
+        Pin::new(&mut self.inner).poll_trailers(cx)
+    }
+
+    fn is_end_stream(&self) -> bool { self.inner.is_end_stream() }
+
+    fn size_hint(&self) -> SizeHint { self.inner.size_hint() }
+}
+
+/// Returns how to render the request and response of `method`, `None` for
+/// methods that aren't rendered.
+fn renderers(method: &str) -> Option<(Render, Render)> {
+    let renderers: (Render, Render) = match method {
+        "/rsketch.v1.hello.Hello/Hello" => (render::<HelloRequest>, render::<HelloResponse>),
+        "/rsketch.v1.hello.Hello/ListGreetings" => (
+            render::<ListGreetingsRequest>,
+            render::<ListGreetingsResponse>,
+        ),
+        "/rsketch.v1.hello.Hello/Ping" => (render::<PingRequest>, render::<PingResponse>),
+        "/rsketch.v1.hello.Hello/GetInfo" => (render::<()>, render::<InfoResponse>),
+        "/rsketch.v2.hello.Hello/Hello" => (
+            render::<v2::hello::HelloRequest>,
+            render::<v2::hello::HelloResponse>,
+        ),
+        _ => return None,
+    };
+    Some(renderers)
+}
+
+fn render<M: Message + Default + Serialize>(message: &[u8]) -> Result<Value, String> {
+    let message = M::decode(message).map_err(|err| err.to_string())?;
+    serde_json::to_value(&message).map_err(|err| err.to_string())
+}
+
+/// Renders the single message of a unary body, redacting the `redacted`
+/// fields.
+fn render_payload(
+    payload: &[u8],
+    render: Render,
+    redacted: &HashSet<String>,
+) -> Result<String, String> {
+    let Some(header) = payload.get(..FRAME_HEADER_LEN) else {
+        return Err("truncated message".to_string());
+    };
+    if header[0] != 0 {
+        return Err("compressed message".to_string());
+    }
+    let len = u32::from_be_bytes([header[1], header[2], header[3], header[4]]) as usize;
+    let message = payload
+        .get(FRAME_HEADER_LEN..FRAME_HEADER_LEN + len)
+        .ok_or_else(|| "truncated message".to_string())?;
+    let mut value = render(message)?;
+    redact(&mut value, redacted);
+    Ok(value.to_string())
+}
+
+fn redact(value: &mut Value, redacted: &HashSet<String>) {
+    match value {
+        Value::Object(fields) => {
+            for (name, field) in fields {
+                if redacted.contains(name) {
+                    *field = Value::String(REDACTED.to_string());
+                } else {
+                    redact(field, redacted);
+                }
+            }
+        }
+        Value::Array(items) => items.iter_mut().for_each(|item| redact(item, redacted)),
+        _ => {}
+    }
+}
+
+fn log_payload(method: &str, kind: &str, rendered: Result<String, String>) {
+    match rendered {
+        Ok(payload) => info!(grpc.method = method, %payload, "rpc {kind}"),
+        Err(err) => warn!(
+            grpc.method = method,
+            "failed to render {kind} payload: {err}"
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        io,
+        sync::{Arc, Mutex},
+    };
+
+    use api::pb::{
+        v1::hello::hello_client::HelloClient, v2::hello::hello_client::HelloClient as HelloV2Client,
+    };
+    use tonic::Code;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    /// Collects the output of a subscriber.
+    #[derive(Clone, Default)]
+    struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+    impl Buffer {
+        /// Returns the lines mentioning a payload.
+        fn payload_lines(&self) -> Vec<String> {
+            let output = String::from_utf8(self.0.lock().unwrap().clone()).unwrap();
+            output
+                .lines()
+                .filter(|line| line.contains("payload"))
+                .map(ToString::to_string)
+                .collect()
+        }
+    }
+
+    impl io::Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> io::Result<()> { Ok(()) }
+    }
+
+    fn capture() -> (Buffer, tracing::subscriber::DefaultGuard) {
+        let buffer = Buffer::default();
+        let writer = buffer.clone();
+        let subscriber = tracing_subscriber::fmt()
+            .with_ansi(false)
+            .with_writer(move || writer.clone())
+            .finish();
+        (buffer, tracing::subscriber::set_default(subscriber))
+    }
+
+    // The subscriber is only installed on this thread, which the single
+    // threaded runtime runs the server on too.
+    #[tokio::test(flavor = "current_thread")]
+    async fn logs_hello_as_json_with_redacted_fields() {
+        let (buffer, _guard) = capture();
+        let logger = PayloadLoggingLayer::new().with_redacted("message");
+        let server = InProcessServer::start(Server::new("").with_payload_logger(logger));
+
+        let request = HelloRequest {
+            name: "Ada".to_string(),
+        };
+        let greeting = HelloClient::new(server.channel())
+            .hello(request)
+            .await
+            .unwrap()
+            .into_inner();
+        assert_eq!(greeting.message, "Hello, Ada");
+
+        let lines = buffer.payload_lines();
+        assert_eq!(lines.len(), 2, "{lines:?}");
+        assert!(lines[0].contains("rpc request"), "{lines:?}");
+        assert!(lines[0].contains(r#"payload={"name":"Ada"}"#), "{lines:?}");
+        assert!(lines[1].contains("rpc response"), "{lines:?}");
+        assert!(
+            lines[1].contains(r#"payload={"message":"[REDACTED]"}"#),
+            "{lines:?}"
+        );
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test(flavor = "current_thread")]
+    async fn renders_bytes_in_base64() {
+        let (buffer, _guard) = capture();
+        let server = InProcessServer::start(Server::new("").with_payload_logging(true));
+
+        let request = PingRequest {
+            payload: b"hi".to_vec(),
+        };
+        HelloClient::new(server.channel())
+            .ping(request)
+            .await
+            .unwrap();
+
+        let lines = buffer.payload_lines();
+        assert_eq!(lines.len(), 2, "{lines:?}");
+        for line in &lines {
+            assert!(line.contains(r#"payload={"payload":"aGk="}"#), "{lines:?}");
+        }
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test(flavor = "current_thread")]
+    async fn logs_v2_hello() {
+        let (buffer, _guard) = capture();
+        let server = InProcessServer::start(Server::new("").with_payload_logging(true));
+
+        let request = v2::hello::HelloRequest {
+            name: "Ada".to_string(),
+        };
+        HelloV2Client::new(server.channel())
+            .hello(request)
+            .await
+            .unwrap();
+
+        let lines = buffer.payload_lines();
+        assert_eq!(lines.len(), 2, "{lines:?}");
+        assert!(
+            lines[0].contains("/rsketch.v2.hello.Hello/Hello"),
+            "{lines:?}"
+        );
+        assert!(lines[0].contains(r#"payload={"name":"Ada"}"#), "{lines:?}");
+        assert!(lines[1].contains(r#""message":"Hello, Ada""#), "{lines:?}");
+        assert!(lines[1].contains(r#""servedAt":""#), "{lines:?}");
+        assert!(lines[1].contains(r#""serverVersion":""#), "{lines:?}");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test(flavor = "current_thread")]
+    async fn requests_over_the_size_limit_are_not_buffered() {
+        let (buffer, _guard) = capture();
+        let server = InProcessServer::start(
+            Server::new("")
+                .with_payload_logging(true)
+                .with_max_recv_msg_size(16),
+        );
+
+        let request = PingRequest {
+            payload: vec![7; 64],
+        };
+        let status = HelloClient::new(server.channel())
+            .ping(request)
+            .await
+            .unwrap_err();
+        assert_eq!(status.code(), Code::ResourceExhausted);
+
+        let lines = buffer.payload_lines();
+        assert_eq!(lines.len(), 1, "{lines:?}");
+        assert!(
+            lines[0].contains("failed to render request payload: message over 21 bytes"),
+            "{lines:?}"
+        );
+        server.shutdown().await.unwrap();
+    }
+}
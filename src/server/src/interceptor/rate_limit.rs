@@ -0,0 +1,210 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Token bucket rate limiting, rejecting calls over the limit with
+//! `ResourceExhausted`.
+
+use std::{
+    collections::HashMap,
+    sync::{Arc, Mutex},
+    task::{Context, Poll},
+    time::Instant,
+};
+
+use tonic::{body::BoxBody, Code};
+use tower::{Layer, Service};
+
+use super::BoxFuture;
+use crate::status::new_error_info;
+
+/// A bucket holding up to `burst` tokens, refilled at `rate` tokens per
+/// second.
+#[derive(Debug)]
+pub struct TokenBucket {
+    rate:  f64,
+    burst: f64,
+    state: Mutex<BucketState>,
+}
+
+#[derive(Debug)]
+struct BucketState {
+    tokens:      f64,
+    last_refill: Instant,
+}
+
+impl TokenBucket {
+    /// Creates a full bucket.
+    pub fn new(rate: f64, burst: u32) -> Self {
+        let burst = f64::from(burst.max(1));
+        Self {
+            rate,
+            burst,
+            state: Mutex::new(BucketState {
+                tokens:      burst,
+                last_refill: Instant::now(),
+            }),
+        }
+    }
+
+    /// Takes a token if one is available.
+    pub fn try_acquire(&self) -> bool {
+        let mut state = self.state.lock().unwrap_or_else(|e| e.into_inner());
+        let now = Instant::now();
+        let refill = now.duration_since(state.last_refill).as_secs_f64() * self.rate;
+        state.tokens = (state.tokens + refill).min(self.burst);
+        state.last_refill = now;
+
+        if state.tokens >= 1.0 {
+            state.tokens -= 1.0;
+            true
+        } else {
+            false
+        }
+    }
+}
+
+/// Limits the rate of incoming calls.
+///
+/// Methods given a limit of their own with [RateLimitLayer::with_method]
+/// only draw from it, every other method shares the global bucket.
+#[derive(Debug, Clone)]
+pub struct RateLimitLayer {
+    global:  Arc<TokenBucket>,
+    methods: HashMap<String, Arc<TokenBucket>>,
+}
+
+impl RateLimitLayer {
+    /// Allows `rps` calls per second on average with bursts of up to `burst`
+    /// calls.
+    pub fn new(rps: f64, burst: u32) -> Self {
+        Self {
+            global:  Arc::new(TokenBucket::new(rps, burst)),
+            methods: HashMap::new(),
+        }
+    }
+
+    /// Gives `method`, a full method like `/rsketch.v1.hello.Hello/Hello`,
+    /// its own limit instead of the global one.
+    pub fn with_method(mut self, method: impl Into<String>, rps: f64, burst: u32) -> Self {
+        self.methods
+            .insert(method.into(), Arc::new(TokenBucket::new(rps, burst)));
+        self
+    }
+
+    fn try_acquire(&self, method: &str) -> bool {
+        self.methods
+            .get(method)
+            .unwrap_or(&self.global)
+            .try_acquire()
+    }
+}
+
+impl<S> Layer<S> for RateLimitLayer {
+    type Service = RateLimitService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        RateLimitService {
+            inner,
+            limits: self.clone(),
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct RateLimitService<S> {
+    inner:  S,
+    limits: RateLimitLayer,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for RateLimitService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<ReqBody>) -> Self::Future {
+        if !self.limits.try_acquire(request.uri().path()) {
+            let status = new_error_info(
+                Code::ResourceExhausted,
+                "rate limit exceeded",
+                "RATE_LIMIT_EXCEEDED",
+            );
+            return Box::pin(async move { Ok(status.to_http()) });
+        }
+
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        Box::pin(inner.call(request))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest, PingRequest};
+    use tonic::transport::Channel;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    /// Fires `calls` Hello calls at once, returning how many were rejected
+    /// with `ResourceExhausted`.
+    async fn burst(channel: Channel, calls: usize) -> usize {
+        let calls = (0..calls).map(|_| {
+            let mut client = HelloClient::new(channel.clone());
+            async move { client.hello(HelloRequest::default()).await }
+        });
+        let results = futures::future::join_all(calls).await;
+        results
+            .iter()
+            .filter(|result| {
+                let code = result.as_ref().err().map(|status| status.code());
+                assert!(
+                    matches!(code, None | Some(Code::ResourceExhausted)),
+                    "{result:?}"
+                );
+                code.is_some()
+            })
+            .count()
+    }
+
+    #[tokio::test]
+    async fn rejects_calls_over_the_burst() {
+        // Too slow to refill a token during the test.
+        let server = InProcessServer::start(Server::new("").with_rate_limit(0.01, 3));
+        assert_eq!(burst(server.channel(), 5).await, 2);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn methods_with_their_own_limit_skip_the_global_one() {
+        let limits =
+            RateLimitLayer::new(0.01, 1).with_method("/rsketch.v1.hello.Hello/Ping", 0.01, 10);
+        let server = InProcessServer::start(Server::new("").with_rate_limiter(limits));
+        assert_eq!(burst(server.channel(), 3).await, 2);
+
+        let mut client = HelloClient::new(server.channel());
+        for _ in 0..5 {
+            client.ping(PingRequest::default()).await.unwrap();
+        }
+        server.shutdown().await.unwrap();
+    }
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Turns a panicking handler into an `Internal` error for that call instead
+//! of tearing down the client's connection.
+
+use std::{
+    any::Any,
+    fmt,
+    panic::AssertUnwindSafe,
+    sync::Arc,
+    task::{Context, Poll},
+};
+
+use futures::FutureExt;
+use tonic::{body::BoxBody, Status};
+use tower::{Layer, Service};
+use tracing::error;
+
+use super::BoxFuture;
+
+/// Builds the status returned for a panic from its payload.
+pub type PanicHandler = Arc<dyn Fn(&str, Box<dyn Any + Send>) -> Status + Send + Sync>;
+
+/// Recovers panics raised while handling an RPC.
+///
+/// By default the panic is logged and the client gets
+/// `Internal: internal error`, use [RecoveryLayer::with_handler] to return
+/// something else or to record it elsewhere. Backtraces are printed by the
+/// standard panic hook when `RUST_BACKTRACE` is set.
+#[derive(Clone)]
+pub struct RecoveryLayer {
+    handler: PanicHandler,
+}
+
+impl fmt::Debug for RecoveryLayer {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("RecoveryLayer").finish_non_exhaustive()
+    }
+}
+
+impl Default for RecoveryLayer {
+    fn default() -> Self {
+        Self {
+            handler: Arc::new(default_handler),
+        }
+    }
+}
+
+impl RecoveryLayer {
+    pub fn new() -> Self { Self::default() }
+
+    /// Replaces the default handler, it is given the full method and the
+    /// panic payload.
+    pub fn with_handler<F>(self, handler: F) -> Self
+    where
+        F: Fn(&str, Box<dyn Any + Send>) -> Status + Send + Sync + 'static,
+    {
+        Self {
+            handler: Arc::new(handler),
+        }
+    }
+}
+
+fn default_handler(method: &str, panic: Box<dyn Any + Send>) -> Status {
+    error!(
+        grpc.method = method,
+        "handler panicked: {}",
+        panic_message(panic.as_ref())
+    );
+    Status::internal("internal error")
+}
+
+/// Extracts the message of a `panic!`, which is either a `&str` or a
+/// `String`.
+pub fn panic_message(panic: &(dyn Any + Send)) -> &str {
+    panic
+        .downcast_ref::<&str>()
+        .copied()
+        .or_else(|| panic.downcast_ref::<String>().map(String::as_str))
+        .unwrap_or("<non-string panic payload>")
+}
+
+impl<S> Layer<S> for RecoveryLayer {
+    type Service = RecoveryService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        RecoveryService {
+            inner,
+            handler: self.handler.clone(),
+        }
+    }
+}
+
+#[derive(Clone)]
+pub struct RecoveryService<S> {
+    inner:   S,
+    handler: PanicHandler,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for RecoveryService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        let handler = self.handler.clone();
+        let method = request.uri().path().to_string();
+
+        // Handlers may panic while building the future as well as polling it.
+        let future = match std::panic::catch_unwind(AssertUnwindSafe(|| inner.call(request))) {
+            Ok(future) => future,
+            Err(panic) => {
+                let status = handler(&method, panic);
+                return Box::pin(async move { Ok(status.to_http()) });
+            }
+        };
+        Box::pin(async move {
+            match AssertUnwindSafe(future).catch_unwind().await {
+                Ok(result) => result,
+                Err(panic) => Ok(handler(&method, panic).to_http()),
+            }
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use tonic::{Code, Request};
+    use tower::ServiceExt;
+
+    use super::*;
+    use crate::{
+        in_process::InProcessServer,
+        interceptor::{GrpcRequest, GrpcService, Interceptor},
+        Server,
+    };
+
+    const PANIC_HEADER: &str = "x-test-panic";
+
+    /// Panics while handling calls carrying [PANIC_HEADER], standing in for
+    /// a panicking handler.
+    fn panicking() -> Interceptor {
+        Interceptor::new(tower::layer::layer_fn(|inner: GrpcService| {
+            tower::service_fn(move |request: GrpcRequest| {
+                let inner = inner.clone();
+                async move {
+                    if request.headers().contains_key(PANIC_HEADER) {
+                        panic!("test panic");
+                    }
+                    inner.oneshot(request).await
+                }
+            })
+        }))
+    }
+
+    fn panicking_request() -> Request<HelloRequest> {
+        let mut request = Request::new(HelloRequest::default());
+        request
+            .metadata_mut()
+            .insert(PANIC_HEADER, "1".parse().unwrap());
+        request
+    }
+
+    #[tokio::test]
+    async fn panic_becomes_internal_and_server_keeps_serving() {
+        let server = InProcessServer::start(Server::new("").with_interceptors([panicking()]));
+        let mut client = HelloClient::new(server.channel());
+
+        let status = client.hello(panicking_request()).await.unwrap_err();
+        assert_eq!(status.code(), Code::Internal);
+        assert_eq!(status.message(), "internal error");
+
+        let response = client.hello(HelloRequest::default()).await.unwrap();
+        assert_eq!(response.into_inner().message, "Hello, world");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn custom_handler_sets_the_status() {
+        let recovery = RecoveryLayer::new().with_handler(|method, panic| {
+            Status::unavailable(format!("{method}: {}", panic_message(panic.as_ref())))
+        });
+        let server = Server::new("")
+            .with_recovery(recovery)
+            .with_interceptors([panicking()]);
+        let server = InProcessServer::start(server);
+        let mut client = HelloClient::new(server.channel());
+
+        let status = client.hello(panicking_request()).await.unwrap_err();
+        assert_eq!(status.code(), Code::Unavailable);
+        assert_eq!(
+            status.message(),
+            "/rsketch.v1.hello.Hello/Hello: test panic"
+        );
+        server.shutdown().await.unwrap();
+    }
+}
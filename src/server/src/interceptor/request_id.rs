@@ -0,0 +1,216 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Request IDs correlating a call across services, taken from the caller's
+//! `x-request-id` metadata or generated when it has none.
+//!
+//! The ID is echoed back in the `x-request-id` response header and trailer,
+//! readable through the response metadata and, for streaming calls, the
+//! trailers of the stream. Calls failing before a response is produced only
+//! carry headers, which then hold the ID.
+
+use std::{
+    pin::Pin,
+    task::{Context, Poll},
+};
+
+use http::{HeaderMap, HeaderValue};
+use hyper::body::{Bytes, HttpBody, SizeHint};
+use rsketch_common::propagation::{new_request_id, REQUEST_ID_HEADER};
+use tonic::{body::BoxBody, Status};
+use tower::{Layer, Service};
+
+use super::BoxFuture;
+
+/// The longest caller supplied ID accepted, longer ones are replaced.
+const MAX_REQUEST_ID_LEN: usize = 128;
+
+/// The ID of the request being handled, see [RequestId::from_request].
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RequestId(String);
+
+impl RequestId {
+    /// Returns the ID of `request`, set when the server runs with request
+    /// IDs enabled.
+    pub fn from_request<T>(request: &tonic::Request<T>) -> Option<&Self> {
+        request.extensions().get::<Self>()
+    }
+
+    pub fn as_str(&self) -> &str { &self.0 }
+}
+
+/// Assigns every call a [RequestId].
+#[derive(Debug, Clone, Default)]
+pub struct RequestIdLayer;
+
+impl<S> Layer<S> for RequestIdLayer {
+    type Service = RequestIdService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service { RequestIdService { inner } }
+}
+
+#[derive(Debug, Clone)]
+pub struct RequestIdService<S> {
+    inner: S,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for RequestIdService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, mut request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+
+        let value = request
+            .headers()
+            .get(REQUEST_ID_HEADER)
+            .filter(|value| is_valid(value))
+            .cloned()
+            .unwrap_or_else(generate);
+        // Valid header values are visible ASCII, so this never falls back.
+        let id = RequestId(value.to_str().unwrap_or_default().to_string());
+        request
+            .headers_mut()
+            .insert(REQUEST_ID_HEADER, value.clone());
+        request.extensions_mut().insert(id);
+
+        Box::pin(async move {
+            let mut response = inner.call(request).await?;
+            response
+                .headers_mut()
+                .insert(REQUEST_ID_HEADER, value.clone());
+            Ok(response.map(|inner| tonic::body::boxed(RequestIdBody { inner, id: value })))
+        })
+    }
+}
+
+/// A response body adding the request ID to its trailers.
+struct RequestIdBody {
+    inner: BoxBody,
+    id:    HeaderValue,
+}
+
+impl HttpBody for RequestIdBody {
+    type Data = Bytes;
+    type Error = Status;
+
+    fn poll_data(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Option<Result<Self::Data, Self::Error>>> {
+        Pin::new(&mut self.inner).poll_data(cx)
+    }
+
+    fn poll_trailers(
+        self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+    ) -> Poll<Result<Option<HeaderMap>, Self::Error>> {
+        let this = self.get_mut();
+        let id = &this.id;
+        Pin::new(&mut this.inner)
+            .poll_trailers(cx)
+            .map_ok(|trailers| {
+                trailers.map(|mut trailers| {
+                    trailers.insert(REQUEST_ID_HEADER, id.clone());
+                    trailers
+                })
+            })
+    }
+
+    fn is_end_stream(&self) -> bool { self.inner.is_end_stream() }
+
+    fn size_hint(&self) -> SizeHint { self.inner.size_hint() }
+}
+
+fn is_valid(value: &HeaderValue) -> bool {
+    let len = value.as_bytes().len();
+    len > 0 && len <= MAX_REQUEST_ID_LEN && value.to_str().is_ok()
+}
+
+fn generate() -> HeaderValue {
+    HeaderValue::from_str(&new_request_id()).expect("UUIDs are valid header values")
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloStreamRequest};
+    use tonic::{metadata::MetadataMap, Request};
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    fn id(metadata: &MetadataMap) -> &str {
+        metadata.get(REQUEST_ID_HEADER).unwrap().to_str().unwrap()
+    }
+
+    /// Streams greetings for `request`, returning the response headers and
+    /// trailers.
+    async fn hello_stream(
+        server: &InProcessServer,
+        request: Request<HelloStreamRequest>,
+    ) -> (MetadataMap, MetadataMap) {
+        let mut client = HelloClient::new(server.channel());
+        let response = client.hello_stream(request).await.unwrap();
+        let headers = response.metadata().clone();
+        let mut stream = response.into_inner();
+        while stream.message().await.unwrap().is_some() {}
+        (headers, stream.trailers().await.unwrap().unwrap())
+    }
+
+    fn request(id: Option<&str>) -> Request<HelloStreamRequest> {
+        let mut request = Request::new(HelloStreamRequest {
+            names: vec!["Ada".to_string()],
+        });
+        if let Some(id) = id {
+            request
+                .metadata_mut()
+                .insert(REQUEST_ID_HEADER, id.parse().unwrap());
+        }
+        request
+    }
+
+    #[tokio::test]
+    async fn echoes_the_callers_id_in_headers_and_trailers() {
+        let server = InProcessServer::start(Server::new("").with_request_id(true));
+
+        let (headers, trailers) = hello_stream(&server, request(Some("call-42"))).await;
+        assert_eq!(id(&headers), "call-42");
+        assert_eq!(id(&trailers), "call-42");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn generates_an_id_for_calls_without_a_valid_one() {
+        let server = InProcessServer::start(Server::new("").with_request_id(true));
+
+        let too_long = "x".repeat(MAX_REQUEST_ID_LEN + 1);
+        for caller_id in [None, Some(too_long.as_str())] {
+            let (headers, trailers) = hello_stream(&server, request(caller_id)).await;
+            assert!(!id(&headers).is_empty());
+            assert_ne!(Some(id(&headers)), caller_id);
+            assert_eq!(id(&trailers), id(&headers));
+        }
+        server.shutdown().await.unwrap();
+    }
+}
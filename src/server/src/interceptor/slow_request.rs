@@ -0,0 +1,200 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! Warnings for RPCs taking longer than a threshold, to catch tail latency
+//! without logging every call.
+//!
+//! The duration covers the whole call, which for streaming methods ends once
+//! their last message is sent, like the latency of
+//! [metrics](super::metrics).
+
+use std::{
+    task::{Context, Poll},
+    time::{Duration, Instant},
+};
+
+use rsketch_common::propagation::REQUEST_ID_HEADER;
+use tonic::body::BoxBody;
+use tower::{Layer, Service};
+use tracing::warn;
+
+use super::{completion::on_end, peer_addr, BoxFuture};
+
+/// Logs a warning with the method, duration, status, peer and request ID of
+/// every RPC slower than the threshold.
+#[derive(Debug, Clone, Copy)]
+pub struct SlowRequestLayer {
+    threshold: Duration,
+}
+
+impl SlowRequestLayer {
+    pub fn new(threshold: Duration) -> Self { Self { threshold } }
+}
+
+impl<S> Layer<S> for SlowRequestLayer {
+    type Service = SlowRequestService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        SlowRequestService {
+            inner,
+            threshold: self.threshold,
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub struct SlowRequestService<S> {
+    inner:     S,
+    threshold: Duration,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for SlowRequestService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        let threshold = self.threshold;
+
+        // Cheap clones, only formatted for the rare slow call.
+        let uri = request.uri().clone();
+        let peer = peer_addr(&request);
+        let request_id = request.headers().get(REQUEST_ID_HEADER).cloned();
+
+        Box::pin(async move {
+            let start = Instant::now();
+            let response = inner.call(request).await?;
+            Ok(on_end(response, move |status| {
+                let duration = start.elapsed();
+                if duration <= threshold {
+                    return;
+                }
+                let peer = peer.map_or_else(|| "unknown".to_string(), |a| a.to_string());
+                let request_id = request_id
+                    .as_ref()
+                    .and_then(|value| value.to_str().ok())
+                    .unwrap_or_default();
+                warn!(
+                    grpc.method = uri.path(),
+                    grpc.code = ?status.code(),
+                    %peer,
+                    %request_id,
+                    ?duration,
+                    ?threshold,
+                    "slow rpc"
+                );
+            }))
+        })
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use std::{
+        io,
+        sync::{Arc, Mutex},
+    };
+
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use tokio::sync::mpsc;
+    use tokio_stream::wrappers::ReceiverStream;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    const THRESHOLD: Duration = Duration::from_millis(200);
+
+    /// Collects the output of a subscriber.
+    #[derive(Clone, Default)]
+    struct Buffer(Arc<Mutex<Vec<u8>>>);
+
+    impl Buffer {
+        /// Returns the lines of the `slow rpc` events.
+        fn slow_lines(&self) -> Vec<String> {
+            let output = String::from_utf8(self.0.lock().unwrap().clone()).unwrap();
+            output
+                .lines()
+                .filter(|line| line.contains("slow rpc"))
+                .map(ToString::to_string)
+                .collect()
+        }
+    }
+
+    impl io::Write for Buffer {
+        fn write(&mut self, buf: &[u8]) -> io::Result<usize> {
+            self.0.lock().unwrap().extend_from_slice(buf);
+            Ok(buf.len())
+        }
+
+        fn flush(&mut self) -> io::Result<()> { Ok(()) }
+    }
+
+    fn hello(name: &str) -> HelloRequest {
+        HelloRequest {
+            name: name.to_string(),
+        }
+    }
+
+    // The subscriber is only installed on this thread, which the single
+    // threaded runtime runs the server on too.
+    #[tokio::test(flavor = "current_thread")]
+    async fn logs_streams_slower_than_the_threshold_but_not_fast_calls() {
+        let buffer = Buffer::default();
+        let writer = buffer.clone();
+        let subscriber = tracing_subscriber::fmt()
+            .with_ansi(false)
+            .with_writer(move || writer.clone())
+            .finish();
+        let _guard = tracing::subscriber::set_default(subscriber);
+
+        let server = InProcessServer::start(Server::new("").with_slow_request_log(THRESHOLD));
+        let mut client = HelloClient::new(server.channel());
+        client.hello(hello("Ada")).await.unwrap();
+        assert_eq!(buffer.slow_lines(), Vec::<String>::new());
+
+        // The chat answers right away but only ends once the client is done.
+        let (names, rx) = mpsc::channel(1);
+        let mut replies = client
+            .hello_chat(ReceiverStream::new(rx))
+            .await
+            .unwrap()
+            .into_inner();
+        names.send(hello("Grace")).await.unwrap();
+        replies.message().await.unwrap().unwrap();
+        tokio::time::sleep(THRESHOLD).await;
+        assert_eq!(buffer.slow_lines(), Vec::<String>::new());
+        drop(names);
+        assert!(replies.message().await.unwrap().is_none());
+
+        let lines = buffer.slow_lines();
+        assert_eq!(lines.len(), 1, "{lines:?}");
+        assert!(
+            lines[0].contains("/rsketch.v1.hello.Hello/HelloChat"),
+            "{lines:?}"
+        );
+        assert!(lines[0].contains("grpc.code=Ok"), "{lines:?}");
+        server.shutdown().await.unwrap();
+    }
+}
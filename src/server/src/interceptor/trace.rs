@@ -0,0 +1,171 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//! OpenTelemetry spans for every RPC, continuing the trace propagated by the
+//! caller in the request metadata.
+//!
+//! Spans are plain [tracing] spans, they are exported through the
+//! OpenTelemetry layer installed in the subscriber, see
+//! [init_global_logging](rsketch_common::logger::init_global_logging). That
+//! layer's tracer provider is the one used, there is no provider per server,
+//! so server spans sit in the same trace as the logs of their handlers.
+//!
+//! A span lasts until the call ends, for streaming calls once the last
+//! message is sent, and records the final status, so streams failing midway
+//! are marked as errors too.
+
+use std::task::{Context, Poll};
+
+use opentelemetry::global;
+use rsketch_common::propagation::HeaderExtractor;
+use tonic::{body::BoxBody, Code, Status};
+use tower::{Layer, Service};
+use tracing::{field, Instrument, Span};
+use tracing_opentelemetry::OpenTelemetrySpanExt;
+
+use super::{completion::on_end, BoxFuture};
+
+/// Wraps every RPC in a server span named after the full method, e.g.
+/// `rsketch.v1.hello.Hello/Hello`, recording the resulting status code.
+#[derive(Debug, Clone, Default)]
+pub struct TraceLayer;
+
+impl<S> Layer<S> for TraceLayer {
+    type Service = TraceService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service { TraceService { inner } }
+}
+
+#[derive(Debug, Clone)]
+pub struct TraceService<S> {
+    inner: S,
+}
+
+impl<S, ReqBody> Service<http::Request<ReqBody>> for TraceService<S>
+where
+    S: Service<http::Request<ReqBody>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+    ReqBody: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<ReqBody>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+
+        let method = request.uri().path().trim_start_matches('/');
+        let span = tracing::info_span!(
+            "grpc.server",
+            otel.name = method,
+            otel.kind = "server",
+            otel.status_code = field::Empty,
+            otel.status_message = field::Empty,
+            rpc.system = "grpc",
+            rpc.grpc.status_code = field::Empty,
+        );
+        let parent = global::get_text_map_propagator(|propagator| {
+            propagator.extract(&HeaderExtractor(request.headers()))
+        });
+        span.set_parent(parent);
+
+        Box::pin(
+            async move {
+                // Held until the call ends, which closes the span.
+                let span = Span::current();
+                match inner.call(request).await {
+                    Ok(response) => Ok(on_end(response, move |status| record(&span, status))),
+                    Err(err) => {
+                        record(&span, &Status::unknown("service failed"));
+                        Err(err)
+                    }
+                }
+            }
+            .instrument(span),
+        )
+    }
+}
+
+/// Records the final `status` of a call on its span.
+fn record(span: &Span, status: &Status) {
+    span.record("rpc.grpc.status_code", status.code() as i32);
+    if status.code() != Code::Ok {
+        span.record("otel.status_code", "ERROR");
+        span.record("otel.status_message", status.message());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::v1::hello::{hello_client::HelloClient, HelloRequest};
+    use opentelemetry::trace::{Status as SpanStatus, TracerProvider as _};
+    use opentelemetry_sdk::{testing::trace::InMemorySpanExporter, trace::TracerProvider};
+    use tracing_subscriber::layer::SubscriberExt;
+
+    use crate::{in_process::InProcessServer, Server};
+
+    fn hello(name: &str) -> HelloRequest {
+        HelloRequest {
+            name: name.to_string(),
+        }
+    }
+
+    // The subscriber is only installed on this thread, which the single
+    // threaded runtime runs the server on too.
+    #[tokio::test(flavor = "current_thread")]
+    async fn marks_streams_failing_midway_as_errors() {
+        let exporter = InMemorySpanExporter::default();
+        let provider = TracerProvider::builder()
+            .with_simple_exporter(exporter.clone())
+            .build();
+        let subscriber = tracing_subscriber::registry()
+            .with(tracing_opentelemetry::layer().with_tracer(provider.tracer("test")));
+        let _guard = tracing::subscriber::set_default(subscriber);
+
+        let server = InProcessServer::start(Server::new("").with_tracing(true));
+        let mut client = HelloClient::new(server.channel());
+        let names = ["Ada", "bell\u{7}"].map(hello);
+        let mut replies = client
+            .hello_chat(tokio_stream::iter(names))
+            .await
+            .unwrap()
+            .into_inner();
+        replies.message().await.unwrap().unwrap();
+        replies.message().await.unwrap_err();
+        server.shutdown().await.unwrap();
+        provider.force_flush();
+
+        let spans = exporter.get_finished_spans().unwrap();
+        let span = spans
+            .iter()
+            .find(|span| span.name == "rsketch.v1.hello.Hello/HelloChat")
+            .unwrap_or_else(|| panic!("no chat span in {spans:?}"));
+        assert!(
+            matches!(span.status, SpanStatus::Error { .. }),
+            "{:?}",
+            span.status
+        );
+        let code = span
+            .attributes
+            .iter()
+            .find(|kv| kv.key.as_str() == "rpc.grpc.status_code")
+            .map(|kv| kv.value.to_string());
+        assert_eq!(code.as_deref(), Some("3"));
+    }
+}
@@ -0,0 +1,349 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Validates request messages against the constraints documented in the
+//! protos, see [api::validate], before they reach their handler.
+//!
+//! The request body of every call to a method with constrained messages is
+//! followed message by message as it streams in. Each message is decoded,
+//! after decompressing it if it is gzip encoded, and checked, and only
+//! passed on once it is valid. The first invalid message fails the body with
+//! `InvalidArgument`, detailing the violated fields in a `BadRequest`, which
+//! tonic hands the handler in place of the message: unary and server
+//! streaming calls fail before their handler runs, `HelloChat` gets the
+//! status from its request stream.
+//!
+//! Messages that can't be decoded, or exceed the size limit, are passed on
+//! untouched for tonic to reject.
+
+use std::{
+    io::Read,
+    pin::Pin,
+    task::{Context, Poll},
+};
+
+use api::{
+    pb::{
+        v1::hello::{HelloRequest, HelloStreamRequest},
+        v2,
+    },
+    validate::Validate,
+};
+use bytes::BytesMut;
+use flate2::read::GzDecoder;
+use futures::Stream;
+use hyper::body::{Bytes, HttpBody};
+use prost::Message;
+use tonic::{body::BoxBody, transport::Body, Status};
+use tower::{Layer, Service};
+
+use super::{BoxFuture, FRAME_HEADER_LEN};
+use crate::status::bad_request;
+
+/// tonic's default limit on the size of the messages a service decodes.
+pub(crate) const DEFAULT_MAX_MESSAGE_SIZE: usize = 4 * 1024 * 1024;
+
+/// Flags a compressed message in its prefix.
+const COMPRESSED: u8 = 1;
+
+/// Returns the violations of a message, `None` if it is valid or doesn't
+/// decode.
+type Check = fn(&[u8]) -> Option<Status>;
+
+/// Validates the messages of requests to the methods known to be
+/// constrained, up to `max_message_size` bytes each.
+#[derive(Debug, Clone, Copy)]
+pub(crate) struct ValidateLayer {
+    max_message_size: usize,
+}
+
+impl ValidateLayer {
+    pub(crate) fn new(max_message_size: usize) -> Self { Self { max_message_size } }
+}
+
+impl Default for ValidateLayer {
+    fn default() -> Self { Self::new(DEFAULT_MAX_MESSAGE_SIZE) }
+}
+
+impl<S> Layer<S> for ValidateLayer {
+    type Service = ValidateService<S>;
+
+    fn layer(&self, inner: S) -> Self::Service {
+        ValidateService {
+            inner,
+            max_message_size: self.max_message_size,
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+pub(crate) struct ValidateService<S> {
+    inner:            S,
+    max_message_size: usize,
+}
+
+impl<S> Service<http::Request<Body>> for ValidateService<S>
+where
+    S: Service<http::Request<Body>, Response = http::Response<BoxBody>> + Clone + Send + 'static,
+    S::Future: Send + 'static,
+{
+    type Error = S::Error;
+    type Future = BoxFuture<Result<Self::Response, Self::Error>>;
+    type Response = S::Response;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        self.inner.poll_ready(cx)
+    }
+
+    fn call(&mut self, request: http::Request<Body>) -> Self::Future {
+        let clone = self.inner.clone();
+        let mut inner = std::mem::replace(&mut self.inner, clone);
+        let Some(check) = check_for(request.uri().path()) else {
+            return Box::pin(inner.call(request));
+        };
+        let gzip = request
+            .headers()
+            .get("grpc-encoding")
+            .is_some_and(|encoding| encoding == "gzip");
+        let request = request.map(|body| {
+            Body::wrap_stream(ValidatedBody {
+                inner: body,
+                buffer: BytesMut::new(),
+                check,
+                gzip,
+                max_message_size: self.max_message_size,
+                unchecked: false,
+                violation: None,
+                failed: false,
+            })
+        });
+        Box::pin(inner.call(request))
+    }
+}
+
+/// Returns how to check the messages sent to `method`, `None` for methods
+/// without constraints.
+fn check_for(method: &str) -> Option<Check> {
+    let check: Check = match method {
+        "/rsketch.v1.hello.Hello/Hello" | "/rsketch.v1.hello.Hello/HelloChat" => {
+            check::<HelloRequest>
+        }
+        "/rsketch.v1.hello.Hello/HelloStream" => check::<HelloStreamRequest>,
+        "/rsketch.v2.hello.Hello/Hello" => check::<v2::hello::HelloRequest>,
+        _ => return None,
+    };
+    Some(check)
+}
+
+fn check<M: Message + Default + Validate>(message: &[u8]) -> Option<Status> {
+    let message = M::decode(message).ok()?;
+    let violations = message.validate().err()?;
+    Some(bad_request(&violations))
+}
+
+/// A request body passing on its messages once they are found valid.
+struct ValidatedBody {
+    inner:            Body,
+    /// Data received but not passed on yet, starting at a message.
+    buffer:           BytesMut,
+    check:            Check,
+    /// Whether compressed messages are gzip encoded.
+    gzip:             bool,
+    max_message_size: usize,
+    /// Set once a message over the size limit is found, passing everything
+    /// from then on untouched.
+    unchecked:        bool,
+    /// The status of the first invalid message, reported once the messages
+    /// before it have been passed on.
+    violation:        Option<Status>,
+    failed:           bool,
+}
+
+impl ValidatedBody {
+    /// Splits the valid complete messages off the buffer, stopping at the
+    /// first invalid one.
+    fn checked(&mut self) -> Bytes {
+        let mut checked = 0;
+        while !self.unchecked {
+            let rest = &self.buffer[checked..];
+            let Some(header) = rest.get(..FRAME_HEADER_LEN) else {
+                break;
+            };
+            let len = u32::from_be_bytes([header[1], header[2], header[3], header[4]]) as usize;
+            if len > self.max_message_size {
+                self.unchecked = true;
+                break;
+            }
+            let Some(message) = rest.get(FRAME_HEADER_LEN..FRAME_HEADER_LEN + len) else {
+                break;
+            };
+            if let Some(status) = self.violations(header[0], message) {
+                self.violation = Some(status);
+                break;
+            }
+            checked += FRAME_HEADER_LEN + len;
+        }
+        let checked = if self.unchecked {
+            self.buffer.len()
+        } else {
+            checked
+        };
+        self.buffer.split_to(checked).freeze()
+    }
+
+    fn violations(&self, flags: u8, message: &[u8]) -> Option<Status> {
+        if flags & COMPRESSED == 0 {
+            return (self.check)(message);
+        }
+        // Anything but gzip is rejected by tonic.
+        if !self.gzip {
+            return None;
+        }
+        let mut decompressed = Vec::new();
+        let limit = self.max_message_size as u64 + 1;
+        GzDecoder::new(message)
+            .take(limit)
+            .read_to_end(&mut decompressed)
+            .ok()?;
+        if decompressed.len() > self.max_message_size {
+            return None;
+        }
+        (self.check)(&decompressed)
+    }
+}
+
+impl Stream for ValidatedBody {
+    type Item = Result<Bytes, Box<dyn std::error::Error + Send + Sync>>;
+
+    fn poll_next(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<Option<Self::Item>> {
+        loop {
+            if self.failed {
+                return Poll::Ready(None);
+            }
+            if let Some(status) = self.violation.take() {
+                self.failed = true;
+                return Poll::Ready(Some(Err(status.into())));
+            }
+            match Pin::new(&mut self.inner).poll_data(cx) {
+                Poll::Ready(Some(Ok(data))) => self.buffer.extend_from_slice(&data),
+                Poll::Ready(Some(Err(err))) => return Poll::Ready(Some(Err(err.into()))),
+                // A truncated message left over is for tonic to report.
+                Poll::Ready(None) if !self.buffer.is_empty() => {
+                    let rest = self.buffer.split().freeze();
+                    return Poll::Ready(Some(Ok(rest)));
+                }
+                Poll::Ready(None) => return Poll::Ready(None),
+                Poll::Pending => return Poll::Pending,
+            }
+            let checked = self.checked();
+            if !checked.is_empty() {
+                return Poll::Ready(Some(Ok(checked)));
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::{
+        pb::v1::hello::{hello_client::HelloClient, PingRequest},
+        validate::MAX_NAME_LEN,
+    };
+    use tonic::{codec::CompressionEncoding, Code};
+    use tonic_types::StatusExt;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    fn hello(name: &str) -> HelloRequest {
+        HelloRequest {
+            name: name.to_string(),
+        }
+    }
+
+    fn too_long() -> String { "n".repeat(MAX_NAME_LEN + 1) }
+
+    fn assert_invalid_name(status: &Status, field: &str) {
+        assert_eq!(status.code(), Code::InvalidArgument, "{status:?}");
+        let details = status.get_details_bad_request().unwrap();
+        assert_eq!(details.field_violations.len(), 1);
+        assert_eq!(details.field_violations[0].field, field);
+    }
+
+    #[test]
+    fn checks_only_constrained_methods() {
+        assert!(check_for("/rsketch.v1.hello.Hello/Hello").is_some());
+        assert!(check_for("/rsketch.v2.hello.Hello/Hello").is_some());
+        assert!(check_for("/rsketch.v1.hello.Hello/Ping").is_none());
+        assert!(check_for("/grpc.health.v1.Health/Check").is_none());
+
+        let check = check_for("/rsketch.v1.hello.Hello/HelloStream").unwrap();
+        let request = HelloStreamRequest {
+            names: vec!["Ada".to_string(), too_long()],
+        };
+        let status = check(&request.encode_to_vec()).unwrap();
+        assert_invalid_name(&status, "names[1]");
+    }
+
+    #[tokio::test]
+    async fn rejects_invalid_messages_before_the_handler() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel());
+
+        let status = client.hello(hello(&too_long())).await.unwrap_err();
+        assert_invalid_name(&status, "name");
+        let request = HelloStreamRequest {
+            names: vec!["Ada".to_string(), "bell\u{7}".to_string()],
+        };
+        let status = client.hello_stream(request).await.unwrap_err();
+        assert_invalid_name(&status, "names[1]");
+
+        // Unconstrained methods are left alone.
+        let ping = PingRequest {
+            payload: b"ping".to_vec(),
+        };
+        client.ping(ping).await.unwrap();
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn rejects_invalid_messages_midway_through_a_chat() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel());
+
+        let names = ["Ada", "bell\u{7}", "Grace"].map(hello);
+        let mut replies = client
+            .hello_chat(tokio_stream::iter(names))
+            .await
+            .unwrap()
+            .into_inner();
+        let reply = replies.message().await.unwrap().unwrap();
+        assert_eq!(reply.message, "Hello, Ada");
+        let status = replies.message().await.unwrap_err();
+        assert_invalid_name(&status, "name");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn validates_compressed_messages() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel())
+            .send_compressed(CompressionEncoding::Gzip)
+            .accept_compressed(CompressionEncoding::Gzip);
+
+        let status = client.hello(hello(&too_long())).await.unwrap_err();
+        assert_invalid_name(&status, "name");
+        client.hello(hello("Ada")).await.unwrap();
+        server.shutdown().await.unwrap();
+    }
+}
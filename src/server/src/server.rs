@@ -0,0 +1,1385 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::{
+    convert::Infallible,
+    fmt,
+    future::Future,
+    path::{Path, PathBuf},
+    sync::{
+        atomic::{AtomicBool, Ordering},
+        Arc,
+    },
+    time::Duration,
+};
+
+use api::pb::{
+    v1::hello::hello_server::HelloServer, v2::hello::hello_server::HelloServer as HelloV2Server,
+};
+use futures::future::BoxFuture;
+use prometheus::Registry;
+use snafu::{ensure, OptionExt, ResultExt};
+#[cfg(unix)]
+use tokio::net::UnixListener;
+use tokio::{
+    io::{AsyncRead, AsyncWrite},
+    net::TcpListener,
+    sync::watch,
+    task::JoinHandle,
+    time::Instant,
+};
+use tokio_rustls::{
+    rustls::{
+        pki_types::{CertificateDer, PrivateKeyDer},
+        server::WebPkiClientVerifier,
+        RootCertStore, ServerConfig,
+    },
+    TlsAcceptor,
+};
+#[cfg(unix)]
+use tokio_stream::wrappers::UnixListenerStream;
+use tokio_stream::{wrappers::TcpListenerStream, Stream};
+use tonic::{
+    body::BoxBody,
+    codec::CompressionEncoding,
+    server::NamedService,
+    transport::{
+        server::{Connected, Routes},
+        Body,
+    },
+    Status,
+};
+use tower::{Layer, Service, ServiceExt};
+use tracing::{info, warn};
+
+use crate::{
+    admin,
+    build_info::BuildInfo,
+    connection,
+    error::{
+        BindSnafu, ClientCaSnafu, DrainTimeoutSnafu, InvalidPemSnafu, MetricsSnafu,
+        MissingPemSnafu, ReadTlsSnafu, ReflectionSnafu, Result, ServerTaskSnafu, ShutdownHookError,
+        ShutdownHooksSnafu, TlsConfigSnafu, UnknownMethodSnafu,
+    },
+    health::HealthHandle,
+    interceptor::{
+        auth::AuthLayer,
+        authorize::{AuthorizeLayer, Authorizer},
+        deadline::DeadlineLayer,
+        identity::IdentityLayer,
+        logging::LoggingLayer,
+        metrics::MetricsLayer,
+        payload::PayloadLoggingLayer,
+        rate_limit::RateLimitLayer,
+        recovery::RecoveryLayer,
+        request_id::RequestIdLayer,
+        slow_request::SlowRequestLayer,
+        trace::TraceLayer,
+        validate::{ValidateLayer, DEFAULT_MAX_MESSAGE_SIZE},
+        GrpcService, Interceptor, Interceptors,
+    },
+    service::{HelloService, HelloV2Service},
+};
+
+/// How long in-flight requests get to finish once shutdown begins.
+pub const DEFAULT_DRAIN_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// HTTP/2 keepalive pings the server sends on its connections and the
+/// limits on how long connections stay open.
+///
+/// Peers that don't acknowledge a ping within `timeout` are disconnected,
+/// which clears out dead connections that would otherwise accumulate.
+/// Connections left idle or open for too long are closed gracefully: the
+/// client is sent a GOAWAY, so it reconnects for its next calls, spreading
+/// clients over the servers behind a load balancer, while the calls in
+/// flight finish.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct Keepalive {
+    /// How often to ping, `None` disables pings.
+    pub interval:                 Option<Duration>,
+    /// How long to wait for a ping to be acknowledged.
+    pub timeout:                  Option<Duration>,
+    /// How long a connection may go without calls in flight, `None` keeps
+    /// idle connections open.
+    pub max_connection_idle:      Option<Duration>,
+    /// How long a connection may stay open, `None` for no limit. Calls in
+    /// flight are let finish first.
+    pub max_connection_age:       Option<Duration>,
+    /// How long calls in flight get to finish once a connection has reached
+    /// its maximum age, `None` waits for them indefinitely.
+    pub max_connection_age_grace: Option<Duration>,
+}
+
+impl Default for Keepalive {
+    /// Pings every 2 hours and waits 20 seconds, and closes connections
+    /// idle for 5 minutes or open for 2 hours.
+    fn default() -> Self {
+        Self {
+            interval:                 Some(Duration::from_secs(2 * 60 * 60)),
+            timeout:                  Some(Duration::from_secs(20)),
+            max_connection_idle:      Some(Duration::from_secs(5 * 60)),
+            max_connection_age:       Some(Duration::from_secs(2 * 60 * 60)),
+            max_connection_age_grace: None,
+        }
+    }
+}
+
+/// Size limits on the messages a service decodes and encodes, `None` keeps
+/// tonic's defaults of 4 MiB and unlimited respectively.
+#[derive(Debug, Clone, Copy, Default)]
+struct MessageLimits {
+    recv: Option<usize>,
+    send: Option<usize>,
+}
+
+/// Mounts a type erased service onto the routes.
+type AddService = Box<dyn FnOnce(Routes) -> Routes + Send>;
+
+/// A service mounted through [Server::with_service].
+struct Registration {
+    name: &'static str,
+    add:  AddService,
+}
+
+impl Registration {
+    fn new<S>(service: S) -> Self
+    where
+        S: Service<http::Request<Body>, Response = http::Response<BoxBody>, Error = Infallible>
+            + NamedService
+            + Clone
+            + Send
+            + 'static,
+        S::Future: Send + 'static,
+    {
+        Self {
+            name: S::NAME,
+            add:  Box::new(move |routes| routes.add_service(service)),
+        }
+    }
+}
+
+/// Cleanup run once the server has drained, see [Server::with_shutdown_hook].
+type ShutdownHook =
+    Box<dyn FnOnce() -> BoxFuture<'static, std::result::Result<(), ShutdownHookError>> + Send>;
+
+/// A gRPC server hosting the rsketch services.
+pub struct Server {
+    addr:           String,
+    listener:       Option<TcpListener>,
+    drain_timeout:  Duration,
+    keepalive:      Keepalive,
+    limits:         MessageLimits,
+    tls:            Option<Arc<ServerConfig>>,
+    reflection:     bool,
+    build_info:     BuildInfo,
+    interceptors:   Interceptors,
+    metrics:        Option<Registry>,
+    metrics_addr:   Option<String>,
+    services:       Vec<Registration>,
+    shutdown_hooks: Vec<ShutdownHook>,
+    ready:          Arc<AtomicBool>,
+    health:         HealthHandle,
+    health_service: AddService,
+}
+
+impl fmt::Debug for Server {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.debug_struct("Server")
+            .field("addr", &self.addr)
+            .field("listener", &self.listener)
+            .field("drain_timeout", &self.drain_timeout)
+            .field("keepalive", &self.keepalive)
+            .field("limits", &self.limits)
+            .field("tls", &self.tls.is_some())
+            .field("reflection", &self.reflection)
+            .field("metrics", &self.metrics.is_some())
+            .field("metrics_addr", &self.metrics_addr)
+            .field(
+                "services",
+                &self.services.iter().map(|s| s.name).collect::<Vec<_>>(),
+            )
+            .field("shutdown_hooks", &self.shutdown_hooks.len())
+            .finish_non_exhaustive()
+    }
+}
+
+impl Server {
+    pub fn new(addr: impl Into<String>) -> Self {
+        let (reporter, health_service) = tonic_health::server::health_reporter();
+        Self {
+            addr:           addr.into(),
+            listener:       None,
+            drain_timeout:  DEFAULT_DRAIN_TIMEOUT,
+            keepalive:      Keepalive::default(),
+            limits:         MessageLimits::default(),
+            tls:            None,
+            reflection:     false,
+            build_info:     BuildInfo::default(),
+            interceptors:   Interceptors::default(),
+            metrics:        None,
+            metrics_addr:   None,
+            services:       Vec::new(),
+            shutdown_hooks: Vec::new(),
+            ready:          Arc::default(),
+            health:         HealthHandle::new(reporter),
+            health_service: Box::new(move |routes| routes.add_service(health_service)),
+        }
+    }
+
+    /// Mounts another gRPC service, e.g. a generated `FooServer`, behind the
+    /// same listener and interceptors as the built-in Hello service.
+    ///
+    /// The health service reports each mounted service under its full name,
+    /// serving while the server runs. Reflection only covers the rsketch
+    /// services.
+    ///
+    /// Deadlines treat its methods as unary, declare the streaming ones with
+    /// [Server::with_streaming_methods].
+    pub fn with_service<S>(mut self, service: S) -> Self
+    where
+        S: Service<http::Request<Body>, Response = http::Response<BoxBody>, Error = Infallible>
+            + NamedService
+            + Clone
+            + Send
+            + 'static,
+        S::Future: Send + 'static,
+    {
+        self.services.push(Registration::new(service));
+        self
+    }
+
+    /// Registers cleanup, e.g. flushing metrics or closing a database, to run
+    /// once [Server::run] has drained and before it returns.
+    ///
+    /// Hooks run however serving ends, also when it fails or the server
+    /// can't start. They run one at a time in reverse registration order,
+    /// bounded by the same deadline as draining, so they get whatever time
+    /// draining left of the drain timeout. A failing or timed out hook is
+    /// logged and doesn't stop the others from running, the failures are
+    /// returned together as
+    /// [ShutdownHooks](crate::error::Error::ShutdownHooks).
+    pub fn with_shutdown_hook<F, Fut>(mut self, hook: F) -> Self
+    where
+        F: FnOnce() -> Fut + Send + 'static,
+        Fut: Future<Output = std::result::Result<(), ShutdownHookError>> + Send + 'static,
+    {
+        self.shutdown_hooks.push(Box::new(move || Box::pin(hook())));
+        self
+    }
+
+    /// Returns a handle for flipping the statuses reported by the
+    /// `grpc.health.v1.Health` service, usable while [Server::run] is
+    /// serving.
+    pub fn health(&self) -> HealthHandle { self.health.clone() }
+
+    /// Makes [Server::run] serve on `listener` instead of binding the
+    /// configured address, e.g. one bound to port 0 whose port is read back,
+    /// or a socket inherited from systemd through
+    /// [TcpListener::from_std].
+    ///
+    /// The listener wins over the address, which is logged as ignored unless
+    /// empty.
+    pub fn with_listener(self, listener: TcpListener) -> Self {
+        Self {
+            listener: Some(listener),
+            ..self
+        }
+    }
+
+    /// Bounds how long [Server::run] waits for in-flight requests after
+    /// shutdown is requested before closing the remaining connections.
+    pub fn with_drain_timeout(self, drain_timeout: Duration) -> Self {
+        Self {
+            drain_timeout,
+            ..self
+        }
+    }
+
+    /// Replaces the default keepalive pings, see [Keepalive].
+    pub fn with_keepalive(self, keepalive: Keepalive) -> Self { Self { keepalive, ..self } }
+
+    /// Rejects requests larger than `limit` bytes in place of the 4 MiB
+    /// default.
+    ///
+    /// Oversized requests fail with `ResourceExhausted`, as do oversized
+    /// responses under [Server::with_max_send_msg_size].
+    pub fn with_max_recv_msg_size(self, limit: usize) -> Self {
+        Self {
+            limits: MessageLimits {
+                recv: Some(limit),
+                ..self.limits
+            },
+            ..self
+        }
+    }
+
+    /// Fails responses larger than `limit` bytes instead of sending them.
+    pub fn with_max_send_msg_size(self, limit: usize) -> Self {
+        Self {
+            limits: MessageLimits {
+                send: Some(limit),
+                ..self.limits
+            },
+            ..self
+        }
+    }
+
+    /// Serves over TLS using the PEM encoded certificate chain and private
+    /// key read from the given files.
+    pub fn with_tls(self, cert_file: impl AsRef<Path>, key_file: impl AsRef<Path>) -> Result<Self> {
+        let tls = tls_config(&read_pem(cert_file)?, &read_pem(key_file)?, None)?;
+        Ok(Self {
+            tls: Some(tls),
+            ..self
+        })
+    }
+
+    /// Serves over TLS like [Server::with_tls], taking the PEM encoded
+    /// certificate chain and private key as bytes, e.g. injected through the
+    /// environment, instead of reading them from files.
+    ///
+    /// Fails if either doesn't hold a valid PEM block of its kind.
+    pub fn with_tls_from_pem(
+        self,
+        cert_pem: impl AsRef<[u8]>,
+        key_pem: impl AsRef<[u8]>,
+    ) -> Result<Self> {
+        let tls = tls_config(cert_pem.as_ref(), key_pem.as_ref(), None)?;
+        Ok(Self {
+            tls: Some(tls),
+            ..self
+        })
+    }
+
+    /// Serves over mutual TLS, like [Server::with_tls] but additionally
+    /// requiring every client to present a certificate signed by the CA read
+    /// from `client_ca_file`.
+    ///
+    /// Connections without a valid client certificate fail the handshake.
+    /// The [Identity](crate::interceptor::identity::Identity) read from the
+    /// certificate is attached to every request.
+    pub fn with_mtls(
+        self,
+        cert_file: impl AsRef<Path>,
+        key_file: impl AsRef<Path>,
+        client_ca_file: impl AsRef<Path>,
+    ) -> Result<Self> {
+        let client_ca = read_pem(client_ca_file)?;
+        let tls = tls_config(
+            &read_pem(cert_file)?,
+            &read_pem(key_file)?,
+            Some(&client_ca),
+        )?;
+        Ok(Self {
+            interceptors: Interceptors {
+                identity: Some(IdentityLayer),
+                ..self.interceptors
+            },
+            tls: Some(tls),
+            ..self
+        })
+    }
+
+    /// Enables the gRPC server reflection service so tools like `grpcurl` can
+    /// discover the hosted services without the protos at hand.
+    ///
+    /// Off by default, leave it disabled in production.
+    pub fn with_reflection(self, reflection: bool) -> Self { Self { reflection, ..self } }
+
+    /// Sets what the `GetInfo` RPC reports about the server, see
+    /// [BuildInfo].
+    pub fn with_build_info(self, build_info: BuildInfo) -> Self { Self { build_info, ..self } }
+
+    /// Records per-method request counts, in-flight calls and latencies into
+    /// `registry`.
+    ///
+    /// Fails if `registry` already holds the server metrics.
+    pub fn with_metrics(self, registry: Registry) -> Result<Self> {
+        let metrics = MetricsLayer::new(&registry).context(MetricsSnafu)?;
+        Ok(Self {
+            interceptors: Interceptors {
+                metrics: Some(metrics),
+                ..self.interceptors
+            },
+            metrics: Some(registry),
+            ..self
+        })
+    }
+
+    /// Replaces the panic recovery applied to every RPC, which by default
+    /// answers a panicking handler with `Internal`, see [RecoveryLayer].
+    pub fn with_recovery(self, recovery: RecoveryLayer) -> Self {
+        Self {
+            interceptors: Interceptors {
+                recovery: Some(recovery),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Enables the interceptors the `rsketch` binary serves with on top of
+    /// the ones on by default: [logging](Server::with_logging) and
+    /// [request IDs](Server::with_request_id).
+    ///
+    /// Tests running a server through
+    /// [InProcessServer](crate::in_process::InProcessServer) use this to see
+    /// the same interceptor chain as production.
+    pub fn with_default_interceptors(self) -> Self {
+        self.with_logging(LoggingLayer::new()).with_request_id(true)
+    }
+
+    /// Logs every completed RPC through `logging`, see [LoggingLayer].
+    pub fn with_logging(self, logging: LoggingLayer) -> Self {
+        Self {
+            interceptors: Interceptors {
+                logging: Some(logging),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Logs the request and response payloads of the unary Hello methods, of
+    /// both API versions, as JSON when enabled, off by default. Meant for
+    /// debugging only, see [PayloadLoggingLayer].
+    pub fn with_payload_logging(self, enabled: bool) -> Self {
+        Self {
+            interceptors: Interceptors {
+                payload: enabled.then(PayloadLoggingLayer::new),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Logs payloads through `payload`, which allows redacting fields, see
+    /// [PayloadLoggingLayer::with_redacted].
+    pub fn with_payload_logger(self, payload: PayloadLoggingLayer) -> Self {
+        Self {
+            interceptors: Interceptors {
+                payload: Some(payload),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Limits incoming calls to `rps` per second on average with bursts of up
+    /// to `burst`, rejecting the excess with `ResourceExhausted`.
+    pub fn with_rate_limit(self, rps: f64, burst: u32) -> Self {
+        self.with_rate_limiter(RateLimitLayer::new(rps, burst))
+    }
+
+    /// Limits incoming calls through `rate_limit`, which allows per-method
+    /// limits, see [RateLimitLayer::with_method].
+    pub fn with_rate_limiter(self, rate_limit: RateLimitLayer) -> Self {
+        Self {
+            interceptors: Interceptors {
+                rate_limit: Some(rate_limit),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Requires every call to carry a bearer token accepted by `auth`, see
+    /// [AuthLayer].
+    pub fn with_auth(self, auth: AuthLayer) -> Self {
+        Self {
+            interceptors: Interceptors {
+                auth: Some(auth),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Rejects calls `authorizer` disallows with `PermissionDenied`, see
+    /// [AuthorizeLayer]. Every call is allowed by default.
+    pub fn with_authorizer(self, authorizer: impl Authorizer) -> Self {
+        Self {
+            interceptors: Interceptors {
+                authorize: Some(AuthorizeLayer::new(authorizer)),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Rejects unary calls that arrive without a deadline with
+    /// `InvalidArgument`, by default they're only logged.
+    ///
+    /// Calls to mounted services count as unary unless their method is
+    /// declared with [Server::with_streaming_methods].
+    pub fn with_require_deadline(self, require_deadline: bool) -> Self {
+        let deadline = self.interceptors.deadline.unwrap_or_default();
+        Self {
+            interceptors: Interceptors {
+                deadline: Some(deadline.with_require_deadline(require_deadline)),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Logs a warning for every call taking longer than `threshold`, see
+    /// [SlowRequestLayer].
+    pub fn with_slow_request_log(self, threshold: Duration) -> Self {
+        Self {
+            interceptors: Interceptors {
+                slow: Some(SlowRequestLayer::new(threshold)),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Bounds the execution of unary calls to `timeout`, or to the caller's
+    /// deadline if that is sooner, see [DeadlineLayer::with_handler_timeout].
+    pub fn with_handler_timeout(self, timeout: Duration) -> Self {
+        let deadline = self.interceptors.deadline.unwrap_or_default();
+        Self {
+            interceptors: Interceptors {
+                deadline: Some(deadline.with_handler_timeout(timeout)),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Declares `methods`, full method names like `/foo.v1.Foo/Watch`, of
+    /// services mounted with [Server::with_service] as streaming, exempting
+    /// them from [Server::with_require_deadline] and
+    /// [Server::with_handler_timeout], see
+    /// [DeadlineLayer::with_streaming_method].
+    pub fn with_streaming_methods<M>(self, methods: impl IntoIterator<Item = M>) -> Self
+    where
+        M: Into<String>,
+    {
+        let mut deadline = self.interceptors.deadline.unwrap_or_default();
+        for method in methods {
+            deadline = deadline.with_streaming_method(method);
+        }
+        Self {
+            interceptors: Interceptors {
+                deadline: Some(deadline),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Gives calls arriving without a deadline a default one, `defaults`
+    /// mapping full method names like `/rsketch.v1.hello.Hello/Hello` to
+    /// their timeout and `global` covering the other unary methods.
+    ///
+    /// [Server::run] fails with
+    /// [UnknownMethod](crate::error::Error::UnknownMethod) before binding
+    /// anything if a method isn't served, see
+    /// [DeadlineLayer::with_method_default].
+    pub fn with_default_timeouts<M>(
+        self,
+        defaults: impl IntoIterator<Item = (M, Duration)>,
+        global: Option<Duration>,
+    ) -> Self
+    where
+        M: Into<String>,
+    {
+        let mut deadline = self.interceptors.deadline.unwrap_or_default();
+        for (method, timeout) in defaults {
+            deadline = deadline.with_method_default(method, timeout);
+        }
+        if let Some(timeout) = global {
+            deadline = deadline.with_global_default(timeout);
+        }
+        Self {
+            interceptors: Interceptors {
+                deadline: Some(deadline),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Tags every call with a request ID taken from its `x-request-id`
+    /// metadata or generated, see
+    /// [RequestId](crate::interceptor::request_id::RequestId).
+    pub fn with_request_id(self, request_id: bool) -> Self {
+        Self {
+            interceptors: Interceptors {
+                request_id: request_id.then_some(RequestIdLayer),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Adds custom interceptors to the chain, inside of every built-in one.
+    ///
+    /// Each call appends to the interceptors already added, and the first one
+    /// added sees a request first, see the [interceptor](crate::interceptor)
+    /// module for the full order.
+    pub fn with_interceptors(self, interceptors: impl IntoIterator<Item = Interceptor>) -> Self {
+        let mut custom = self.interceptors.custom;
+        custom.extend(interceptors);
+        Self {
+            interceptors: Interceptors {
+                custom,
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Wraps every RPC in an OpenTelemetry server span that continues the
+    /// trace propagated by the caller.
+    ///
+    /// Spans are exported by the OpenTelemetry layer of the global tracing
+    /// subscriber, so one has to be installed for them to go anywhere. They
+    /// use that layer's tracer provider, which is why this takes no provider
+    /// of its own.
+    pub fn with_tracing(self, tracing: bool) -> Self {
+        Self {
+            interceptors: Interceptors {
+                trace: tracing.then_some(TraceLayer),
+                ..self.interceptors
+            },
+            ..self
+        }
+    }
+
+    /// Serves the metrics registered through [Server::with_metrics] over
+    /// plain HTTP at `/metrics` on `addr`, falling back to the default
+    /// registry otherwise.
+    ///
+    /// The same port serves `/readyz`, failing from the moment shutdown
+    /// begins, and `/livez`.
+    pub fn with_metrics_addr(self, addr: impl Into<String>) -> Self {
+        Self {
+            metrics_addr: Some(addr.into()),
+            ..self
+        }
+    }
+
+    /// Serves until `shutdown` resolves, then stops accepting connections and
+    /// drains in-flight requests.
+    ///
+    /// Draining is bounded by the drain timeout, once it elapses the serving
+    /// task is aborted without waiting for the remaining requests and
+    /// [DrainTimeout](crate::error::Error::DrainTimeout) is returned, so
+    /// callers can tell a forced shutdown from a clean one.
+    ///
+    /// An address like `unix:///tmp/rsketch.sock` listens on a Unix domain
+    /// socket, removing a stale socket file left at that path beforehand and
+    /// the socket file itself once the server stops. A listener set with
+    /// [Server::with_listener] is used instead of any address.
+    pub async fn run<F>(mut self, shutdown: F) -> Result<()>
+    where
+        F: Future<Output = ()>,
+    {
+        let hooks = std::mem::take(&mut self.shutdown_hooks);
+        let drain_timeout = self.drain_timeout;
+        let mut deadline = None;
+        let result = match self.check_methods() {
+            Ok(()) => self.listen(shutdown, &mut deadline).await,
+            Err(err) => Err(err),
+        };
+        finish(result, hooks, deadline, drain_timeout).await
+    }
+
+    /// Fails with [UnknownMethod](crate::error::Error::UnknownMethod) if a
+    /// default timeout names a method that isn't served, so typos surface
+    /// before anything is bound.
+    fn check_methods(&self) -> Result<()> {
+        let Some(deadline) = &self.interceptors.deadline else {
+            return Ok(());
+        };
+        let services: Vec<_> = self.services.iter().map(|service| service.name).collect();
+        deadline
+            .check_methods(&services, &HEALTH_METHODS)
+            .map_err(|method| UnknownMethodSnafu { method }.build())
+    }
+
+    /// Serves like [Server::run] without the shutdown hooks, setting
+    /// `deadline` to the drain deadline once shutdown begins.
+    async fn listen<F>(mut self, shutdown: F, deadline: &mut Option<Instant>) -> Result<()>
+    where
+        F: Future<Output = ()>,
+    {
+        if let Some(listener) = self.listener.take() {
+            if !self.addr.is_empty() {
+                warn!(
+                    "serving on the provided listener, ignoring address {}",
+                    self.addr
+                );
+            }
+            match listener.local_addr() {
+                Ok(addr) => info!("gRPC server listening on {addr}"),
+                Err(_) => info!("gRPC server listening on the provided listener"),
+            }
+            return self
+                .serve_incoming(TcpListenerStream::new(listener), shutdown, deadline)
+                .await;
+        }
+
+        #[cfg(unix)]
+        if let Some(path) = self.addr.strip_prefix(UNIX_SCHEME) {
+            let path = PathBuf::from(path);
+            return self.run_unix(path, shutdown, deadline).await;
+        }
+
+        let listener = TcpListener::bind(&self.addr)
+            .await
+            .context(BindSnafu { addr: &self.addr })?;
+        info!("gRPC server listening on {}", self.addr);
+        self.serve_incoming(TcpListenerStream::new(listener), shutdown, deadline)
+            .await
+    }
+
+    #[cfg(unix)]
+    async fn run_unix<F>(
+        self,
+        path: PathBuf,
+        shutdown: F,
+        deadline: &mut Option<Instant>,
+    ) -> Result<()>
+    where
+        F: Future<Output = ()>,
+    {
+        remove_stale_socket(&path)?;
+        let listener = UnixListener::bind(&path).context(BindSnafu { addr: &self.addr })?;
+        info!("gRPC server listening on {}", self.addr);
+        let result = self
+            .serve_incoming(UnixListenerStream::new(listener), shutdown, deadline)
+            .await;
+        if let Err(err) = std::fs::remove_file(&path) {
+            warn!("failed to remove socket {}: {err}", path.display());
+        }
+        result
+    }
+
+    /// Like [Server::run], but serves the connections yielded by `incoming`
+    /// instead of listening on the configured address, e.g. an
+    /// [in-process](crate::in_process) transport.
+    pub async fn run_with_incoming<I, IO, IE, F>(mut self, incoming: I, shutdown: F) -> Result<()>
+    where
+        I: Stream<Item = std::result::Result<IO, IE>> + Send + 'static,
+        IO: AsyncRead + AsyncWrite + Connected + Unpin + Send + 'static,
+        IO::ConnectInfo: Clone + Send + Sync + 'static,
+        IE: Into<Box<dyn std::error::Error + Send + Sync>>,
+        F: Future<Output = ()>,
+    {
+        let hooks = std::mem::take(&mut self.shutdown_hooks);
+        let drain_timeout = self.drain_timeout;
+        let mut deadline = None;
+        let result = match self.check_methods() {
+            Ok(()) => self.serve_incoming(incoming, shutdown, &mut deadline).await,
+            Err(err) => Err(err),
+        };
+        finish(result, hooks, deadline, drain_timeout).await
+    }
+
+    async fn serve_incoming<I, IO, IE, F>(
+        self,
+        incoming: I,
+        shutdown: F,
+        deadline: &mut Option<Instant>,
+    ) -> Result<()>
+    where
+        I: Stream<Item = std::result::Result<IO, IE>> + Send + 'static,
+        IO: AsyncRead + AsyncWrite + Connected + Unpin + Send + 'static,
+        IO::ConnectInfo: Clone + Send + Sync + 'static,
+        IE: Into<Box<dyn std::error::Error + Send + Sync>>,
+        F: Future<Output = ()>,
+    {
+        let admin = match &self.metrics_addr {
+            Some(addr) => {
+                let listener = TcpListener::bind(addr).await.context(BindSnafu { addr })?;
+                info!("metrics HTTP server listening on {addr}");
+                let registry = self
+                    .metrics
+                    .clone()
+                    .unwrap_or_else(|| prometheus::default_registry().clone());
+                Some(tokio::spawn(admin::serve(
+                    listener,
+                    registry,
+                    self.ready.clone(),
+                )))
+            }
+            None => None,
+        };
+
+        let result = self.serve(incoming, shutdown, deadline).await;
+        if let Some(admin) = admin {
+            admin.abort();
+        }
+        result
+    }
+
+    async fn serve<I, IO, IE, F>(
+        self,
+        incoming: I,
+        shutdown: F,
+        deadline: &mut Option<Instant>,
+    ) -> Result<()>
+    where
+        I: Stream<Item = std::result::Result<IO, IE>> + Send + 'static,
+        IO: AsyncRead + AsyncWrite + Connected + Unpin + Send + 'static,
+        IO::ConnectInfo: Clone + Send + Sync + 'static,
+        IE: Into<Box<dyn std::error::Error + Send + Sync>>,
+        F: Future<Output = ()>,
+    {
+        // Hello is mounted like any other service. Each API version is a
+        // service of its own, named after its versioned package, so v1 keeps
+        // being served unchanged to existing clients next to v2 and a version
+        // is only dropped by removing its registration.
+        let services: Vec<_> = [
+            Registration::new(hello_server(self.build_info.clone(), self.limits)),
+            Registration::new(hello_v2_server(self.build_info, self.limits)),
+        ]
+        .into_iter()
+        .chain(self.services)
+        .collect();
+        let names: Vec<_> = services.iter().map(|service| service.name).collect();
+        let routes = services.into_iter().fold(
+            (self.health_service)(Routes::default()),
+            |routes, service| (service.add)(routes),
+        );
+        let reflection = self
+            .reflection
+            .then(|| {
+                tonic_reflection::server::Builder::configure()
+                    .register_encoded_file_descriptor_set(api::pb::GRPC_DESC)
+                    .build()
+                    .context(ReflectionSnafu)
+            })
+            .transpose()?;
+        let routes = match reflection {
+            Some(reflection) => routes.add_service(reflection),
+            None => routes,
+        };
+        // Messages are validated and logged up to the size Hello decodes.
+        let max_message_size = self.limits.recv.unwrap_or(DEFAULT_MAX_MESSAGE_SIZE);
+        let interceptors = Interceptors {
+            validate: ValidateLayer::new(max_message_size),
+            payload: self
+                .interceptors
+                .payload
+                .map(|payload| payload.with_max_message_size(max_message_size)),
+            ..self.interceptors
+        };
+        let service = interceptors.layer(grpc_service(routes));
+        for name in &names {
+            self.health.set_serving_status(name, true).await;
+        }
+        self.ready.store(true, Ordering::Release);
+
+        let (drain_tx, drain_rx) = watch::channel(());
+        let mut serving = tokio::spawn(connection::serve(
+            incoming,
+            service,
+            self.keepalive,
+            self.tls.map(TlsAcceptor::from),
+            drain_rx,
+        ));
+
+        tokio::select! {
+            res = &mut serving => return join(res),
+            _ = shutdown => {}
+        }
+
+        // Tell load balancers to stop routing here before draining.
+        self.ready.store(false, Ordering::Release);
+        self.health.set_serving_status("", false).await;
+        for name in &names {
+            self.health.set_serving_status(name, false).await;
+        }
+
+        info!(
+            "shutting down gRPC server, draining for up to {:?}",
+            self.drain_timeout
+        );
+        let drain_deadline = *deadline.insert(Instant::now() + self.drain_timeout);
+        let _ = drain_tx.send(());
+        match tokio::time::timeout_at(drain_deadline, &mut serving).await {
+            Ok(res) => join(res),
+            Err(_) => {
+                warn!("drain timeout elapsed, stopping gRPC server");
+                stop(serving).await;
+                DrainTimeoutSnafu {
+                    timeout: self.drain_timeout,
+                }
+                .fail()
+            }
+        }
+    }
+}
+
+/// Type erases `routes`, turning its errors into `INTERNAL` responses.
+fn grpc_service(routes: Routes) -> GrpcService {
+    GrpcService::new(routes.map_result(|result| {
+        Ok::<_, Infallible>(
+            result.unwrap_or_else(|err| Status::internal(err.to_string()).to_http()),
+        )
+    }))
+}
+
+fn hello_server(build_info: BuildInfo, limits: MessageLimits) -> HelloServer<HelloService> {
+    // Responses are only compressed for clients that advertise gzip.
+    let mut server = HelloServer::new(HelloService::new(build_info))
+        .accept_compressed(CompressionEncoding::Gzip)
+        .send_compressed(CompressionEncoding::Gzip);
+    if let Some(limit) = limits.recv {
+        server = server.max_decoding_message_size(limit);
+    }
+    if let Some(limit) = limits.send {
+        server = server.max_encoding_message_size(limit);
+    }
+    server
+}
+
+fn hello_v2_server(build_info: BuildInfo, limits: MessageLimits) -> HelloV2Server<HelloV2Service> {
+    let mut server = HelloV2Server::new(HelloV2Service::new(build_info))
+        .accept_compressed(CompressionEncoding::Gzip)
+        .send_compressed(CompressionEncoding::Gzip);
+    if let Some(limit) = limits.recv {
+        server = server.max_decoding_message_size(limit);
+    }
+    if let Some(limit) = limits.send {
+        server = server.max_encoding_message_size(limit);
+    }
+    server
+}
+
+/// Methods of the `grpc.health.v1.Health` service mounted on every server.
+const HEALTH_METHODS: [&str; 2] = [
+    "/grpc.health.v1.Health/Check",
+    "/grpc.health.v1.Health/Watch",
+];
+
+/// Prefix of addresses naming a Unix domain socket.
+#[cfg(unix)]
+const UNIX_SCHEME: &str = "unix://";
+
+/// Removes the socket file a previous server failed to clean up, which
+/// would otherwise make binding fail. Anything other than a socket is left
+/// alone.
+#[cfg(unix)]
+fn remove_stale_socket(path: &Path) -> Result<()> {
+    use std::os::unix::fs::FileTypeExt;
+
+    use crate::error::RemoveSocketSnafu;
+
+    match std::fs::symlink_metadata(path) {
+        Ok(metadata) if metadata.file_type().is_socket() => {
+            std::fs::remove_file(path).context(RemoveSocketSnafu { path })
+        }
+        _ => Ok(()),
+    }
+}
+
+fn read_pem(path: impl AsRef<Path>) -> Result<Vec<u8>> {
+    let path = path.as_ref();
+    std::fs::read(path).context(ReadTlsSnafu { path })
+}
+
+/// Builds the TLS configuration serving the certificate chain and private
+/// key in `cert_pem` and `key_pem`, requiring clients to present a
+/// certificate signed by the CA in `client_ca_pem` if given.
+fn tls_config(
+    cert_pem: &[u8],
+    key_pem: &[u8],
+    client_ca_pem: Option<&[u8]>,
+) -> Result<Arc<ServerConfig>> {
+    let certs = certs_from_pem(cert_pem, "certificate")?;
+    let key = key_from_pem(key_pem)?;
+    let builder = ServerConfig::builder();
+    let builder = match client_ca_pem {
+        Some(pem) => {
+            let mut roots = RootCertStore::empty();
+            for cert in certs_from_pem(pem, "client CA certificate")? {
+                roots.add(cert).context(TlsConfigSnafu)?;
+            }
+            let verifier = WebPkiClientVerifier::builder(Arc::new(roots))
+                .build()
+                .context(ClientCaSnafu)?;
+            builder.with_client_cert_verifier(verifier)
+        }
+        None => builder.with_no_client_auth(),
+    };
+    let mut config = builder
+        .with_single_cert(certs, key)
+        .context(TlsConfigSnafu)?;
+    // gRPC only runs over HTTP/2.
+    config.alpn_protocols = vec![b"h2".to_vec()];
+    Ok(Arc::new(config))
+}
+
+/// Parses the certificate chain in `pem`, failing if there is none.
+fn certs_from_pem(mut pem: &[u8], what: &'static str) -> Result<Vec<CertificateDer<'static>>> {
+    let certs = rustls_pemfile::certs(&mut pem)
+        .collect::<std::result::Result<Vec<_>, _>>()
+        .context(InvalidPemSnafu { what })?;
+    ensure!(!certs.is_empty(), MissingPemSnafu { what });
+    Ok(certs)
+}
+
+/// Parses the private key in `pem`.
+fn key_from_pem(mut pem: &[u8]) -> Result<PrivateKeyDer<'static>> {
+    let what = "private key";
+    rustls_pemfile::private_key(&mut pem)
+        .context(InvalidPemSnafu { what })?
+        .context(MissingPemSnafu { what })
+}
+
+fn join(res: std::result::Result<(), tokio::task::JoinError>) -> Result<()> {
+    res.context(ServerTaskSnafu)
+}
+
+/// Runs `hooks` once serving ended with `result`, by the drain `deadline`
+/// if shutdown began, otherwise within a full `drain_timeout`.
+///
+/// A failed run takes precedence over failed hooks.
+async fn finish(
+    result: Result<()>,
+    hooks: Vec<ShutdownHook>,
+    deadline: Option<Instant>,
+    drain_timeout: Duration,
+) -> Result<()> {
+    let deadline = deadline.unwrap_or_else(|| Instant::now() + drain_timeout);
+    let hooks = run_shutdown_hooks(hooks, deadline).await;
+    result.and(hooks)
+}
+
+/// Runs `hooks` last to first, collecting their failures.
+async fn run_shutdown_hooks(hooks: Vec<ShutdownHook>, deadline: Instant) -> Result<()> {
+    let mut errors = Vec::new();
+    for hook in hooks.into_iter().rev() {
+        let err = match tokio::time::timeout_at(deadline, hook()).await {
+            Ok(Ok(())) => continue,
+            Ok(Err(err)) => err,
+            Err(_) => "timed out at the drain deadline".into(),
+        };
+        warn!("shutdown hook failed: {err}");
+        errors.push(err);
+    }
+    if errors.is_empty() {
+        Ok(())
+    } else {
+        ShutdownHooksSnafu { errors }.fail()
+    }
+}
+
+/// Aborts the serving task, dropping every open connection.
+async fn stop(serving: JoinHandle<()>) {
+    serving.abort();
+    let _ = serving.await;
+}
+
+#[cfg(test)]
+mod tests {
+    use api::pb::{
+        v1::hello::{hello_client::HelloClient, HelloRequest},
+        v2::hello::{hello_client::HelloClient as HelloV2Client, HelloRequest as HelloV2Request},
+    };
+    use prost::Message;
+    use prost_types::FileDescriptorProto;
+    use tonic::Code;
+    use tonic_health::pb::{
+        health_check_response::ServingStatus, health_client::HealthClient, HealthCheckRequest,
+    };
+    use tonic_reflection::pb::{
+        server_reflection_client::ServerReflectionClient,
+        server_reflection_request::MessageRequest, server_reflection_response::MessageResponse,
+        ServerReflectionRequest,
+    };
+
+    use super::*;
+    use crate::{error::Error, in_process::InProcessServer};
+
+    fn reflection_request(message_request: MessageRequest) -> ServerReflectionRequest {
+        ServerReflectionRequest {
+            host:            String::new(),
+            message_request: Some(message_request),
+        }
+    }
+
+    async fn reflect(server: &InProcessServer, request: MessageRequest) -> MessageResponse {
+        let mut client = ServerReflectionClient::new(server.channel());
+        let requests = tokio_stream::once(reflection_request(request));
+        let mut responses = client
+            .server_reflection_info(requests)
+            .await
+            .unwrap()
+            .into_inner();
+        let response = responses.message().await.unwrap().unwrap();
+        response.message_response.unwrap()
+    }
+
+    #[tokio::test]
+    async fn reflection_lists_hello_and_its_methods() {
+        let server = InProcessServer::start(Server::new("").with_reflection(true));
+
+        let request = MessageRequest::ListServices(String::new());
+        let MessageResponse::ListServicesResponse(list) = reflect(&server, request).await else {
+            panic!("expected a service list");
+        };
+        let services: Vec<_> = list.service.iter().map(|s| s.name.as_str()).collect();
+        assert!(services.contains(&"rsketch.v1.hello.Hello"), "{services:?}");
+
+        let request = MessageRequest::FileContainingSymbol("rsketch.v1.hello.Hello".to_string());
+        let MessageResponse::FileDescriptorResponse(files) = reflect(&server, request).await else {
+            panic!("expected file descriptors");
+        };
+        let methods: Vec<_> = files
+            .file_descriptor_proto
+            .iter()
+            .map(|file| FileDescriptorProto::decode(file.as_slice()).unwrap())
+            .filter(|file| file.package() == "rsketch.v1.hello")
+            .flat_map(|file| file.service)
+            .flat_map(|service| service.method)
+            .map(|method| method.name().to_string())
+            .collect();
+        for method in ["Hello", "HelloStream", "HelloChat", "ListGreetings"] {
+            assert!(methods.iter().any(|m| m == method), "{methods:?}");
+        }
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn both_hello_versions_are_served_side_by_side() {
+        let build_info = BuildInfo {
+            version: "1.2.3-test".to_string(),
+            ..BuildInfo::default()
+        };
+        let server = InProcessServer::start(Server::new("").with_build_info(build_info));
+
+        let request = HelloRequest {
+            name: "Ada".to_string(),
+        };
+        let v1 = HelloClient::new(server.channel())
+            .hello(request)
+            .await
+            .unwrap()
+            .into_inner();
+        assert_eq!(v1.message, "Hello, Ada");
+
+        let request = HelloV2Request {
+            name: "Ada".to_string(),
+        };
+        let v2 = HelloV2Client::new(server.channel())
+            .hello(request)
+            .await
+            .unwrap()
+            .into_inner();
+        assert_eq!(v2.message, v1.message);
+        assert_eq!(v2.server_version, "1.2.3-test");
+        assert!(v2.served_at.is_some());
+        server.shutdown().await.unwrap();
+    }
+
+    fn service_name<S: NamedService>(_: &S) -> &'static str { S::NAME }
+
+    #[tokio::test]
+    async fn mounted_services_are_served_and_report_their_health() {
+        // Reflection stands in for any generated service.
+        let service = tonic_reflection::server::Builder::configure()
+            .register_encoded_file_descriptor_set(api::pb::GRPC_DESC)
+            .build()
+            .unwrap();
+        let name = service_name(&service);
+        let server = Server::new("").with_service(service);
+        let health = server.health();
+        let server = InProcessServer::start(server);
+
+        let request = MessageRequest::ListServices(String::new());
+        let MessageResponse::ListServicesResponse(list) = reflect(&server, request).await else {
+            panic!("expected a service list");
+        };
+        assert!(!list.service.is_empty());
+
+        let mut client = HealthClient::new(server.channel());
+        let check = |service: &str| HealthCheckRequest {
+            service: service.to_string(),
+        };
+        let status = client.check(check(name)).await.unwrap().into_inner().status;
+        assert_eq!(status, ServingStatus::Serving as i32);
+
+        health.set_serving_status(name, false).await;
+        let status = client.check(check(name)).await.unwrap().into_inner().status;
+        assert_eq!(status, ServingStatus::NotServing as i32);
+        // The other services are unaffected.
+        let hello = client
+            .check(check("rsketch.v1.hello.Hello"))
+            .await
+            .unwrap()
+            .into_inner()
+            .status;
+        assert_eq!(hello, ServingStatus::Serving as i32);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn reflection_is_off_by_default() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = ServerReflectionClient::new(server.channel());
+        let requests = tokio_stream::once(reflection_request(MessageRequest::ListServices(
+            String::new(),
+        )));
+        let status = client.server_reflection_info(requests).await.unwrap_err();
+        assert_eq!(status.code(), Code::Unimplemented);
+
+        // The Hello service is unaffected.
+        let mut client = HelloClient::new(server.channel());
+        client.hello(HelloRequest::default()).await.unwrap();
+    }
+
+    /// Records the order hooks run in, the hook numbered `fail` failing.
+    fn with_hooks(
+        mut server: Server,
+        ran: &Arc<std::sync::Mutex<Vec<usize>>>,
+        fail: usize,
+    ) -> Server {
+        for hook in 1..=3 {
+            let ran = ran.clone();
+            server = server.with_shutdown_hook(move || async move {
+                ran.lock().unwrap().push(hook);
+                if hook == fail {
+                    return Err(format!("hook {hook} failed").into());
+                }
+                Ok(())
+            });
+        }
+        server
+    }
+
+    fn hook_errors(result: Result<()>) -> Vec<String> {
+        match result {
+            Err(Error::ShutdownHooks { errors }) => {
+                errors.iter().map(ToString::to_string).collect()
+            }
+            other => panic!("expected failed hooks, got {other:?}"),
+        }
+    }
+
+    #[tokio::test]
+    async fn shutdown_hooks_run_last_to_first_collecting_failures() {
+        let ran = Arc::default();
+        let server = InProcessServer::start(with_hooks(Server::new(""), &ran, 2));
+
+        let errors = hook_errors(server.shutdown().await);
+        assert_eq!(errors, ["hook 2 failed"]);
+        assert_eq!(*ran.lock().unwrap(), [3, 2, 1]);
+    }
+
+    #[tokio::test]
+    async fn shutdown_hooks_run_when_serving_ends_on_its_own() {
+        let ran = Arc::default();
+        let server = with_hooks(Server::new(""), &ran, 0);
+
+        // The connections run out without shutdown ever being requested.
+        let incoming = tokio_stream::empty::<std::io::Result<tokio::io::DuplexStream>>();
+        let _ = server
+            .run_with_incoming(incoming, std::future::pending())
+            .await;
+        assert_eq!(*ran.lock().unwrap(), [3, 2, 1]);
+    }
+
+    #[tokio::test]
+    async fn shutdown_hooks_run_when_the_server_fails_to_start() {
+        let ran = Arc::default();
+        let server = with_hooks(Server::new("").with_metrics_addr("not an address"), &ran, 0);
+
+        let incoming = tokio_stream::pending::<std::io::Result<tokio::io::DuplexStream>>();
+        let result = server.run_with_incoming(incoming, async {}).await;
+        assert!(matches!(result, Err(Error::Bind { .. })), "{result:?}");
+        assert_eq!(*ran.lock().unwrap(), [3, 2, 1]);
+    }
+
+    #[tokio::test]
+    async fn shutdown_hooks_share_the_drain_deadline() {
+        let server = Server::new("")
+            .with_drain_timeout(Duration::from_millis(100))
+            .with_shutdown_hook(|| async {
+                tokio::time::sleep(Duration::from_secs(10)).await;
+                Ok(())
+            })
+            .with_shutdown_hook(|| async { Ok(()) });
+        let server = InProcessServer::start(server);
+
+        let started = Instant::now();
+        let errors = hook_errors(server.shutdown().await);
+        assert_eq!(errors, ["timed out at the drain deadline"]);
+        assert!(started.elapsed() < Duration::from_secs(1));
+    }
+
+    #[tokio::test]
+    async fn serves_on_a_listener_bound_to_port_zero() {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        assert_ne!(addr.port(), 0);
+        // The listener wins over the address, which is never bound.
+        let (shutdown, shutdown_rx) = tokio::sync::oneshot::channel::<()>();
+        let serving = tokio::spawn(Server::new("127.0.0.1:1").with_listener(listener).run(
+            async move {
+                let _ = shutdown_rx.await;
+            },
+        ));
+
+        let channel = tonic::transport::Endpoint::from_shared(format!("http://{addr}"))
+            .unwrap()
+            .connect()
+            .await
+            .unwrap();
+        let request = HelloRequest {
+            name: "Ada".to_string(),
+        };
+        let reply = HelloClient::new(channel).hello(request).await.unwrap();
+        assert_eq!(reply.into_inner().message, "Hello, Ada");
+
+        shutdown.send(()).unwrap();
+        serving.await.unwrap().unwrap();
+    }
+
+    #[tokio::test]
+    async fn shutdown_cuts_calls_still_running_at_the_drain_timeout() {
+        let server =
+            InProcessServer::start(Server::new("").with_drain_timeout(Duration::from_millis(200)));
+        let mut client = HelloClient::new(server.channel());
+
+        // The chat goes on for as long as the client keeps it open.
+        let (names, rx) = tokio::sync::mpsc::unbounded_channel();
+        let requests = tokio_stream::wrappers::UnboundedReceiverStream::new(rx);
+        let mut replies = client.hello_chat(requests).await.unwrap().into_inner();
+        names
+            .send(HelloRequest {
+                name: "Ada".to_string(),
+            })
+            .unwrap();
+        assert!(replies.message().await.unwrap().is_some());
+
+        let started = Instant::now();
+        let result = server.shutdown().await;
+        assert!(
+            matches!(result, Err(Error::DrainTimeout { .. })),
+            "{result:?}"
+        );
+        assert!(started.elapsed() < Duration::from_secs(1));
+
+        let cut = tokio::time::timeout(Duration::from_secs(5), replies.message()).await;
+        assert!(cut.unwrap().is_err(), "the chat should have been cut off");
+        drop(names);
+    }
+}
@@ -0,0 +1,396 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::sync::Arc;
+
+use api::pb::v1::hello::{
+    hello_server::Hello, HelloRequest, HelloResponse, HelloStreamRequest, InfoResponse,
+    ListGreetingsRequest, ListGreetingsResponse, PingRequest, PingResponse,
+};
+use tokio::sync::mpsc;
+use tokio_stream::wrappers::ReceiverStream;
+use tonic::{Code, Request, Response, Status, Streaming};
+
+use super::page::paginate;
+use crate::{
+    build_info::BuildInfo,
+    interceptor::{
+        deadline::Deadline,
+        identity::{identity_from_request, Identity},
+    },
+    status::new_error_info,
+};
+
+/// The name greeted when the caller leaves it empty.
+const DEFAULT_NAME: &str = "world";
+
+/// How many greetings a stream may buffer ahead of the client.
+const STREAM_BUFFER: usize = 16;
+
+/// The largest payload `Ping` echoes, in bytes.
+const MAX_PING_PAYLOAD: usize = 64 * 1024;
+
+/// The greetings listed by `ListGreetings`, in listing order.
+const GREETINGS: &[&str] = &[
+    "Hello",
+    "Hola",
+    "Bonjour",
+    "Hallo",
+    "Ciao",
+    "Olá",
+    "Hej",
+    "Ahoj",
+    "Cześć",
+    "Merhaba",
+    "Salam",
+    "Namaste",
+    "Konnichiwa",
+    "Annyeonghaseyo",
+    "Ni hao",
+    "Xin chào",
+    "Sawasdee",
+    "Jambo",
+    "Sannu",
+    "Aloha",
+    "Kia ora",
+    "Shalom",
+    "Yassas",
+    "Privet",
+    "Szia",
+];
+
+/// Implementation of the `rsketch.v1.hello.Hello` service.
+#[derive(Debug, Default, Clone)]
+pub struct HelloService {
+    info: Arc<BuildInfo>,
+}
+
+impl HelloService {
+    pub fn new(info: BuildInfo) -> Self {
+        Self {
+            info: Arc::new(info),
+        }
+    }
+}
+
+/// Builds the greeting for `name`, falling back to [DEFAULT_NAME].
+pub(super) fn greeting(name: &str) -> String {
+    let name = if name.is_empty() { DEFAULT_NAME } else { name };
+    format!("Hello, {name}")
+}
+
+/// Returns the name to greet, the authenticated caller's subject when the
+/// request leaves it empty.
+pub(super) fn name_or_caller<'a>(name: &'a str, identity: Option<&'a Identity>) -> &'a str {
+    match identity {
+        Some(identity) if name.is_empty() => &identity.subject,
+        _ => name,
+    }
+}
+
+/// Fails with `DeadlineExceeded` if the caller has already given up.
+pub(super) fn check_deadline(deadline: Option<Deadline>) -> Result<(), Status> {
+    match deadline {
+        Some(deadline) if deadline.is_expired() => {
+            Err(Status::deadline_exceeded("deadline exceeded"))
+        }
+        _ => Ok(()),
+    }
+}
+
+/// Resolves once `deadline` passes, never if there is none.
+async fn expired(deadline: Option<Deadline>) {
+    match deadline {
+        Some(deadline) => tokio::time::sleep_until(deadline.instant()).await,
+        None => std::future::pending().await,
+    }
+}
+
+#[tonic::async_trait]
+impl Hello for HelloService {
+    type HelloChatStream = ReceiverStream<Result<HelloResponse, Status>>;
+    type HelloStreamStream = ReceiverStream<Result<HelloResponse, Status>>;
+
+    async fn hello(
+        &self,
+        request: Request<HelloRequest>,
+    ) -> Result<Response<HelloResponse>, Status> {
+        check_deadline(Deadline::from_request(&request))?;
+        let identity = identity_from_request(&request).cloned();
+        let request = request.into_inner();
+        let message = greeting(name_or_caller(&request.name, identity.as_ref()));
+        Ok(Response::new(HelloResponse { message }))
+    }
+
+    async fn hello_stream(
+        &self,
+        request: Request<HelloStreamRequest>,
+    ) -> Result<Response<Self::HelloStreamStream>, Status> {
+        let deadline = Deadline::from_request(&request);
+        check_deadline(deadline)?;
+        let identity = identity_from_request(&request).cloned();
+        let names = request.into_inner().names;
+        let (tx, rx) = mpsc::channel(STREAM_BUFFER);
+
+        tokio::spawn(async move {
+            let expired = expired(deadline);
+            tokio::pin!(expired);
+
+            for name in names {
+                let response = HelloResponse {
+                    message: greeting(name_or_caller(&name, identity.as_ref())),
+                };
+                tokio::select! {
+                    sent = tx.send(Ok(response)) => {
+                        // The receiver is dropped once the client goes away,
+                        // stop producing greetings nobody will read.
+                        if sent.is_err() {
+                            break;
+                        }
+                    }
+                    () = &mut expired => {
+                        let status = Status::deadline_exceeded("deadline exceeded");
+                        let _ = tx.send(Err(status)).await;
+                        break;
+                    }
+                }
+            }
+        });
+
+        Ok(Response::new(ReceiverStream::new(rx)))
+    }
+
+    async fn hello_chat(
+        &self,
+        request: Request<Streaming<HelloRequest>>,
+    ) -> Result<Response<Self::HelloChatStream>, Status> {
+        let deadline = Deadline::from_request(&request);
+        check_deadline(deadline)?;
+        let identity = identity_from_request(&request).cloned();
+        let mut requests = request.into_inner();
+        let (tx, rx) = mpsc::channel(STREAM_BUFFER);
+
+        // Reading and replying in one task means a client sending faster
+        // than it reads is slowed down by flow control rather than buffered
+        // without bound.
+        tokio::spawn(async move {
+            let expired = expired(deadline);
+            tokio::pin!(expired);
+
+            loop {
+                let reply = tokio::select! {
+                    received = requests.message() => match received {
+                        Ok(Some(request)) => Ok(HelloResponse {
+                            message: greeting(name_or_caller(&request.name, identity.as_ref())),
+                        }),
+                        // The client half-closed, end the stream cleanly.
+                        Ok(None) => break,
+                        Err(status) => Err(status),
+                    },
+                    () = &mut expired => Err(Status::deadline_exceeded("deadline exceeded")),
+                };
+                let failed = reply.is_err();
+                // The receiver is dropped once the client goes away.
+                if tx.send(reply).await.is_err() || failed {
+                    break;
+                }
+            }
+        });
+
+        Ok(Response::new(ReceiverStream::new(rx)))
+    }
+
+    async fn list_greetings(
+        &self,
+        request: Request<ListGreetingsRequest>,
+    ) -> Result<Response<ListGreetingsResponse>, Status> {
+        let request = request.into_inner();
+        let (page, next_page_token) = paginate(GREETINGS, request.page_size, &request.page_token)?;
+        Ok(Response::new(ListGreetingsResponse {
+            greetings: page.iter().map(ToString::to_string).collect(),
+            next_page_token,
+        }))
+    }
+
+    async fn ping(&self, request: Request<PingRequest>) -> Result<Response<PingResponse>, Status> {
+        let payload = request.into_inner().payload;
+        if payload.len() > MAX_PING_PAYLOAD {
+            return Err(new_error_info(
+                Code::ResourceExhausted,
+                format!("payload exceeds {MAX_PING_PAYLOAD} bytes"),
+                "PAYLOAD_TOO_LARGE",
+            ));
+        }
+        Ok(Response::new(PingResponse { payload }))
+    }
+
+    async fn get_info(&self, _: Request<()>) -> Result<Response<InfoResponse>, Status> {
+        let BuildInfo {
+            version,
+            git_commit,
+            build_time,
+            rustc_version,
+        } = BuildInfo::clone(&self.info);
+        Ok(Response::new(InfoResponse {
+            version,
+            git_commit,
+            build_time,
+            rustc_version,
+        }))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use api::{pb::v1::hello::hello_client::HelloClient, validate::MAX_NAME_LEN};
+    use tonic_types::StatusExt;
+
+    use super::*;
+    use crate::{in_process::InProcessServer, Server};
+
+    fn hello(name: &str) -> HelloRequest {
+        HelloRequest {
+            name: name.to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn rejects_invalid_names_naming_the_field() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel());
+
+        for name in ["n".repeat(MAX_NAME_LEN + 1), "bell\u{7}".to_string()] {
+            let status = client.hello(hello(&name)).await.unwrap_err();
+            assert_eq!(status.code(), Code::InvalidArgument);
+            assert!(status.message().contains("name"), "{}", status.message());
+            let details = status.get_details_bad_request().unwrap();
+            assert_eq!(details.field_violations.len(), 1);
+            assert_eq!(details.field_violations[0].field, "name");
+        }
+
+        let name = "n".repeat(MAX_NAME_LEN);
+        let reply = client.hello(hello(&name)).await.unwrap().into_inner();
+        assert_eq!(reply.message, greeting(&name));
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn get_info_reports_the_build_info_of_the_server() {
+        let build_info = BuildInfo {
+            version:       "1.2.3".to_string(),
+            git_commit:    "0123abc".to_string(),
+            build_time:    "Wed, 14 Oct 2026 04:22:00 +0000".to_string(),
+            rustc_version: "rustc 1.77.0".to_string(),
+        };
+        let server = InProcessServer::start(Server::new("").with_build_info(build_info));
+
+        let info = HelloClient::new(server.channel())
+            .get_info(())
+            .await
+            .unwrap()
+            .into_inner();
+        assert_eq!(
+            info,
+            InfoResponse {
+                version:       "1.2.3".to_string(),
+                git_commit:    "0123abc".to_string(),
+                build_time:    "Wed, 14 Oct 2026 04:22:00 +0000".to_string(),
+                rustc_version: "rustc 1.77.0".to_string(),
+            }
+        );
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn ping_echoes_payloads_up_to_the_limit() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel());
+
+        let patterned: Vec<u8> = (0..=255).cycle().take(1000).collect();
+        for payload in [Vec::new(), patterned, vec![0xff; MAX_PING_PAYLOAD]] {
+            let request = PingRequest {
+                payload: payload.clone(),
+            };
+            let reply = client.ping(request).await.unwrap().into_inner();
+            assert_eq!(reply.payload, payload);
+        }
+
+        let request = PingRequest {
+            payload: vec![0; MAX_PING_PAYLOAD + 1],
+        };
+        let status = client.ping(request).await.unwrap_err();
+        assert_eq!(status.code(), Code::ResourceExhausted);
+        let info = status.get_details_error_info().unwrap();
+        assert_eq!(info.reason, "PAYLOAD_TOO_LARGE");
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn pages_list_every_greeting_exactly_once() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel());
+
+        let mut listed = Vec::new();
+        let mut page_token = String::new();
+        loop {
+            let request = ListGreetingsRequest {
+                page_size: 4,
+                page_token,
+            };
+            let page = client.list_greetings(request).await.unwrap().into_inner();
+            assert!(page.greetings.len() <= 4);
+            listed.extend(page.greetings);
+            if page.next_page_token.is_empty() {
+                break;
+            }
+            page_token = page.next_page_token;
+        }
+        assert_eq!(listed, GREETINGS);
+
+        let request = ListGreetingsRequest {
+            page_size:  1000,
+            page_token: String::new(),
+        };
+        let page = client.list_greetings(request).await.unwrap().into_inner();
+        assert_eq!(page.greetings, GREETINGS);
+        assert!(page.next_page_token.is_empty());
+
+        let request = ListGreetingsRequest {
+            page_size:  4,
+            page_token: "not a token".to_string(),
+        };
+        let status = client.list_greetings(request).await.unwrap_err();
+        assert_eq!(status.code(), Code::InvalidArgument);
+        server.shutdown().await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn chat_greets_each_name_in_order_until_the_client_closes() {
+        let server = InProcessServer::start(Server::new(""));
+        let mut client = HelloClient::new(server.channel());
+
+        let (names, rx) = mpsc::unbounded_channel();
+        let requests = tokio_stream::wrappers::UnboundedReceiverStream::new(rx);
+        let mut replies = client.hello_chat(requests).await.unwrap().into_inner();
+        for name in ["Ada", "Grace", "Linus"] {
+            names.send(hello(name)).unwrap();
+            let reply = replies.message().await.unwrap().unwrap();
+            assert_eq!(reply.message, greeting(name));
+        }
+
+        drop(names);
+        assert!(replies.message().await.unwrap().is_none());
+        server.shutdown().await.unwrap();
+    }
+}
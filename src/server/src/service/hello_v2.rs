@@ -0,0 +1,59 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+use std::{sync::Arc, time::SystemTime};
+
+use api::pb::v2::hello::{hello_server::Hello, HelloRequest, HelloResponse};
+use tonic::{Request, Response, Status};
+
+use super::hello::{check_deadline, greeting, name_or_caller};
+use crate::{
+    build_info::BuildInfo,
+    interceptor::{deadline::Deadline, identity::identity_from_request},
+};
+
+/// Implementation of the `rsketch.v2.hello.Hello` service, greeting like v1
+/// with the serving time and version added.
+///
+/// The version is the one of the [BuildInfo] that v1 `GetInfo` reports, so
+/// both API versions agree on what is running.
+#[derive(Debug, Default, Clone)]
+pub struct HelloV2Service {
+    info: Arc<BuildInfo>,
+}
+
+impl HelloV2Service {
+    pub fn new(info: BuildInfo) -> Self {
+        Self {
+            info: Arc::new(info),
+        }
+    }
+}
+
+#[tonic::async_trait]
+impl Hello for HelloV2Service {
+    async fn hello(
+        &self,
+        request: Request<HelloRequest>,
+    ) -> Result<Response<HelloResponse>, Status> {
+        check_deadline(Deadline::from_request(&request))?;
+        let identity = identity_from_request(&request).cloned();
+        let request = request.into_inner();
+        Ok(Response::new(HelloResponse {
+            message:        greeting(name_or_caller(&request.name, identity.as_ref())),
+            served_at:      Some(SystemTime::now().into()),
+            server_version: self.info.version.clone(),
+        }))
+    }
+}
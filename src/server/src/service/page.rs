@@ -0,0 +1,63 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Offset based pagination behind opaque page tokens.
+
+use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
+use tonic::Status;
+
+use crate::status::new_bad_request;
+
+/// Page size used when the request leaves it at zero.
+pub(crate) const DEFAULT_PAGE_SIZE: usize = 10;
+
+/// Largest page a request may ask for, bigger sizes are clamped to it.
+pub(crate) const MAX_PAGE_SIZE: usize = 100;
+
+/// Returns the page of `items` selected by `page_size` and `page_token`,
+/// along with the token for the next page, empty on the last one.
+///
+/// Malformed tokens and negative sizes fail with `InvalidArgument`.
+pub(crate) fn paginate<T>(
+    items: &[T],
+    page_size: i32,
+    page_token: &str,
+) -> Result<(&[T], String), Status> {
+    let page_size = match usize::try_from(page_size) {
+        Ok(0) => DEFAULT_PAGE_SIZE,
+        Ok(size) => size.min(MAX_PAGE_SIZE),
+        Err(_) => return Err(new_bad_request("page_size", "must not be negative")),
+    };
+    let start = decode_token(page_token)
+        .filter(|&offset| offset <= items.len())
+        .ok_or_else(|| new_bad_request("page_token", "malformed page token"))?;
+    let end = start.saturating_add(page_size).min(items.len());
+    let next_page_token = if end < items.len() {
+        encode_token(end)
+    } else {
+        String::new()
+    };
+    Ok((&items[start..end], next_page_token))
+}
+
+/// Encodes `offset` as an opaque token, so clients don't build their own.
+fn encode_token(offset: usize) -> String { URL_SAFE_NO_PAD.encode(offset.to_string()) }
+
+/// Decodes a token made by [encode_token], the empty token is offset zero.
+fn decode_token(token: &str) -> Option<usize> {
+    if token.is_empty() {
+        return Some(0);
+    }
+    let decoded = URL_SAFE_NO_PAD.decode(token).ok()?;
+    std::str::from_utf8(&decoded).ok()?.parse().ok()
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Rsketch
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//! Statuses carrying structured error details, which clients can read back
+//! with [tonic_types::StatusExt], e.g. `status.get_details_bad_request()`.
+
+use std::collections::HashMap;
+
+use api::validate::FieldViolation;
+use tonic::{Code, Status};
+use tonic_types::{ErrorDetails, FieldViolation as DetailViolation, StatusExt};
+
+/// The domain reported in the `ErrorInfo` details of rsketch errors.
+pub const ERROR_DOMAIN: &str = "rsketch";
+
+/// Returns an `InvalidArgument` status with a `BadRequest` detail naming
+/// `field` as the offending request field.
+pub fn new_bad_request(field: impl Into<String>, description: impl Into<String>) -> Status {
+    bad_request(&[FieldViolation {
+        field:       field.into(),
+        description: description.into(),
+    }])
+}
+
+/// Returns an `InvalidArgument` status with a `BadRequest` detail listing
+/// every violation, also summarized in the message.
+pub fn bad_request(violations: &[FieldViolation]) -> Status {
+    let message: Vec<_> = violations.iter().map(ToString::to_string).collect();
+    let details = ErrorDetails::with_bad_request(
+        violations
+            .iter()
+            .map(|violation| {
+                DetailViolation::new(violation.field.clone(), violation.description.clone())
+            })
+            .collect(),
+    );
+    Status::with_error_details(Code::InvalidArgument, message.join("; "), details)
+}
+
+/// Returns a status with an `ErrorInfo` detail carrying `reason`, a
+/// machine-readable `UPPER_SNAKE_CASE` identifier for the failure.
+pub fn new_error_info(code: Code, message: impl Into<String>, reason: impl Into<String>) -> Status {
+    let details = ErrorDetails::with_error_info(reason, ERROR_DOMAIN, HashMap::new());
+    Status::with_error_details(code, message, details)
+}